@@ -9,6 +9,7 @@ import (
 
 	"github.com/apolloconfig/agollo/v4"
 	"github.com/apolloconfig/agollo/v4/env/config"
+	"github.com/rickylin614/common/cetcd"
 	"github.com/rickylin614/common/utils"
 	"github.com/rickylin614/common/zlog"
 	"github.com/spf13/viper"
@@ -18,6 +19,8 @@ import (
 var (
 	// 保存連線設定
 	cli *agollo.Client
+	// 不使用apollo時 改以etcd作為設定來源
+	etcdCfg *cetcd.ConfigSource
 	// 保存namespace
 	Namespace *string
 	// Unit Test使用 若為true則getValue改吃mockMap的資料
@@ -92,6 +95,21 @@ func InitWithConfig(ymlFile ...string) Listener {
 	return InitApollo(*appid, *host, *namespace, *cluster, *secretkey)
 }
 
+/*
+	不使用apollo時 以etcd的key prefix作為設定來源
+	prefix下的key對應apollo的key 例: "/config/app1/support" 即為 "support"
+*/
+func InitEtcd(prefix string, endpoints []string) (Listener, error) {
+	cs, err := cetcd.NewConfigSource(prefix, endpoints)
+	if err != nil {
+		return Listener{}, err
+	}
+	etcdCfg = cs
+	lis := Listener{}
+	cs.AddChangeListener(etcdListener{lis})
+	return lis, nil
+}
+
 /*
 	參數取得設定檔
 	優先級順序 flag > env > yml
@@ -119,6 +137,9 @@ func GetValue(key string) (string, error) {
 		return MockMap[key], nil
 	}
 	if cli == nil {
+		if etcdCfg != nil {
+			return etcdCfg.GetValue(key)
+		}
 		return "", errors.New("no setting cli")
 	}
 	cache := cli.GetConfigCache(*Namespace)
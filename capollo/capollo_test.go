@@ -11,6 +11,7 @@ const testConfigFilePath = "./test/config.yml"
 /* for unit test clear setting */
 func Reset() {
 	cli = nil
+	etcdCfg = nil
 }
 
 func ExampleInitWithConfig() {
@@ -28,10 +28,33 @@ func init() {
 /* apollo變更時 跟著變更 */
 func (this Listener) OnChange(event *storage.ChangeEvent) {
 	zlog.Info("apollo onchange execute")
+	keys := make([]string, 0, len(event.Changes))
+	for key := range event.Changes {
+		keys = append(keys, key)
+	}
+	this.execChange(keys)
+}
+
+/* 以etcd作為設定來源時 接收etcd的變更 */
+type etcdListener struct {
+	Listener
+}
+
+/* etcd設定變更時 跟著變更 */
+func (this etcdListener) OnChange(event *cetcd.ChangeEvent) {
+	zlog.Info("etcd config onchange execute")
+	keys := make([]string, 0, len(event.Changes))
+	for key := range event.Changes {
+		keys = append(keys, key)
+	}
+	this.execChange(keys)
+}
+
+func (this Listener) execChange(keys []string) {
 	// 執行共用自動設定
 	this.AutoSetting()
-	// 執行被指定的重新初始化項目0
-	for key := range event.Changes {
+	// 執行被指定的重新初始化項目
+	for _, key := range keys {
 		if _, ok := ExecFuncs[key]; ok {
 			zlog.Info("change key:", key)
 			ExecFuncs[key](key)
@@ -80,38 +103,46 @@ func (this Listener) AutoSetting() {
 /* 靠apollo設定初始化DB設定 */
 func DbAutoSetting(key string) {
 	defer utils.ErrRecover()
-	m, _ := GetYmlValue(key)
-	confList := m["mysql"]
-	if conf, ok := confList.([]interface{}); ok {
-		for _, v := range conf {
-			if confMap, ok := v.(map[string]interface{}); ok {
-				if confMap["host"] == nil && confMap["schema"] == nil &&
-					confMap["user"] == nil && confMap["pwd"] == nil {
-					return
-				}
-				host := confMap["host"].(string)
-				schema := confMap["schema"].(string)
-				user := confMap["user"].(string)
-				pwd := confMap["pwd"].(string)
-				source := ""
-				if confMap["source"] != nil {
-					source = confMap["source"].(string)
-				}
-				cgorm.InitDB(host, schema, user, pwd, source)
-			}
+	var m struct {
+		Mysql []cgorm.Config `yaml:"mysql"`
+	}
+	if err := BindYmlValue(key, &m); err != nil {
+		zlog.Error("mysql setting parse err:", err)
+		return
+	}
+	confs := make([]cgorm.Config, 0, len(m.Mysql))
+	for _, conf := range m.Mysql {
+		if conf.Host == "" && conf.Schema == "" && conf.User == "" && conf.Pwd == "" {
+			continue
 		}
+		confs = append(confs, conf)
+	}
+	// 沒有任何有效設定時視為設定異常 保留現有連線源
+	if len(confs) == 0 {
+		zlog.Warn("mysql setting is empty, keep current sources")
+		return
+	}
+	// 只重建有變更的連線源 並移除設定中已不存在的連線源
+	if err := cgorm.ReloadDB(confs); err != nil {
+		zlog.Error("mysql init err:", err)
 	}
 }
 
 /* kafka連線設定 */
 func KafkaSet(key string) {
 	defer utils.ErrRecover()
-	m, _ := GetYmlValue(key)
-	if s, ok := m["brokers"].(string); ok {
-		ckafka.Manage.SetBrokers(strings.Split(s, ","))
+	var conf ckafka.Config
+	if err := BindYmlValue(key, &conf); err != nil {
+		zlog.Error("kafka setting parse err:", err)
+		return
+	}
+	// 沒有任何連線位址時視為設定異常 保留現有設定
+	if len(conf.Brokers) == 0 && conf.Leader == "" {
+		zlog.Warn("kafka setting is empty, keep current setting")
+		return
 	}
-	if s, ok := m["leader"].(string); ok {
-		ckafka.Manage.SetLeaderAddr(s)
+	if err := ckafka.Manage.SetConfig(conf); err != nil {
+		zlog.Error("kafka setting err:", err)
 	}
 }
 
@@ -0,0 +1,195 @@
+/*
+	單元測試用的內嵌etcd
+	於暫存目錄及隨機port啟動etcd 取代cetcd.MockList 讓watcher、lease、keepAlive等邏輯可離線測試
+
+	c := cetcdtest.NewCluster(t, 1)
+	cli, _ := cetcd.NewClientDis(c.Endpoints())
+*/
+package cetcdtest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// 等待etcd啟動/選出leader的時間
+var StartTimeout = 10 * time.Second
+
+type member struct {
+	cfg  *embed.Config
+	etcd *embed.Etcd
+}
+
+type Cluster struct {
+	t       testing.TB
+	members []*member
+	client  *clientv3.Client
+	lock    sync.Mutex
+}
+
+/* 啟動size個成員的內嵌etcd叢集 測試結束時自動關閉並清除資料 */
+func NewCluster(t testing.TB, size int) *Cluster {
+	t.Helper()
+	if size < 1 {
+		size = 1
+	}
+	dir := t.TempDir()
+
+	c := &Cluster{t: t}
+	initial := make([]string, 0, size)
+	for i := 0; i < size; i++ {
+		cfg := embed.NewConfig()
+		cfg.Name = fmt.Sprintf("member%d", i)
+		cfg.Dir = filepath.Join(dir, cfg.Name)
+		cfg.LogLevel = "error"
+		cfg.LCUrls = []url.URL{freeURL(t)}
+		cfg.ACUrls = cfg.LCUrls
+		cfg.LPUrls = []url.URL{freeURL(t)}
+		cfg.APUrls = cfg.LPUrls
+		initial = append(initial, cfg.Name+"="+cfg.APUrls[0].String())
+		c.members = append(c.members, &member{cfg: cfg})
+	}
+	for _, m := range c.members {
+		m.cfg.InitialCluster = strings.Join(initial, ",")
+		m.cfg.InitialClusterToken = "cetcdtest"
+	}
+
+	// 多成員時需同時啟動才能選出leader
+	errs := make(chan error, size)
+	for _, m := range c.members {
+		go func(m *member) {
+			errs <- m.start()
+		}(m)
+	}
+	for i := 0; i < size; i++ {
+		if err := <-errs; err != nil {
+			c.Terminate()
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(c.Terminate)
+	return c
+}
+
+/* 以原設定啟動成員 已有資料目錄時會以既有成員身分加入 */
+func (m *member) start() error {
+	e, err := embed.StartEtcd(m.cfg)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(StartTimeout):
+		e.Close()
+		return fmt.Errorf("etcd member %s start timeout", m.cfg.Name)
+	}
+	m.etcd = e
+	return nil
+}
+
+func (m *member) stop() {
+	if m.etcd != nil {
+		m.etcd.Close()
+		m.etcd = nil
+	}
+}
+
+/* 取得可用的隨機port */
+func freeURL(t testing.TB) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+/* 所有成員的client endpoints 可直接給cetcd.NewClientDis/NewService使用 */
+func (c *Cluster) Endpoints() []string {
+	endpoints := make([]string, 0, len(c.members))
+	for _, m := range c.members {
+		endpoints = append(endpoints, m.cfg.ACUrls[0].Host)
+	}
+	return endpoints
+}
+
+/* 叢集內部操作用的client 與被測程式使用的client分開 */
+func (c *Cluster) Client() *clientv3.Client {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.client != nil {
+		return c.client
+	}
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   c.Endpoints(),
+		DialTimeout: StartTimeout,
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.client = cli
+	return cli
+}
+
+/* 撤銷指定租約 模擬服務租約過期 */
+func (c *Cluster) KillLease(id clientv3.LeaseID) {
+	c.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), StartTimeout)
+	defer cancel()
+	if _, err := c.Client().Revoke(ctx, id); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+/* 撤銷所有租約 所有綁定租約的key(服務註冊)會一併被刪除 */
+func (c *Cluster) KillLeases() {
+	c.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), StartTimeout)
+	defer cancel()
+	resp, err := c.Client().Leases(ctx)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	for _, l := range resp.Leases {
+		c.KillLease(l.ID)
+	}
+}
+
+/* 停止第i個成員 模擬節點下線 */
+func (c *Cluster) StopMember(i int) {
+	c.members[i].stop()
+}
+
+/* 重新啟動第i個成員 沿用原本的資料目錄及port */
+func (c *Cluster) RestartMember(i int) {
+	c.t.Helper()
+	m := c.members[i]
+	m.stop()
+	m.cfg.ClusterState = embed.ClusterStateFlagExisting
+	if err := m.start(); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+/* 關閉所有成員 */
+func (c *Cluster) Terminate() {
+	c.lock.Lock()
+	if c.client != nil {
+		c.client.Close()
+		c.client = nil
+	}
+	c.lock.Unlock()
+	for _, m := range c.members {
+		m.stop()
+	}
+}
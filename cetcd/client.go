@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/rickylin614/common/zlog"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
@@ -18,6 +20,7 @@ type ClientDis struct {
 	client     *clientv3.Client
 	serverList map[string]string
 	lock       sync.Mutex
+	retry      time.Duration // watch中斷後重新讀取的等待時間 預設watchRetryInterval
 }
 
 func NewClientDis(endpoints []string) (*ClientDis, error) {
@@ -71,6 +74,102 @@ func (this *ClientDis) GetOneService(prefix string) (string, error) {
 	return "", nil
 }
 
+/*
+	持續監聽prefix下的服務 每次變更時以完整的位址列表呼叫onUpdate
+	watch中斷(如版本已被compact)時重新讀取並繼續監聽 ctx結束時停止監聽
+*/
+func (this *ClientDis) WatchService(ctx context.Context, prefix string, onUpdate func(addrs []string)) error {
+	return this.watchService(ctx, ctx, prefix, onUpdate)
+}
+
+/* getCtx只用於第一次讀取 可設定逾時 watchCtx結束時停止監聽 */
+func (this *ClientDis) watchService(getCtx, watchCtx context.Context, prefix string, onUpdate func(addrs []string)) error {
+	// 單元測試用假資料
+	if MockList[prefix] != nil && len(MockList[prefix]) > 0 {
+		onUpdate(MockList[prefix])
+		return nil
+	}
+
+	resp, err := this.client.Get(getCtx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	list := make(map[string]string)
+	for _, kv := range resp.Kvs {
+		list[string(kv.Key)] = string(kv.Value)
+	}
+	onUpdate(mapValues(list))
+
+	go this.watchLoop(watchCtx, prefix, resp.Header.Revision+1, list, onUpdate)
+	return nil
+}
+
+/* 從rev開始監聽 中斷時依退避時間重新讀取完整列表後繼續 直到ctx結束 */
+func (this *ClientDis) watchLoop(ctx context.Context, prefix string, rev int64, list map[string]string, onUpdate func(addrs []string)) {
+	retry := this.retry
+	if retry <= 0 {
+		retry = watchRetryInterval
+	}
+	for {
+		this.watchOnce(ctx, prefix, rev, list, onUpdate)
+		backoff := retry
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			getCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			resp, err := this.client.Get(getCtx, prefix, clientv3.WithPrefix())
+			cancel()
+			if err == nil {
+				list = make(map[string]string)
+				for _, kv := range resp.Kvs {
+					list[string(kv.Key)] = string(kv.Value)
+				}
+				onUpdate(mapValues(list))
+				rev = resp.Header.Revision + 1
+				break
+			}
+			zlog.Error("etcd relist service err:", prefix, err)
+			if backoff *= 2; backoff > maxWatchRetryInterval {
+				backoff = maxWatchRetryInterval
+			}
+		}
+	}
+}
+
+/* 監聽一次 發生錯誤或channel關閉時回傳 */
+func (this *ClientDis) watchOnce(ctx context.Context, prefix string, rev int64, list map[string]string, onUpdate func(addrs []string)) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rch := this.client.Watch(ctx, prefix, clientv3.WithPrefix(), clientv3.WithRev(rev))
+	for wresp := range rch {
+		if err := wresp.Err(); err != nil {
+			zlog.Error("etcd watch service err:", prefix, err)
+			return
+		}
+		for _, ev := range wresp.Events {
+			switch ev.Type {
+			case clientv3.EventTypePut:
+				list[string(ev.Kv.Key)] = string(ev.Kv.Value)
+			case clientv3.EventTypeDelete:
+				delete(list, string(ev.Kv.Key))
+			}
+		}
+		onUpdate(mapValues(list))
+	}
+}
+
+func mapValues(m map[string]string) []string {
+	addrs := make([]string, 0, len(m))
+	for _, v := range m {
+		addrs = append(addrs, v)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
 func (this *ClientDis) watcher(prefix string) {
 	rch := this.client.Watch(context.Background(), prefix, clientv3.WithPrefix())
 	for wresp := range rch {
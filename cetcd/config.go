@@ -0,0 +1,359 @@
+package cetcd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rickylin614/common/zlog"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// 最後一次以NewConfigSource建立的設定源
+var Config *ConfigSource
+
+// watch中斷(如revision已被compact)後重新讀取的等待時間 失敗時加倍 最多maxWatchRetryInterval
+const (
+	watchRetryInterval    = time.Second
+	maxWatchRetryInterval = 30 * time.Second
+)
+
+// 設定變更類型
+type ChangeType int
+
+const (
+	ADDED ChangeType = iota
+	MODIFIED
+	DELETED
+)
+
+// 單一key的變更內容
+type ConfigChange struct {
+	OldValue   string
+	NewValue   string
+	ChangeType ChangeType
+}
+
+// 一次watch回應中所有的變更 key為去除prefix後的名稱
+type ChangeEvent struct {
+	Prefix  string
+	Changes map[string]*ConfigChange
+}
+
+// 設定變更監聽者 與apollo的ChangeListener相同用法
+type ConfigListener interface {
+	OnChange(event *ChangeEvent)
+}
+
+/*
+	以etcd的key prefix作為設定來源
+	例: prefix為"/config/app1/" 則 "/config/app1/mysql" 對應到設定key "mysql"
+	value可為yaml或json格式
+*/
+type ConfigSource struct {
+	client    *clientv3.Client
+	prefix    string
+	values    map[string]string
+	listeners []ConfigListener
+	execFuncs map[string]func(string)
+	lock      sync.RWMutex
+	cancel    context.CancelFunc
+	ownClient bool          // client由NewConfigSource建立 Close時一併關閉
+	retry     time.Duration // watch中斷後重新讀取的等待時間
+}
+
+/* 建立etcd設定源 載入prefix下所有的key並開始監聽變更 */
+func NewConfigSource(prefix string, endpoints []string) (*ConfigSource, error) {
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	cs, err := NewConfigSourceWithClient(prefix, client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	cs.ownClient = true
+	return cs, nil
+}
+
+/* 以既有的etcd client建立設定源 */
+func NewConfigSourceWithClient(prefix string, client *clientv3.Client) (*ConfigSource, error) {
+	cs := newConfigSource(prefix)
+	cs.client = client
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	resp, err := client.Get(ctx, prefix, clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range resp.Kvs {
+		cs.values[cs.trimKey(string(kv.Key))] = string(kv.Value)
+	}
+
+	// 從讀取後的下一個版本開始監聽 避免遺漏中間的變更
+	watchCtx, watchCancel := context.WithCancel(context.Background())
+	cs.cancel = watchCancel
+	go cs.watcher(watchCtx, resp.Header.Revision+1)
+
+	Config = cs
+	return cs, nil
+}
+
+func newConfigSource(prefix string) *ConfigSource {
+	return &ConfigSource{
+		prefix:    prefix,
+		values:    make(map[string]string),
+		execFuncs: make(map[string]func(string)),
+		retry:     watchRetryInterval,
+	}
+}
+
+/* 停止監聽 若client由此設定源建立則一併關閉 */
+func (cs *ConfigSource) Close() error {
+	if cs.cancel != nil {
+		cs.cancel()
+	}
+	if cs.ownClient {
+		return cs.client.Close()
+	}
+	return nil
+}
+
+func (cs *ConfigSource) trimKey(key string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(key, cs.prefix), "/")
+}
+
+/* 監聽變更 watch中斷時重新讀取prefix 通知差異後從新的版本繼續監聽 直到ctx結束 */
+func (cs *ConfigSource) watcher(ctx context.Context, rev int64) {
+	for {
+		cs.watch(ctx, rev)
+		backoff := cs.retry
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			next, err := cs.resync(ctx)
+			if err == nil {
+				rev = next
+				break
+			}
+			zlog.Error("etcd config resync err:", err)
+			if backoff *= 2; backoff > maxWatchRetryInterval {
+				backoff = maxWatchRetryInterval
+			}
+		}
+	}
+}
+
+/* 從rev開始監聽 發生錯誤或channel關閉時回傳 */
+func (cs *ConfigSource) watch(ctx context.Context, rev int64) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rch := cs.client.Watch(ctx, cs.prefix, clientv3.WithPrefix(), clientv3.WithRev(rev), clientv3.WithPrevKV())
+	for wresp := range rch {
+		if err := wresp.Err(); err != nil {
+			zlog.Error("etcd config watch err:", err)
+			return
+		}
+		event := &ChangeEvent{Prefix: cs.prefix, Changes: make(map[string]*ConfigChange)}
+		for _, ev := range wresp.Events {
+			key := cs.trimKey(string(ev.Kv.Key))
+			switch ev.Type {
+			case clientv3.EventTypePut:
+				event.Changes[key] = cs.set(key, string(ev.Kv.Value))
+			case clientv3.EventTypeDelete:
+				event.Changes[key] = cs.del(key)
+			}
+		}
+		cs.fire(event)
+	}
+}
+
+/* 重新讀取prefix下所有的key 與目前的值比對後通知差異 回傳下一個監聽的版本 */
+func (cs *ConfigSource) resync(ctx context.Context) (int64, error) {
+	getCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	resp, err := cs.client.Get(getCtx, cs.prefix, clientv3.WithPrefix())
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+	values := make(map[string]string, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		values[cs.trimKey(string(kv.Key))] = string(kv.Value)
+	}
+
+	event := &ChangeEvent{Prefix: cs.prefix, Changes: make(map[string]*ConfigChange)}
+	cs.lock.Lock()
+	for key, val := range values {
+		old, ok := cs.values[key]
+		switch {
+		case !ok:
+			event.Changes[key] = &ConfigChange{NewValue: val, ChangeType: ADDED}
+		case old != val:
+			event.Changes[key] = &ConfigChange{OldValue: old, NewValue: val, ChangeType: MODIFIED}
+		}
+	}
+	for key, old := range cs.values {
+		if _, ok := values[key]; !ok {
+			event.Changes[key] = &ConfigChange{OldValue: old, ChangeType: DELETED}
+		}
+	}
+	cs.values = values
+	cs.lock.Unlock()
+
+	cs.fire(event)
+	return resp.Header.Revision + 1, nil
+}
+
+func (cs *ConfigSource) set(key, val string) *ConfigChange {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	old, ok := cs.values[key]
+	cs.values[key] = val
+	if ok {
+		return &ConfigChange{OldValue: old, NewValue: val, ChangeType: MODIFIED}
+	}
+	return &ConfigChange{NewValue: val, ChangeType: ADDED}
+}
+
+func (cs *ConfigSource) del(key string) *ConfigChange {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	old := cs.values[key]
+	delete(cs.values, key)
+	return &ConfigChange{OldValue: old, ChangeType: DELETED}
+}
+
+/* 通知監聽者 並執行被指定key的func */
+func (cs *ConfigSource) fire(event *ChangeEvent) {
+	if len(event.Changes) == 0 {
+		return
+	}
+	cs.lock.RLock()
+	listeners := append([]ConfigListener{}, cs.listeners...)
+	funcs := make(map[string]func(string), len(cs.execFuncs))
+	for k, f := range cs.execFuncs {
+		funcs[k] = f
+	}
+	cs.lock.RUnlock()
+
+	for _, l := range listeners {
+		l.OnChange(event)
+	}
+	for key := range event.Changes {
+		if f, ok := funcs[key]; ok {
+			zlog.Info("etcd config change key:", key)
+			f(key)
+		}
+	}
+}
+
+/* 添加設定變更監聽者 */
+func (cs *ConfigSource) AddChangeListener(l ConfigListener) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.listeners = append(cs.listeners, l)
+}
+
+/* 修改/添加onchange時執行的func */
+func (cs *ConfigSource) AddChangeFunc(key string, f func(string)) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.execFuncs[key] = f
+}
+
+/* 修改/添加onchange時執行的funcs */
+func (cs *ConfigSource) AddChangeFuncs(fs map[string]func(string)) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	for key, f := range fs {
+		cs.execFuncs[key] = f
+	}
+}
+
+/* 取得所有設定key */
+func (cs *ConfigSource) Keys() []string {
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	keys := make([]string, 0, len(cs.values))
+	for k := range cs.values {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+/* 取得設定值 key不存在時回傳空字串 */
+func (cs *ConfigSource) GetValue(key string) (string, error) {
+	if cs == nil {
+		return "", errors.New("no setting etcd config source")
+	}
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	return cs.values[key], nil
+}
+
+/* 取得yaml設定值 */
+func (cs *ConfigSource) GetYmlValue(key string) (map[string]interface{}, error) {
+	str, err := cs.GetValue(key)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	err = yaml.Unmarshal([]byte(str), &m)
+	return m, err
+}
+
+/* 綁定yaml設定值到val */
+func (cs *ConfigSource) BindYmlValue(key string, val interface{}) error {
+	str, err := cs.GetValue(key)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal([]byte(str), val)
+}
+
+/* 綁定json設定值到val */
+func (cs *ConfigSource) BindJsonValue(key string, val interface{}) error {
+	str, err := cs.GetValue(key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(str), val)
+}
+
+/*
+	將prefix下所有設定綁定到結構體 以yaml tag對應key
+	每個value以yaml解析(json亦為合法yaml) 無法解析時視為字串
+*/
+func (cs *ConfigSource) Bind(val interface{}) error {
+	if cs == nil {
+		return errors.New("no setting etcd config source")
+	}
+	cs.lock.RLock()
+	m := make(map[string]interface{}, len(cs.values))
+	for k, v := range cs.values {
+		var parsed interface{}
+		if err := yaml.Unmarshal([]byte(v), &parsed); err != nil {
+			parsed = v
+		}
+		m[k] = parsed
+	}
+	cs.lock.RUnlock()
+
+	b, err := yaml.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(b, val)
+}
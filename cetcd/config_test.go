@@ -0,0 +1,131 @@
+package cetcd
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rickylin614/common/cetcd/cetcdtest"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestConfigSource_Bind(t *testing.T) {
+	type mysqlConf struct {
+		Host   string `yaml:"host"`
+		Schema string `yaml:"schema"`
+	}
+	type appConf struct {
+		Support string      `yaml:"support"`
+		Mysql   []mysqlConf `yaml:"mysql"`
+		Kafka   struct {
+			Brokers string `yaml:"brokers"`
+		} `yaml:"kafka"`
+	}
+
+	cs := newConfigSource("/config/app1/")
+	cs.set(cs.trimKey("/config/app1/support"), "mysql,redis")
+	cs.set(cs.trimKey("/config/app1/mysql"), "- host: 127.0.0.1:3306\n  schema: s1\n")
+	cs.set(cs.trimKey("/config/app1/kafka"), `{"brokers":"127.0.0.1:9092"}`)
+
+	var got appConf
+	if err := cs.Bind(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := appConf{Support: "mysql,redis", Mysql: []mysqlConf{{Host: "127.0.0.1:3306", Schema: "s1"}}}
+	want.Kafka.Brokers = "127.0.0.1:9092"
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Bind() = %+v, want %+v", got, want)
+	}
+}
+
+type testListener struct {
+	events []*ChangeEvent
+}
+
+func (l *testListener) OnChange(event *ChangeEvent) {
+	l.events = append(l.events, event)
+}
+
+func TestConfigSource_fire(t *testing.T) {
+	cs := newConfigSource("/config/app1/")
+	lis := &testListener{}
+	cs.AddChangeListener(lis)
+	called := ""
+	cs.AddChangeFunc("redis", func(key string) { called = key })
+
+	event := &ChangeEvent{Prefix: cs.prefix, Changes: map[string]*ConfigChange{}}
+	event.Changes["redis"] = cs.set("redis", "host: 127.0.0.1:6379")
+	cs.fire(event)
+
+	if len(lis.events) != 1 || lis.events[0].Changes["redis"].ChangeType != ADDED {
+		t.Errorf("listener not notified, events = %+v", lis.events)
+	}
+	if called != "redis" {
+		t.Errorf("change func not called, got %q", called)
+	}
+	if c := cs.del("redis"); c.ChangeType != DELETED || c.OldValue != "host: 127.0.0.1:6379" {
+		t.Errorf("del() = %+v", c)
+	}
+}
+
+func TestConfigSource_Etcd(t *testing.T) {
+	c := cetcdtest.NewCluster(t, 1)
+	admin := c.Client()
+	ctx := context.Background()
+	cli, err := clientv3.New(clientv3.Config{Endpoints: c.Endpoints(), DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	// 呼叫端傳入的client Close後仍可使用
+	cs, err := NewConfigSourceWithClient("/config/app1/", cli)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Get(ctx, "/config/app1/"); err != nil {
+		t.Fatalf("caller's client should stay open: %v", err)
+	}
+
+	// watch的版本已被compact 重新讀取後繼續監聽
+	admin.Put(ctx, "/config/app1/a", "1")
+	admin.Put(ctx, "/config/app1/b", "1")
+	resp, _ := admin.Put(ctx, "/config/app1/a", "2")
+	if _, err := admin.Compact(ctx, resp.Header.Revision); err != nil {
+		t.Fatal(err)
+	}
+
+	cs = newConfigSource("/config/app1/")
+	cs.client = cli
+	cs.values["c"] = "1"
+	cs.retry = 10 * time.Millisecond
+	lis := &testListener{}
+	cs.AddChangeListener(lis)
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go cs.watcher(watchCtx, 1)
+
+	waitValue := func(key, want string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if v, _ := cs.GetValue(key); v == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: want %q", key, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitValue("a", "2")
+	waitValue("b", "1")
+	if v, _ := cs.GetValue("c"); v != "" {
+		t.Fatalf("deleted key c still %q", v)
+	}
+	admin.Put(ctx, "/config/app1/d", "1")
+	waitValue("d", "1")
+}
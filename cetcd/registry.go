@@ -45,6 +45,7 @@ func NewService(name, ip string, endpoints []string) (service *Service, err erro
 
 	service = &Service{
 		ServiceInfo: info,
+		stop:        make(chan error, 1),
 		client:      client,
 	}
 	return
@@ -106,7 +107,8 @@ func (service *Service) keepAlive() (<-chan *clientv3.LeaseKeepAliveResponse, er
 func (service *Service) revoke() error {
 	_, err := service.client.Revoke(context.TODO(), service.leaseId)
 	if err != nil {
-		zlog.Fatal(err)
+		// 租約可能已過期或被撤銷 不需中止程序
+		zlog.Error(err)
 	}
 	zlog.Infof("servide:%s stop\n", service.getKey())
 	return err
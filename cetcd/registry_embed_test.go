@@ -0,0 +1,112 @@
+package cetcd
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rickylin614/common/cetcd/cetcdtest"
+)
+
+/* 等待WatchService推送預期的位址列表 */
+func waitAddrs(t *testing.T, ch <-chan []string, want []string) {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case got := <-ch:
+			if reflect.DeepEqual(got, want) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("wait service addrs timeout, want %v", want)
+		}
+	}
+}
+
+func TestService_RegisterAndDiscover(t *testing.T) {
+	c := cetcdtest.NewCluster(t, 1)
+
+	srv, err := NewService("/hello", "10.0.0.1:8080", c.Endpoints())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- srv.Start() }()
+
+	cli, err := NewClientDis(c.Endpoints())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan []string, 10)
+	if err := cli.WatchService(ctx, "/hello/", func(addrs []string) { ch <- addrs }); err != nil {
+		t.Fatal(err)
+	}
+	waitAddrs(t, ch, []string{"10.0.0.1:8080"})
+
+	// 租約被撤銷後 服務應從列表中移除 且Start結束keepAlive
+	c.KillLeases()
+	waitAddrs(t, ch, []string{})
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("service keepAlive not stopped after lease revoked")
+	}
+}
+
+func TestClientDis_WatchServiceMemberChurn(t *testing.T) {
+	c := cetcdtest.NewCluster(t, 3)
+
+	cli, err := NewClientDis(c.Endpoints())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan []string, 10)
+	if err := cli.WatchService(ctx, "/churn/", func(addrs []string) { ch <- addrs }); err != nil {
+		t.Fatal(err)
+	}
+	waitAddrs(t, ch, []string{})
+
+	c.StopMember(0)
+	if _, err := c.Client().Put(ctx, "/churn/a", "10.0.0.2:80"); err != nil {
+		t.Fatal(err)
+	}
+	waitAddrs(t, ch, []string{"10.0.0.2:80"})
+
+	c.RestartMember(0)
+	c.StopMember(1)
+	if _, err := c.Client().Put(ctx, "/churn/b", "10.0.0.3:80"); err != nil {
+		t.Fatal(err)
+	}
+	waitAddrs(t, ch, []string{"10.0.0.2:80", "10.0.0.3:80"})
+}
+
+func TestClientDis_WatchServiceCompacted(t *testing.T) {
+	c := cetcdtest.NewCluster(t, 1)
+	cli, err := NewClientDis(c.Endpoints())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.retry = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	admin := c.Client()
+	admin.Put(ctx, "/compact/a", "10.0.0.1:80")
+	resp, _ := admin.Put(ctx, "/compact/b", "10.0.0.2:80")
+	if _, err := admin.Compact(ctx, resp.Header.Revision); err != nil {
+		t.Fatal(err)
+	}
+
+	// 監聽的版本已被compact 重新讀取後繼續監聽
+	ch := make(chan []string, 10)
+	go cli.watchLoop(ctx, "/compact/", 1, map[string]string{"/compact/old": "10.0.0.9:80"}, func(addrs []string) { ch <- addrs })
+	waitAddrs(t, ch, []string{"10.0.0.1:80", "10.0.0.2:80"})
+	admin.Delete(ctx, "/compact/a")
+	waitAddrs(t, ch, []string{"10.0.0.2:80"})
+}
@@ -0,0 +1,83 @@
+package cetcd
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/rickylin614/common/zlog"
+	"google.golang.org/grpc/resolver"
+)
+
+// gRPC使用的scheme 例: grpc.Dial("etcd:///service-name")
+const Scheme = "etcd"
+
+/* 服務名稱轉為註冊時使用的prefix */
+func servicePrefix(name string) string {
+	if strings.HasSuffix(name, "/") {
+		return name
+	}
+	return name + "/"
+}
+
+type resolverBuilder struct {
+	cli *ClientDis
+}
+
+/*
+	建立gRPC resolver.Builder
+	cli為nil時使用全域的Client(NewClientDis後設定)
+*/
+func NewResolverBuilder(cli *ClientDis) resolver.Builder {
+	return &resolverBuilder{cli: cli}
+}
+
+/* 註冊etcd resolver到gRPC 之後即可用 "etcd:///service-name" 連線 */
+func RegisterResolver(cli *ClientDis) {
+	resolver.Register(NewResolverBuilder(cli))
+}
+
+func (b *resolverBuilder) Scheme() string {
+	return Scheme
+}
+
+func (b *resolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	cli := b.cli
+	if cli == nil {
+		cli = Client
+	}
+	if cli == nil {
+		return nil, errors.New("etcd resolver: not setting etcd client")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &etcdResolver{cc: cc, cancel: cancel, name: target.Endpoint}
+	if err := cli.WatchService(ctx, servicePrefix(target.Endpoint), r.update); err != nil {
+		cancel()
+		return nil, err
+	}
+	return r, nil
+}
+
+type etcdResolver struct {
+	cc     resolver.ClientConn
+	cancel context.CancelFunc
+	name   string
+}
+
+func (r *etcdResolver) update(addrs []string) {
+	state := resolver.State{Addresses: make([]resolver.Address, 0, len(addrs))}
+	for _, addr := range addrs {
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: addr})
+	}
+	if err := r.cc.UpdateState(state); err != nil {
+		zlog.Warnf("etcd resolver update service:%s err:%v", r.name, err)
+	}
+}
+
+/* etcd主動推送變更 不需額外處理 */
+func (r *etcdResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (r *etcdResolver) Close() {
+	r.cancel()
+}
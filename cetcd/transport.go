@@ -0,0 +1,220 @@
+package cetcd
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rickylin614/common/zlog"
+)
+
+/*
+	http.RoundTripper實作
+	將 http://service-name/... 的host改寫為etcd上註冊的其中一個實體
+	連線失敗時換下一個實體重試 host查無服務或查詢etcd失敗時直接使用原網址
+	只有查到實體的服務會持續監聽變更 查無的host在MissTTL內不再查詢
+*/
+type Transport struct {
+	// 服務發現來源 為nil時使用全域的Client
+	Client *ClientDis
+	// 實際送出請求的RoundTripper 為nil時使用http.DefaultTransport
+	Base http.RoundTripper
+	// 查詢etcd的逾時 預設3s
+	LookupTimeout time.Duration
+	// 查無服務或查詢失敗的快取時間 預設30s
+	MissTTL time.Duration
+
+	lock     sync.Mutex
+	services map[string]*serviceAddrs // 監聽中的服務
+	misses   map[string]time.Time     // 查無服務的host => 到期時間
+	loading  map[string]chan struct{} // 查詢中的host 結束時關閉
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+type serviceAddrs struct {
+	addrs []string
+	lock  sync.RWMutex
+	stop  context.CancelFunc // 停止監聽
+}
+
+func (s *serviceAddrs) set(addrs []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.addrs = addrs
+}
+
+/* 以隨機順序取得所有實體 */
+func (s *serviceAddrs) shuffled() []string {
+	s.lock.RLock()
+	addrs := append([]string{}, s.addrs...)
+	s.lock.RUnlock()
+	rand.Shuffle(len(addrs), func(i, j int) {
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	})
+	return addrs
+}
+
+func NewTransport(cli *ClientDis, base http.RoundTripper) *Transport {
+	return &Transport{Client: cli, Base: base}
+}
+
+func (t *Transport) base() http.RoundTripper {
+	if t.Base != nil {
+		return t.Base
+	}
+	return http.DefaultTransport
+}
+
+func (t *Transport) lookupTimeout() time.Duration {
+	if t.LookupTimeout > 0 {
+		return t.LookupTimeout
+	}
+	return 3 * time.Second
+}
+
+func (t *Transport) missTTL() time.Duration {
+	if t.MissTTL > 0 {
+		return t.MissTTL
+	}
+	return 30 * time.Second
+}
+
+/*
+	取得服務的實體列表 查無服務或查詢失敗時回傳nil
+	查詢etcd時不持有lock 同一個host同時只查詢一次 其他請求等待結果
+*/
+func (t *Transport) lookup(ctx context.Context, host string) []string {
+	if net.ParseIP(strings.Trim(host, "[]")) != nil {
+		return nil
+	}
+	for {
+		t.lock.Lock()
+		if t.services == nil {
+			t.services = make(map[string]*serviceAddrs)
+			t.misses = make(map[string]time.Time)
+			t.loading = make(map[string]chan struct{})
+			t.ctx, t.cancel = context.WithCancel(context.Background())
+		}
+		if s, ok := t.services[host]; ok {
+			t.lock.Unlock()
+			return s.shuffled()
+		}
+		if until, ok := t.misses[host]; ok && time.Now().Before(until) {
+			t.lock.Unlock()
+			return nil
+		}
+		if wait, ok := t.loading[host]; ok {
+			t.lock.Unlock()
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		done := make(chan struct{})
+		t.loading[host] = done
+		parent := t.ctx
+		t.lock.Unlock()
+
+		s, err := t.watch(parent, host)
+		if err != nil {
+			zlog.Warnf("etcd transport lookup %s err:%v", host, err)
+		}
+		t.lock.Lock()
+		delete(t.loading, host)
+		if s != nil {
+			t.services[host] = s
+		} else {
+			t.misses[host] = time.Now().Add(t.missTTL())
+		}
+		t.lock.Unlock()
+		close(done)
+		if s == nil {
+			return nil
+		}
+		return s.shuffled()
+	}
+}
+
+/* 查詢並監聽服務 查無實體時回傳nil並停止監聽 parent結束時停止監聽 */
+func (t *Transport) watch(parent context.Context, host string) (*serviceAddrs, error) {
+	cli := t.Client
+	if cli == nil {
+		cli = Client
+	}
+	if cli == nil {
+		return nil, errors.New("etcd transport: not setting etcd client")
+	}
+	watchCtx, stop := context.WithCancel(parent)
+	getCtx, cancel := context.WithTimeout(watchCtx, t.lookupTimeout())
+	defer cancel()
+	s := &serviceAddrs{stop: stop}
+	if err := cli.watchService(getCtx, watchCtx, servicePrefix(host), s.set); err != nil {
+		stop()
+		return nil, err
+	}
+	if len(s.shuffled()) == 0 {
+		stop()
+		return nil, nil
+	}
+	return s, nil
+}
+
+/* 停止所有服務的監聽 */
+func (t *Transport) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.cancel != nil {
+		t.cancel()
+	}
+	t.services, t.misses, t.loading = nil, nil, nil
+	return nil
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	addrs := t.lookup(req.Context(), req.URL.Host)
+	if len(addrs) == 0 {
+		return t.base().RoundTrip(req)
+	}
+
+	var lastErr error
+	for i, addr := range addrs {
+		r := req.Clone(req.Context())
+		r.URL.Host = addr
+		r.Host = addr
+		if i > 0 && req.Body != nil {
+			// body已被讀取 無法重送時直接回傳錯誤
+			if req.GetBody == nil {
+				return nil, lastErr
+			}
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+
+		resp, err := t.base().RoundTrip(r)
+		if err == nil {
+			return resp, nil
+		}
+		if !isDialErr(err) {
+			return nil, err
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+/* 只有建立連線失敗時重試 避免重送已送達的請求 */
+func isDialErr(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
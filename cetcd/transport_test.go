@@ -0,0 +1,127 @@
+package cetcd
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rickylin614/common/cetcd/cetcdtest"
+)
+
+func TestTransport_RoundTrip(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "pong")
+	}))
+	defer srv.Close()
+
+	// 取得一個已關閉的port 模擬連線失敗的實體
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := l.Addr().String()
+	l.Close()
+
+	MockList = map[string][]string{
+		"svc/": {deadAddr, srv.Listener.Addr().String()},
+	}
+	defer func() { MockList = nil }()
+
+	client := &http.Client{Transport: NewTransport(&ClientDis{}, nil)}
+	for i := 0; i < 5; i++ {
+		resp, err := client.Get("http://svc/ping")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "pong" {
+			t.Errorf("body = %s, want pong", b)
+		}
+	}
+}
+
+func TestTransport_Etcd(t *testing.T) {
+	c := cetcdtest.NewCluster(t, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "pong")
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	if _, err := c.Client().Put(context.Background(), "svc/1", srv.Listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	cli, err := NewClientDis(c.Endpoints())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { Client = nil }()
+	tr := NewTransport(cli, nil)
+	defer tr.Close()
+	client := &http.Client{Transport: tr}
+	get := func(url string) {
+		t.Helper()
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != "pong" {
+			t.Fatalf("body = %s, want pong", b)
+		}
+	}
+
+	get("http://svc/ping")
+	// 非服務的host使用原網址 且不監聽
+	get("http://localhost:" + port + "/ping")
+	tr.lock.Lock()
+	_, watching := tr.services["localhost:"+port]
+	_, missed := tr.misses["localhost:"+port]
+	tr.lock.Unlock()
+	if watching || !missed {
+		t.Fatalf("unregistered host should be cached as miss, watching:%v missed:%v", watching, missed)
+	}
+}
+
+func TestTransport_EtcdDown(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "pong")
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead := l.Addr().String()
+	l.Close()
+	cli, err := NewClientDis([]string{dead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { Client = nil }()
+
+	// etcd無法連線時使用原網址
+	tr := &Transport{Client: cli, LookupTimeout: 200 * time.Millisecond}
+	defer tr.Close()
+	client := &http.Client{Transport: tr}
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		resp, err := client.Get("http://localhost:" + port + "/ping")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		// 第二次使用快取 不再等待etcd
+		if i == 1 && time.Since(start) > 100*time.Millisecond {
+			t.Fatalf("miss should be cached, took %v", time.Since(start))
+		}
+	}
+}
@@ -0,0 +1,423 @@
+package cgorm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/rickylin614/common/ckafka"
+	"github.com/rickylin614/common/zlog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	operatorPluginName  = "cgorm:operator"
+	auditPluginName     = "cgorm:audit"
+	auditOldRowsKey     = "cgorm:audit_old_rows"
+	auditAfterCommitKey = "cgorm:audit_after_commit"
+)
+
+// 操作者欄位 model有對應欄位時自動填入context中的使用者
+const (
+	ColumnCreatedBy = "created_by"
+	ColumnUpdatedBy = "updated_by"
+)
+
+// 異動紀錄的寫入方式 對應Config.Audit
+const (
+	AuditTable = "table"
+	AuditKafka = "kafka"
+)
+
+type userIDKey struct{}
+
+/* 將操作者放入context 以WithContext(ctx)執行時填入created_by/updated_by及異動紀錄 */
+func WithUserID(ctx context.Context, userID interface{}) context.Context {
+	return context.WithValue(ctx, userIDKey{}, userID)
+}
+
+/* 取得context中的操作者 */
+func UserIDFromContext(ctx context.Context) (interface{}, bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	userID := ctx.Value(userIDKey{})
+	return userID, userID != nil
+}
+
+type operatorPlugin struct{}
+
+func (operatorPlugin) Name() string {
+	return operatorPluginName
+}
+
+func (p operatorPlugin) Initialize(db *gorm.DB) error {
+	if err := db.Callback().Create().Before("gorm:create").Register(operatorPluginName, p.beforeCreate); err != nil {
+		return err
+	}
+	return db.Callback().Update().Before("gorm:update").Register(operatorPluginName, p.beforeUpdate)
+}
+
+func (operatorPlugin) beforeCreate(db *gorm.DB) {
+	stmt := db.Statement
+	userID, ok := UserIDFromContext(stmt.Context)
+	if !ok || stmt.Schema == nil || db.Error != nil {
+		return
+	}
+	for _, name := range []string{ColumnCreatedBy, ColumnUpdatedBy} {
+		if stmt.Schema.LookUpField(name) != nil {
+			stmt.SetColumn(name, userID, true)
+		}
+	}
+}
+
+func (operatorPlugin) beforeUpdate(db *gorm.DB) {
+	stmt := db.Statement
+	userID, ok := UserIDFromContext(stmt.Context)
+	if !ok || stmt.Schema == nil || db.Error != nil {
+		return
+	}
+	if stmt.Schema.LookUpField(ColumnUpdatedBy) != nil {
+		stmt.SetColumn(ColumnUpdatedBy, userID, true)
+	}
+}
+
+/* 實作此介面的model才記錄異動 */
+type Auditable interface {
+	Audited()
+}
+
+// 異動紀錄 使用AuditTable時需先AutoMigrate(&cgorm.AuditLog{})
+type AuditLog struct {
+	Id          int64     `gorm:"primaryKey" json:"id,omitempty"`
+	TargetTable string    `gorm:"size:64;index:idx_audit_target" json:"table"`
+	RecordId    string    `gorm:"size:64;index:idx_audit_target" json:"recordId"`
+	Action      string    `gorm:"size:16" json:"action"` // create/update/delete
+	Diff        string    `gorm:"type:text" json:"diff"` // {"欄位":{"old":舊值,"new":新值}}
+	UserId      string    `gorm:"size:64" json:"userId"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+func (AuditLog) TableName() string {
+	return "audit_log"
+}
+
+type AuditChange struct {
+	Old interface{} `json:"old,omitempty"`
+	New interface{} `json:"new,omitempty"`
+}
+
+/* 異動紀錄寫入方式 db為觸發異動的連線 在交易中時為同一個交易 */
+type AuditSink interface {
+	Write(db *gorm.DB, logs []AuditLog) error
+}
+
+/* 寫入audit_log資料表 與異動在同一個交易 寫入失敗時異動一併rollback */
+type TableAuditSink struct{}
+
+func (TableAuditSink) Write(db *gorm.DB, logs []AuditLog) error {
+	return db.Session(&gorm.Session{NewDB: true}).Create(&logs).Error
+}
+
+/*
+	以json寫入kafka topic key為"資料表:主鍵" 寫入失敗只記錄log 不影響異動
+	在交易commit後才寫入 rollback的異動不發送 也不因kafka延遲佔住交易
+*/
+type KafkaAuditSink struct {
+	Topic string
+}
+
+func (s KafkaAuditSink) Write(db *gorm.DB, logs []AuditLog) error {
+	msgs := make([][]byte, len(logs))
+	for i, l := range logs {
+		b, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+		msgs[i] = b
+	}
+	deferAfterCommit(db, func() {
+		for i, l := range logs {
+			if err := ckafka.Manage.Write([]byte(l.TargetTable+":"+l.RecordId), msgs[i], s.Topic); err != nil {
+				zlog.Error("write audit log to kafka err:", err)
+			}
+		}
+	})
+	return nil
+}
+
+/* 暫存到本次執行結束 gorm的預設交易commit後由publish callback交給afterCommit */
+func deferAfterCommit(db *gorm.DB, fn func()) {
+	var fns []func()
+	if v, ok := db.InstanceGet(auditAfterCommitKey); ok {
+		fns = v.([]func())
+	}
+	db.InstanceSet(auditAfterCommitKey, append(fns, fn))
+}
+
+/*
+	記錄實作Auditable的model的異動
+	更新/刪除前依相同條件讀取舊資料 更新後依主鍵重新讀取 比對欄位差異
+*/
+type auditPlugin struct {
+	sink AuditSink
+}
+
+func newAuditPlugin(conf Config) (*auditPlugin, error) {
+	switch conf.Audit {
+	case "":
+		return nil, nil
+	case AuditTable:
+		return &auditPlugin{sink: TableAuditSink{}}, nil
+	case AuditKafka:
+		if conf.AuditTopic == "" {
+			return nil, errors.New("audit topic is empty")
+		}
+		return &auditPlugin{sink: KafkaAuditSink{Topic: conf.AuditTopic}}, nil
+	default:
+		return nil, errors.New("unsupported audit: " + conf.Audit)
+	}
+}
+
+func (a *auditPlugin) Name() string {
+	return auditPluginName
+}
+
+func (a *auditPlugin) Initialize(db *gorm.DB) error {
+	if err := db.Callback().Create().After("gorm:create").Register(auditPluginName, a.afterCreate); err != nil {
+		return err
+	}
+	if err := db.Callback().Update().Before("gorm:update").Register(auditPluginName+"_before", a.loadOldRows); err != nil {
+		return err
+	}
+	if err := db.Callback().Update().After("gorm:update").Register(auditPluginName, a.afterUpdate); err != nil {
+		return err
+	}
+	if err := db.Callback().Delete().Before("gorm:delete").Register(auditPluginName+"_before", a.loadOldRows); err != nil {
+		return err
+	}
+	if err := db.Callback().Delete().After("gorm:delete").Register(auditPluginName, a.afterDelete); err != nil {
+		return err
+	}
+	// gorm的預設交易commit之後
+	publish := auditPluginName + "_publish"
+	if err := db.Callback().Create().After("gorm:commit_or_rollback_transaction").Register(publish, a.publish); err != nil {
+		return err
+	}
+	if err := db.Callback().Update().After("gorm:commit_or_rollback_transaction").Register(publish, a.publish); err != nil {
+		return err
+	}
+	return db.Callback().Delete().After("gorm:commit_or_rollback_transaction").Register(publish, a.publish)
+}
+
+/* 異動成功時 將暫存的寫入交給afterCommit 仍在WithTx交易中時等交易commit */
+func (a *auditPlugin) publish(db *gorm.DB) {
+	v, ok := db.InstanceGet(auditAfterCommitKey)
+	if !ok || db.Error != nil {
+		return
+	}
+	for _, fn := range v.([]func()) {
+		afterCommit(db, fn)
+	}
+}
+
+func auditable(stmt *gorm.Statement) bool {
+	if stmt.Schema == nil || stmt.Schema.PrioritizedPrimaryField == nil {
+		return false
+	}
+	_, ok := reflect.New(stmt.Schema.ModelType).Interface().(Auditable)
+	return ok
+}
+
+func (a *auditPlugin) afterCreate(db *gorm.DB) {
+	stmt := db.Statement
+	if db.Error != nil || !auditable(stmt) {
+		return
+	}
+	logs := make([]AuditLog, 0)
+	for _, row := range structRows(stmt.ReflectValue) {
+		logs = append(logs, a.newLog(stmt, "create", row, reflect.Value{}, row))
+	}
+	a.write(db, logs)
+}
+
+/* 依原條件讀取將被更新/刪除的資料 */
+func (a *auditPlugin) loadOldRows(db *gorm.DB) {
+	stmt := db.Statement
+	if db.Error != nil || !auditable(stmt) {
+		return
+	}
+	exprs := make([]clause.Expression, 0)
+	if c, ok := stmt.Clauses["WHERE"]; ok {
+		if where, ok := c.Expression.(clause.Where); ok {
+			exprs = append(exprs, where.Exprs...)
+		}
+	}
+	if ids := primaryValues(stmt, structRows(stmt.ReflectValue)); len(ids) > 0 {
+		exprs = append(exprs, clause.IN{Column: clause.Column{Table: clause.CurrentTable, Name: stmt.Schema.PrioritizedPrimaryField.DBName}, Values: ids})
+	}
+	if len(exprs) == 0 {
+		return
+	}
+	rows, err := a.find(db, clause.Where{Exprs: exprs})
+	if err != nil {
+		db.AddError(err)
+		return
+	}
+	db.InstanceSet(auditOldRowsKey, rows)
+}
+
+func (a *auditPlugin) afterUpdate(db *gorm.DB) {
+	stmt := db.Statement
+	oldRows, ok := a.oldRows(db)
+	if !ok || len(oldRows) == 0 {
+		return
+	}
+	pk := stmt.Schema.PrioritizedPrimaryField
+	newRows, err := a.find(db, clause.Where{Exprs: []clause.Expression{
+		clause.IN{Column: clause.Column{Table: clause.CurrentTable, Name: pk.DBName}, Values: primaryValues(stmt, oldRows)},
+	}})
+	if err != nil {
+		db.AddError(err)
+		return
+	}
+	newByID := make(map[string]reflect.Value, len(newRows))
+	for _, row := range newRows {
+		v, _ := pk.ValueOf(row)
+		newByID[fmt.Sprint(v)] = row
+	}
+
+	logs := make([]AuditLog, 0, len(oldRows))
+	for _, oldRow := range oldRows {
+		v, _ := pk.ValueOf(oldRow)
+		newRow, ok := newByID[fmt.Sprint(v)]
+		if !ok {
+			continue
+		}
+		if l := a.newLog(stmt, "update", oldRow, oldRow, newRow); l.Diff != "{}" {
+			logs = append(logs, l)
+		}
+	}
+	a.write(db, logs)
+}
+
+func (a *auditPlugin) afterDelete(db *gorm.DB) {
+	stmt := db.Statement
+	oldRows, ok := a.oldRows(db)
+	if !ok || len(oldRows) == 0 {
+		return
+	}
+	logs := make([]AuditLog, 0, len(oldRows))
+	for _, oldRow := range oldRows {
+		logs = append(logs, a.newLog(stmt, "delete", oldRow, oldRow, reflect.Value{}))
+	}
+	a.write(db, logs)
+}
+
+func (a *auditPlugin) oldRows(db *gorm.DB) ([]reflect.Value, bool) {
+	if db.Error != nil {
+		return nil, false
+	}
+	v, ok := db.InstanceGet(auditOldRowsKey)
+	if !ok {
+		return nil, false
+	}
+	return v.([]reflect.Value), true
+}
+
+/* 在同一個連線(交易)中讀取 並強制走主庫 */
+func (a *auditPlugin) find(db *gorm.DB, where clause.Where) ([]reflect.Value, error) {
+	stmt := db.Statement
+	list := reflect.New(reflect.SliceOf(stmt.Schema.ModelType))
+	err := db.Session(&gorm.Session{NewDB: true}).Unscoped().Table(stmt.Table).
+		Clauses(UsePrimary, where).Find(list.Interface()).Error
+	if err != nil {
+		return nil, err
+	}
+	return structRows(list.Elem()), nil
+}
+
+func (a *auditPlugin) write(db *gorm.DB, logs []AuditLog) {
+	if len(logs) == 0 {
+		return
+	}
+	if err := a.sink.Write(db, logs); err != nil {
+		db.AddError(err)
+	}
+}
+
+/* 比對新舊資料 只記錄有差異的欄位 新增/刪除時記錄所有欄位 */
+func (a *auditPlugin) newLog(stmt *gorm.Statement, action string, row, oldRow, newRow reflect.Value) AuditLog {
+	id, _ := stmt.Schema.PrioritizedPrimaryField.ValueOf(row)
+	diff := make(map[string]AuditChange)
+	for _, field := range stmt.Schema.Fields {
+		if field.DBName == "" {
+			continue
+		}
+		var change AuditChange
+		if oldRow.IsValid() {
+			change.Old, _ = field.ValueOf(oldRow)
+		}
+		if newRow.IsValid() {
+			change.New, _ = field.ValueOf(newRow)
+		}
+		if oldRow.IsValid() && newRow.IsValid() && auditEqual(change.Old, change.New) {
+			continue
+		}
+		diff[field.DBName] = change
+	}
+	b, _ := json.Marshal(diff)
+	l := AuditLog{
+		TargetTable: stmt.Table,
+		RecordId:    fmt.Sprint(id),
+		Action:      action,
+		Diff:        string(b),
+		CreatedAt:   time.Now(),
+	}
+	if userID, ok := UserIDFromContext(stmt.Context); ok {
+		l.UserId = fmt.Sprint(userID)
+	}
+	return l
+}
+
+func auditEqual(a, b interface{}) bool {
+	if ta, ok := a.(time.Time); ok {
+		if tb, ok := b.(time.Time); ok {
+			return ta.Equal(tb)
+		}
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+/* 取得struct或slice中的每筆資料 */
+func structRows(rv reflect.Value) []reflect.Value {
+	rows := make([]reflect.Value, 0)
+	switch rv.Kind() {
+	case reflect.Struct:
+		rows = append(rows, rv)
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			row := reflect.Indirect(rv.Index(i))
+			if row.Kind() == reflect.Struct {
+				rows = append(rows, row)
+			}
+		}
+	}
+	return rows
+}
+
+/* 取得非零值的主鍵 */
+func primaryValues(stmt *gorm.Statement, rows []reflect.Value) []interface{} {
+	pk := stmt.Schema.PrioritizedPrimaryField
+	ids := make([]interface{}, 0, len(rows))
+	for _, row := range rows {
+		if v, isZero := pk.ValueOf(row); !isZero {
+			ids = append(ids, v)
+		}
+	}
+	return ids
+}
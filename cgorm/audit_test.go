@@ -0,0 +1,157 @@
+package cgorm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/rickylin614/common/ckafka/kafkatest"
+	"gorm.io/gorm"
+)
+
+type auditDemo struct {
+	Id        int64 `gorm:"primaryKey"`
+	Name      string
+	Age       int
+	CreatedBy string
+	UpdatedBy string
+}
+
+func (auditDemo) Audited() {}
+
+func TestAudit(t *testing.T) {
+	err := InitDBWithConfig(Config{
+		Dialect:         DialectSqlite,
+		Schema:          "file::memory:",
+		Source:          "audit",
+		MaxIdleConns:    1,
+		MaxOpenConns:    1,
+		ConnMaxIdleTime: -1,
+		ConnMaxLifetime: -1,
+		LogLevel:        "silent",
+		Audit:           AuditTable,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := GetDB("audit")
+	if err := db.AutoMigrate(&auditDemo{}, &AuditLog{}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := WithUserID(context.Background(), "u1")
+
+	d := auditDemo{Name: "a", Age: 1}
+	if err := db.WithContext(ctx).Create(&d).Error; err != nil {
+		t.Fatal(err)
+	}
+	if d.CreatedBy != "u1" || d.UpdatedBy != "u1" {
+		t.Fatalf("operator not filled: %+v", d)
+	}
+
+	ctx2 := WithUserID(context.Background(), "u2")
+	if err := db.WithContext(ctx2).Model(&d).Update("age", 2).Error; err != nil {
+		t.Fatal(err)
+	}
+	var got auditDemo
+	db.First(&got, d.Id)
+	if got.UpdatedBy != "u2" || got.CreatedBy != "u1" {
+		t.Fatalf("updated_by not filled: %+v", got)
+	}
+
+	if err := db.WithContext(ctx2).Delete(&auditDemo{}, d.Id).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var logs []AuditLog
+	db.Order("id").Find(&logs)
+	if len(logs) != 3 {
+		t.Fatalf("want 3 audit logs, got %+v", logs)
+	}
+	if logs[0].Action != "create" || logs[1].Action != "update" || logs[2].Action != "delete" {
+		t.Fatalf("unexpected actions %+v", logs)
+	}
+	var diff map[string]AuditChange
+	if err := json.Unmarshal([]byte(logs[1].Diff), &diff); err != nil {
+		t.Fatal(err)
+	}
+	if len(diff) != 2 || diff["age"].New != float64(2) || diff["updated_by"].Old != "u1" {
+		t.Fatalf("unexpected diff %s", logs[1].Diff)
+	}
+	if logs[1].UserId != "u2" || logs[1].RecordId != "1" || logs[1].TargetTable != "audit_demos" {
+		t.Fatalf("unexpected log %+v", logs[1])
+	}
+}
+
+func TestAudit_KafkaAfterCommit(t *testing.T) {
+	b := kafkatest.Install(t, 1)
+	err := InitDBWithConfig(Config{
+		Dialect:         DialectSqlite,
+		Schema:          "file::memory:",
+		Source:          "audit_kafka",
+		MaxIdleConns:    1,
+		MaxOpenConns:    1,
+		ConnMaxIdleTime: -1,
+		ConnMaxLifetime: -1,
+		LogLevel:        "silent",
+		Audit:           AuditKafka,
+		AuditTopic:      "audit",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := GetDB("audit_kafka")
+	if err := db.AutoMigrate(&auditDemo{}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	count := func() int { return len(b.Messages("audit")) }
+
+	if err := db.Create(&auditDemo{Name: "a"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count() != 1 {
+		t.Fatalf("plain create: want 1 message, got %d", count())
+	}
+
+	// rollback的異動不發送
+	WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		if err := tx.Create(&auditDemo{Name: "b"}).Error; err != nil {
+			return err
+		}
+		return errors.New("rollback")
+	}, TxSource("audit_kafka"))
+	if count() != 1 {
+		t.Fatalf("rollback should not publish, got %d", count())
+	}
+
+	// commit後才發送 savepoint rollback的部分不發送
+	err = WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		if err := GetDBWithContext(ctx, "audit_kafka").Create(&auditDemo{Name: "c"}).Error; err != nil {
+			return err
+		}
+		WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+			tx.Create(&auditDemo{Name: "d"})
+			return errors.New("rollback savepoint")
+		}, TxSource("audit_kafka"))
+		if count() != 1 {
+			t.Errorf("published before commit, got %d", count())
+		}
+		return nil
+	}, TxSource("audit_kafka"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := b.Messages("audit")
+	if len(msgs) != 2 {
+		t.Fatalf("want 2 messages after commit, got %d", len(msgs))
+	}
+	var l AuditLog
+	if err := json.Unmarshal(msgs[1].Value, &l); err != nil {
+		t.Fatal(err)
+	}
+	if l.Action != "create" || !strings.Contains(l.Diff, `"c"`) {
+		t.Fatalf("unexpected audit log %+v", l)
+	}
+}
@@ -1,15 +1,15 @@
 package cgorm
 
 import (
+	"database/sql"
+	"reflect"
+	"sync"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/rickylin614/common/zlog"
 
-	apmmysql "go.elastic.co/apm/module/apmgormv2/driver/mysql"
-	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
-	gormlogger "gorm.io/gorm/logger"
 	"moul.io/zapgorm2"
 )
 
@@ -19,6 +19,18 @@ var db *gorm.DB
 // for multi database
 var dbs map[string]*gorm.DB = make(map[string]*gorm.DB)
 
+// 保護db/dbs/confs 設定熱更新時替換連線源
+var lock sync.RWMutex
+
+// 以設定建立的連線源 ReloadDB以此判斷設定是否變更
+var confs = make(map[string]Config)
+
+// 上一次ReloadDB的連線源 不在新設定中的將被移除 程式自行InitDB的連線源不受影響
+var reloadSources = make(map[string]bool)
+
+// 替換連線源後 舊連線延遲關閉的時間 讓已取得舊連線的請求執行完畢
+var ReloadCloseDelay = 10 * time.Second
+
 /*
 	host: host+port
 	schema: schema名稱
@@ -27,55 +39,219 @@ var dbs map[string]*gorm.DB = make(map[string]*gorm.DB)
 	dbSourceName: 多連線源使用 給予該連線名稱 若不使用則給空字串
 */
 func InitDB(host, schema, user, password, dbSourceName string) (err error) {
-	dsn := user + ":" + password + "@tcp(" + host + ")/" + schema + "?charset=utf8mb4&loc=Local&parseTime=true&timeout=30s"
+	return InitDBWithConfig(Config{
+		Host:   host,
+		Schema: schema,
+		User:   user,
+		Pwd:    password,
+		Source: dbSourceName,
+	})
+}
+
+/* 依完整設定初始化連線源 未設定的欄位使用預設值 */
+func InitDBWithConfig(conf Config) (err error) {
+	conf = conf.withDefault()
+	gormdb, err := openGorm(conf)
+	if err != nil {
+		return err
+	}
+
+	// 有設定副本時 讀取分配到副本
+	if len(conf.Replicas) > 0 {
+		rs, err := openReplicas(conf)
+		if err == nil {
+			if err = gormdb.Use(rs); err != nil {
+				rs.Close()
+			}
+		}
+		if err != nil {
+			if sqlDB, e := gormdb.DB(); e == nil {
+				sqlDB.Close()
+			}
+			return err
+		}
+	}
+
+	closeLater(setSource(conf.Source, gormdb, &conf))
+	return nil
+}
+
+/*
+	設定熱更新 依新的設定重建有變更的連線源 並移除設定中已不存在的連線源
+	只移除之前由ReloadDB建立的連線源 建立失敗的連線源保留舊連線
+*/
+func ReloadDB(newConfs []Config) error {
+	var firstErr error
+	keep := make(map[string]bool, len(newConfs))
+	for _, conf := range newConfs {
+		conf = conf.withDefault()
+		keep[conf.Source] = true
+		lock.RLock()
+		old, ok := confs[conf.Source]
+		lock.RUnlock()
+		if ok && reflect.DeepEqual(old, conf) {
+			continue
+		}
+		zlog.Info("reload db source:", conf.Source)
+		if err := InitDBWithConfig(conf); err != nil {
+			zlog.Error("reload db source err:", conf.Source, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	lock.Lock()
+	removes := make([]string, 0)
+	for source := range reloadSources {
+		if !keep[source] {
+			removes = append(removes, source)
+		}
+	}
+	reloadSources = keep
+	lock.Unlock()
+	for _, source := range removes {
+		zlog.Info("remove db source:", source)
+		RemoveDB(source)
+	}
+	return firstErr
+}
+
+/* 移除連線源 舊連線延遲ReloadCloseDelay後關閉 */
+func RemoveDB(sourceName string) {
+	closeLater(setSource(sourceName, nil, nil))
+}
+
+/* 替換連線源 回傳舊連線 gormdb為nil時移除 conf為nil表示非以設定建立(mock) */
+func setSource(source string, gormdb *gorm.DB, conf *Config) (old *gorm.DB) {
+	lock.Lock()
+	defer lock.Unlock()
+	if conf == nil {
+		delete(confs, source)
+	} else {
+		confs[source] = *conf
+	}
+	if source == "" {
+		old, db = db, gormdb
+		return old
+	}
+	old = dbs[source]
+	if gormdb == nil {
+		delete(dbs, source)
+	} else {
+		dbs[source] = gormdb
+	}
+	return old
+}
+
+/* 延遲關閉舊連線及其副本 */
+func closeLater(old *gorm.DB) {
+	if old == nil {
+		return
+	}
+	closeFn := func() {
+		if rs, ok := old.Config.Plugins[replicaPluginName].(*replicaSet); ok {
+			rs.Close()
+		}
+		if sqlDB, err := old.DB(); err == nil {
+			if err = sqlDB.Close(); err != nil {
+				zlog.Warn("close old db err:", err)
+			}
+		}
+	}
+	if ReloadCloseDelay <= 0 {
+		closeFn()
+		return
+	}
+	time.AfterFunc(ReloadCloseDelay, closeFn)
+}
+
+/* 依設定開啟連線並設置連接池 */
+func openGorm(conf Config) (*gorm.DB, error) {
+	dsn, err := conf.DSN()
+	if err != nil {
+		return nil, err
+	}
 
 	// log初始化設定
 	logger := zapgorm2.Logger{
 		ZapLogger:                 zlog.GetLog(),
-		LogLevel:                  gormlogger.Info,
-		SlowThreshold:             100 * time.Millisecond,
+		LogLevel:                  conf.logLevel(),
+		SlowThreshold:             conf.SlowThreshold,
 		SkipCallerLookup:          false,
 		IgnoreRecordNotFoundError: false,
 	}
 
 	// 連線
-	gormdb, err := gorm.Open(apmmysql.Open(dsn), &gorm.Config{
+	gormdb, err := gorm.Open(conf.dialector(dsn), &gorm.Config{
 		Logger: logger,
 	})
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if err = usePlugins(gormdb, conf); err != nil {
+		return nil, err
 	}
 
 	// 設置連接池數據
 	sqlDB, err := gormdb.DB()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	err = sqlDB.Ping()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	// SetMaxIdleCons 设置连接池中的最大闲置连接数。
-	sqlDB.SetMaxIdleConns(10)
+	sqlDB.SetMaxIdleConns(conf.MaxIdleConns)
 	// SetMaxOpenCons 设置数据库的最大连接数量。
-	sqlDB.SetMaxOpenConns(100)
+	sqlDB.SetMaxOpenConns(conf.MaxOpenConns)
 	// 閒置連線的最大存在時間
-	sqlDB.SetConnMaxIdleTime(time.Second * 25)
+	sqlDB.SetConnMaxIdleTime(conf.ConnMaxIdleTime)
 	// 連線的最大生存時間 確保連線可以被驅動安全關閉 官方建議小於五分鐘
-	sqlDB.SetConnMaxLifetime(time.Second * 25)
+	sqlDB.SetConnMaxLifetime(conf.ConnMaxLifetime)
 
 	err = sqlDB.Ping()
 	if err != nil {
 		zlog.Error(err)
-		return
+		return nil, err
 	}
+	return gormdb, nil
+}
 
-	if dbSourceName == "" {
-		db = gormdb
-	} else {
-		dbs[dbSourceName] = gormdb
+/* 註冊共用plugin: 樂觀鎖、created_by/updated_by、執行統計 有設定時記錄異動 */
+func usePlugins(gormdb *gorm.DB, conf Config) error {
+	if err := gormdb.Use(optimisticLock{}); err != nil {
+		return err
+	}
+	if err := gormdb.Use(operatorPlugin{}); err != nil {
+		return err
+	}
+	if err := gormdb.Use(&metricsPlugin{source: conf.Source, slowThreshold: conf.SlowThreshold}); err != nil {
+		return err
+	}
+	audit, err := newAuditPlugin(conf)
+	if err != nil || audit == nil {
+		return err
+	}
+	return gormdb.Use(audit)
+}
+
+/* 只開啟連線池 不建立gorm.DB及plugin 給讀取副本使用 */
+func (c Config) openPool() (*sql.DB, error) {
+	dsn, err := c.DSN()
+	if err != nil {
+		return nil, err
 	}
-	return err
+	sqlDB, err := sql.Open(c.driver(dsn))
+	if err != nil {
+		return nil, err
+	}
+	sqlDB.SetMaxIdleConns(c.MaxIdleConns)
+	sqlDB.SetMaxOpenConns(c.MaxOpenConns)
+	sqlDB.SetConnMaxIdleTime(c.ConnMaxIdleTime)
+	sqlDB.SetConnMaxLifetime(c.ConnMaxLifetime)
+	return sqlDB, nil
 }
 
 /*
@@ -83,6 +259,8 @@ func InitDB(host, schema, user, password, dbSourceName string) (err error) {
 	!important do not change db.config
 */
 func GetDB(sourceName ...string) *gorm.DB {
+	lock.RLock()
+	defer lock.RUnlock()
 	if len(sourceName) == 0 {
 		return db
 	}
@@ -94,34 +272,52 @@ func GetDB(sourceName ...string) *gorm.DB {
 
 /* 多連線源 給連線源名稱 */
 func Begin(sourceName ...string) *gorm.DB {
-	if len(sourceName) == 0 {
-		return db.Begin()
-	}
-	if dbs[sourceName[0]] == nil {
-		zlog.Panic("can't find the source config :", sourceName[0])
-	}
-	return dbs[sourceName[0]].Begin()
+	return GetDB(sourceName...).Begin()
 }
 
-func GetMock() (*gorm.DB, sqlmock.Sqlmock) {
+/* dialect未給時為mysql */
+func GetMock(dialect ...string) (*gorm.DB, sqlmock.Sqlmock) {
+	d := DialectMysql
+	if len(dialect) > 0 && dialect[0] != "" {
+		d = dialect[0]
+	}
 	db, mock, _ := sqlmock.New()
-	gormDB, _ := gorm.Open(mysql.New(mysql.Config{
-		SkipInitializeWithVersion: true,
-		Conn:                      db,
-	}), &gorm.Config{})
+	gormDB, _ := gorm.Open(mockDialector(d, db), &gorm.Config{})
 	return gormDB, mock
 }
 
 func NewMockDb(sourceName ...string) sqlmock.Sqlmock {
-	mockDB, mock, _ := sqlmock.New()
-	gormMockDB, _ := gorm.Open(mysql.New(mysql.Config{
-		SkipInitializeWithVersion: true,
-		Conn:                      mockDB,
-	}), &gorm.Config{})
-	if len(sourceName) == 0 || sourceName[0] == "" {
-		db = gormMockDB
-	} else {
-		dbs[sourceName[0]] = gormMockDB
+	return NewMockDbWithDialect(DialectMysql, sourceName...)
+}
+
+/* 指定dialect的mock連線源 */
+func NewMockDbWithDialect(dialect string, sourceName ...string) sqlmock.Sqlmock {
+	gormMockDB, mock := GetMock(dialect)
+	source := ""
+	if len(sourceName) > 0 {
+		source = sourceName[0]
 	}
+	setSource(source, gormMockDB, nil)
 	return mock
 }
+
+/*
+	單元測試用 以sqlite記憶體資料庫建立連線源 可執行真實SQL
+	只保留一條連線 避免每條連線各自為獨立的記憶體資料庫
+*/
+func NewMemoryDb(sourceName ...string) error {
+	source := ""
+	if len(sourceName) > 0 {
+		source = sourceName[0]
+	}
+	return InitDBWithConfig(Config{
+		Dialect:         DialectSqlite,
+		Schema:          "file::memory:",
+		Source:          source,
+		MaxIdleConns:    1,
+		MaxOpenConns:    1,
+		ConnMaxIdleTime: -1,
+		ConnMaxLifetime: -1,
+		LogLevel:        "silent",
+	})
+}
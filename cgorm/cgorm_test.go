@@ -2,6 +2,9 @@ package cgorm
 
 import (
 	"fmt"
+	"sync"
+	"testing"
+	"time"
 )
 
 /*
@@ -32,3 +35,65 @@ type Demo struct {
 func (Demo) TableName() string {
 	return "demo"
 }
+
+func TestReloadDB(t *testing.T) {
+	ReloadCloseDelay = 0
+	defer func() { ReloadCloseDelay = 10 * time.Second }()
+	conf := func(source string, maxOpen int) Config {
+		return Config{
+			Dialect:      DialectSqlite,
+			Schema:       "file::memory:",
+			Source:       source,
+			MaxIdleConns: 1,
+			MaxOpenConns: maxOpen,
+			LogLevel:     "silent",
+		}
+	}
+	if err := ReloadDB([]Config{conf("reload1", 1), conf("reload2", 1)}); err != nil {
+		t.Fatal(err)
+	}
+	first := GetDB("reload1")
+	keep := GetDB("reload2")
+
+	// 讀取與熱更新同時進行
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				_ = GetDB("reload2")
+			}
+		}
+	}()
+	if err := ReloadDB([]Config{conf("reload1", 2), conf("reload2", 1)}); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	wg.Wait()
+
+	if GetDB("reload1") == first {
+		t.Fatal("changed source should be replaced")
+	}
+	if GetDB("reload2") != keep {
+		t.Fatal("unchanged source should be kept")
+	}
+	if sqlDB, _ := first.DB(); sqlDB.Ping() == nil {
+		t.Fatal("old pool should be closed")
+	}
+
+	if err := ReloadDB([]Config{conf("reload1", 2)}); err != nil {
+		t.Fatal(err)
+	}
+	lock.RLock()
+	_, ok := dbs["reload2"]
+	lock.RUnlock()
+	if ok {
+		t.Fatal("removed source should be deleted")
+	}
+	RemoveDB("reload1")
+}
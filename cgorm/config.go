@@ -0,0 +1,214 @@
+package cgorm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"time"
+
+	gomysql "github.com/go-sql-driver/mysql"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+/*
+	單一連線源的完整設定 對應apollo mysql yaml中的每個項目
+	未設定的欄位使用預設值 與原InitDB相同
+*/
+type Config struct {
+	Dialect string `yaml:"dialect"` // mysql/postgres/sqlite/sqlserver 預設mysql
+	Host    string `yaml:"host"`    // host+port
+	Schema  string `yaml:"schema"`  // schema名稱 sqlite為檔案路徑
+	User    string `yaml:"user"`    // 使用者帳號
+	Pwd     string `yaml:"pwd"`     // 密碼
+	Source  string `yaml:"source"`  // 多連線源使用 給予該連線名稱 若不使用則給空字串
+
+	// DSN參數
+	Charset      string            `yaml:"charset"`      // mysql使用 預設utf8mb4
+	Loc          string            `yaml:"loc"`          // 預設Local
+	ParseTime    *bool             `yaml:"parseTime"`    // 預設true
+	Timeout      time.Duration     `yaml:"timeout"`      // 連線逾時 預設30s
+	ReadTimeout  time.Duration     `yaml:"readTimeout"`  // 讀取逾時 預設不限制
+	WriteTimeout time.Duration     `yaml:"writeTimeout"` // 寫入逾時 預設不限制
+	Params       map[string]string `yaml:"params"`       // 其他DSN參數
+	TLS          TLSConfig         `yaml:"tls"`
+
+	// 連接池
+	MaxIdleConns    int           `yaml:"maxIdleConns"`    // 最大閒置連線數 預設10
+	MaxOpenConns    int           `yaml:"maxOpenConns"`    // 最大連線數 預設100
+	ConnMaxIdleTime time.Duration `yaml:"connMaxIdleTime"` // 閒置連線的最大存在時間 預設25s 負值為不限制
+	ConnMaxLifetime time.Duration `yaml:"connMaxLifetime"` // 連線的最大生存時間 預設25s 官方建議小於五分鐘 負值為不限制
+
+	// 讀寫分離 讀取分配到副本 寫入及交易維持在主庫
+	Replicas            []ReplicaConfig `yaml:"replicas"`
+	ReplicaPolicy       string          `yaml:"replicaPolicy"`       // random/roundrobin 預設random
+	HealthCheckInterval time.Duration   `yaml:"healthCheckInterval"` // 副本健康檢查間隔 預設10s
+
+	// log
+	LogLevel      string        `yaml:"logLevel"`      // silent/error/warn/info 預設info
+	SlowThreshold time.Duration `yaml:"slowThreshold"` // 慢查詢門檻 預設100ms
+
+	// 異動紀錄 只記錄實作Auditable的model
+	Audit      string `yaml:"audit"`      // table/kafka 未設定時不記錄
+	AuditTopic string `yaml:"auditTopic"` // audit為kafka時寫入的topic
+}
+
+type TLSConfig struct {
+	Enable             bool   `yaml:"enable"`
+	CAFile             string `yaml:"caFile"`
+	CertFile           string `yaml:"certFile"`
+	KeyFile            string `yaml:"keyFile"`
+	ServerName         string `yaml:"serverName"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+/* 補上未設定欄位的預設值 */
+func (c Config) withDefault() Config {
+	if c.Dialect == "" {
+		c.Dialect = DialectMysql
+	}
+	if c.Charset == "" {
+		c.Charset = "utf8mb4"
+	}
+	if c.Loc == "" {
+		c.Loc = "Local"
+	}
+	if c.ParseTime == nil {
+		parseTime := true
+		c.ParseTime = &parseTime
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 30 * time.Second
+	}
+	if c.MaxIdleConns == 0 {
+		c.MaxIdleConns = 10
+	}
+	if c.MaxOpenConns == 0 {
+		c.MaxOpenConns = 100
+	}
+	if c.ConnMaxIdleTime == 0 {
+		c.ConnMaxIdleTime = 25 * time.Second
+	}
+	if c.ConnMaxLifetime == 0 {
+		c.ConnMaxLifetime = 25 * time.Second
+	}
+	if c.ReplicaPolicy == "" {
+		c.ReplicaPolicy = PolicyRandom
+	}
+	if c.HealthCheckInterval == 0 {
+		c.HealthCheckInterval = 10 * time.Second
+	}
+	if c.LogLevel == "" {
+		c.LogLevel = "info"
+	}
+	if c.SlowThreshold == 0 {
+		c.SlowThreshold = 100 * time.Millisecond
+	}
+	return c
+}
+
+/* 依dialect組合DSN */
+func (c Config) DSN() (string, error) {
+	c = c.withDefault()
+	switch c.Dialect {
+	case DialectMysql:
+		return c.mysqlDSN()
+	case DialectPostgres:
+		return c.postgresDSN(), nil
+	case DialectSqlite:
+		return c.sqliteDSN(), nil
+	case DialectSqlserver:
+		return c.sqlserverDSN(), nil
+	default:
+		return "", errors.New("unsupported dialect: " + c.Dialect)
+	}
+}
+
+/* 組合mysql DSN 有設定TLS時會註冊對應的tls設定 */
+func (c Config) mysqlDSN() (string, error) {
+	loc, err := time.LoadLocation(c.Loc)
+	if err != nil {
+		return "", err
+	}
+
+	mc := gomysql.NewConfig()
+	mc.User = c.User
+	mc.Passwd = c.Pwd
+	mc.Net = "tcp"
+	mc.Addr = c.Host
+	mc.DBName = c.Schema
+	mc.Loc = loc
+	mc.ParseTime = *c.ParseTime
+	mc.Timeout = c.Timeout
+	mc.ReadTimeout = c.ReadTimeout
+	mc.WriteTimeout = c.WriteTimeout
+	mc.Params = map[string]string{"charset": c.Charset}
+	for k, v := range c.Params {
+		mc.Params[k] = v
+	}
+
+	if c.TLS.Enable {
+		name, err := c.registerTLS()
+		if err != nil {
+			return "", err
+		}
+		mc.TLSConfig = name
+	}
+	return mc.FormatDSN(), nil
+}
+
+/* 只開啟TLS時使用driver內建的"true" 有自訂憑證時註冊為"cgorm_{source}" */
+func (c Config) registerTLS() (string, error) {
+	t := c.TLS
+	if t.CAFile == "" && t.CertFile == "" && t.ServerName == "" {
+		if t.InsecureSkipVerify {
+			return "skip-verify", nil
+		}
+		return "true", nil
+	}
+
+	tlsConf := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return "", err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return "", errors.New("append mysql ca cert fail: " + t.CAFile)
+		}
+		tlsConf.RootCAs = pool
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return "", err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+
+	name := "cgorm_" + c.Source
+	if c.Source == "" {
+		name = "cgorm_default"
+	}
+	if err := gomysql.RegisterTLSConfig(name, tlsConf); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (c Config) logLevel() gormlogger.LogLevel {
+	switch c.LogLevel {
+	case "silent":
+		return gormlogger.Silent
+	case "error":
+		return gormlogger.Error
+	case "warn":
+		return gormlogger.Warn
+	default:
+		return gormlogger.Info
+	}
+}
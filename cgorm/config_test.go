@@ -0,0 +1,73 @@
+package cgorm
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+func TestConfig_DSN(t *testing.T) {
+	tests := []struct {
+		name string
+		conf Config
+		want string
+	}{
+		{
+			name: "default",
+			conf: Config{Host: "127.0.0.1:3306", Schema: "gl", User: "root", Pwd: "123456"},
+			want: "root:123456@tcp(127.0.0.1:3306)/gl?loc=Local&parseTime=true&timeout=30s&charset=utf8mb4",
+		},
+		{
+			name: "custom",
+			conf: Config{Host: "127.0.0.1:3306", Schema: "gl", User: "root", Pwd: "123456",
+				Charset: "utf8", Loc: "UTC", ReadTimeout: 5 * time.Second, WriteTimeout: 3 * time.Second,
+				Params: map[string]string{"sql_mode": "TRADITIONAL"}, TLS: TLSConfig{Enable: true}},
+			want: "root:123456@tcp(127.0.0.1:3306)/gl?parseTime=true&readTimeout=5s&timeout=30s&tls=true&writeTimeout=3s&charset=utf8&sql_mode=TRADITIONAL",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.conf.DSN()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("DSN() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_Yaml(t *testing.T) {
+	str := `
+mysql:
+  -
+    host: 127.0.0.1:10038
+    schema: schema12
+    user: root
+    pwd: 1234567
+    source: source2
+    maxOpenConns: 50
+    connMaxLifetime: 1m
+    slowThreshold: 200ms
+    logLevel: warn
+`
+	var m struct {
+		Mysql []Config `yaml:"mysql"`
+	}
+	if err := yaml.Unmarshal([]byte(str), &m); err != nil {
+		t.Fatal(err)
+	}
+	conf := m.Mysql[0].withDefault()
+	if conf.Source != "source2" || conf.Pwd != "1234567" || conf.MaxOpenConns != 50 || conf.MaxIdleConns != 10 {
+		t.Errorf("unexpected conf %+v", conf)
+	}
+	if conf.ConnMaxLifetime != time.Minute || conf.SlowThreshold != 200*time.Millisecond {
+		t.Errorf("unexpected duration %v %v", conf.ConnMaxLifetime, conf.SlowThreshold)
+	}
+	if conf.logLevel() != gormlogger.Warn {
+		t.Errorf("logLevel() = %v, want warn", conf.logLevel())
+	}
+}
@@ -0,0 +1,134 @@
+package cgorm
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+const (
+	optimisticLockName = "cgorm:optimistic_lock"
+)
+
+var ErrConflict = errors.New("optimistic lock conflict")
+
+/*
+	樂觀鎖版本欄位 model宣告此型別的欄位即啟用
+	新增時為1 以struct更新時條件加上version=目前版本並將版本+1
+	更新筆數為0時回傳*ConflictError 可用errors.Is(err, cgorm.ErrConflict)判斷
+*/
+type Version int64
+
+var versionType = reflect.TypeOf(Version(0))
+
+type ConflictError struct {
+	Table   string
+	Version int64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s: table %s version %d", ErrConflict, e.Table, e.Version)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+type optimisticLock struct{}
+
+func (optimisticLock) Name() string {
+	return optimisticLockName
+}
+
+func (l optimisticLock) Initialize(db *gorm.DB) error {
+	if err := db.Callback().Create().Before("gorm:create").Register(optimisticLockName, l.beforeCreate); err != nil {
+		return err
+	}
+	if err := db.Callback().Update().Before("gorm:update").Register(optimisticLockName, l.beforeUpdate); err != nil {
+		return err
+	}
+	return db.Callback().Update().After("gorm:update").Register(optimisticLockName+"_check", l.afterUpdate)
+}
+
+func versionField(stmt *gorm.Statement) *schema.Field {
+	if stmt.Schema == nil {
+		return nil
+	}
+	for _, f := range stmt.Schema.Fields {
+		if f.FieldType == versionType && f.DBName != "" {
+			return f
+		}
+	}
+	return nil
+}
+
+/* 新增時版本未設定則為1 */
+func (optimisticLock) beforeCreate(db *gorm.DB) {
+	field := versionField(db.Statement)
+	if field == nil || db.Error != nil {
+		return
+	}
+	rv := db.Statement.ReflectValue
+	switch rv.Kind() {
+	case reflect.Struct:
+		if _, isZero := field.ValueOf(rv); isZero {
+			db.AddError(field.Set(rv, 1))
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if _, isZero := field.ValueOf(rv.Index(i)); isZero {
+				db.AddError(field.Set(rv.Index(i), 1))
+			}
+		}
+	}
+}
+
+/*
+	model帶有版本時 條件加上version=目前版本 並更新為下一版
+	批次更新(model未帶版本)且以map更新時 版本欄位+1
+*/
+func (optimisticLock) beforeUpdate(db *gorm.DB) {
+	stmt := db.Statement
+	field := versionField(stmt)
+	if field == nil || db.Error != nil {
+		return
+	}
+	if _, ok := stmt.Dest.(map[string]interface{}); ok {
+		delete(stmt.Dest.(map[string]interface{}), field.Name)
+		delete(stmt.Dest.(map[string]interface{}), field.DBName)
+	}
+	var current int64
+	if stmt.ReflectValue.Kind() == reflect.Struct {
+		v, _ := field.ValueOf(stmt.ReflectValue)
+		current = int64(v.(Version))
+	}
+	if current == 0 {
+		if _, ok := stmt.Dest.(map[string]interface{}); ok {
+			stmt.SetColumn(field.DBName, gorm.Expr("? + 1", clause.Column{Name: field.DBName}))
+		}
+		return
+	}
+	stmt.AddClause(clause.Where{Exprs: []clause.Expression{
+		clause.Eq{Column: clause.Column{Table: clause.CurrentTable, Name: field.DBName}, Value: current},
+	}})
+	stmt.SetColumn(field.DBName, Version(current+1))
+	db.InstanceSet(optimisticLockName, current)
+}
+
+/* 更新筆數為0表示版本已被其他人更新 還原model的版本並回傳衝突錯誤 */
+func (optimisticLock) afterUpdate(db *gorm.DB) {
+	v, ok := db.InstanceGet(optimisticLockName)
+	if !ok || db.Error != nil || db.RowsAffected > 0 {
+		return
+	}
+	current := v.(int64)
+	stmt := db.Statement
+	if field := versionField(stmt); field != nil && stmt.ReflectValue.CanAddr() {
+		field.Set(stmt.ReflectValue, Version(current))
+	}
+	db.AddError(&ConflictError{Table: stmt.Table, Version: current})
+}
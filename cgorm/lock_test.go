@@ -0,0 +1,58 @@
+package cgorm
+
+import (
+	"errors"
+	"testing"
+)
+
+type lockDemo struct {
+	Id      int64 `gorm:"primaryKey"`
+	Name    string
+	Version Version
+}
+
+func TestOptimisticLock(t *testing.T) {
+	if err := NewMemoryDb("lock"); err != nil {
+		t.Fatal(err)
+	}
+	db := GetDB("lock")
+	if err := db.AutoMigrate(&lockDemo{}); err != nil {
+		t.Fatal(err)
+	}
+	a := lockDemo{Name: "a"}
+	if err := db.Create(&a).Error; err != nil {
+		t.Fatal(err)
+	}
+	if a.Version != 1 {
+		t.Fatalf("want version 1, got %d", a.Version)
+	}
+
+	b := a
+	a.Name = "a1"
+	if err := db.Save(&a).Error; err != nil {
+		t.Fatal(err)
+	}
+	if a.Version != 2 {
+		t.Fatalf("want version 2, got %d", a.Version)
+	}
+
+	// b仍為舊版本 更新時衝突
+	err := db.Model(&b).Updates(map[string]interface{}{"name": "b1"}).Error
+	var conflict *ConflictError
+	if !errors.Is(err, ErrConflict) || !errors.As(err, &conflict) || conflict.Version != 1 {
+		t.Fatalf("want conflict error, got %v", err)
+	}
+	if b.Version != 1 {
+		t.Fatalf("version should be restored, got %d", b.Version)
+	}
+
+	// 批次更新時版本+1
+	if err := db.Model(&lockDemo{}).Where("id = ?", a.Id).Update("name", "c").Error; err != nil {
+		t.Fatal(err)
+	}
+	var got lockDemo
+	db.First(&got, a.Id)
+	if got.Version != 3 || got.Name != "c" {
+		t.Fatalf("unexpected row %+v", got)
+	}
+}
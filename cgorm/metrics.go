@@ -0,0 +1,282 @@
+package cgorm
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	metricsPluginName = "cgorm:metrics"
+	metricsStartKey   = "cgorm:metrics_start"
+)
+
+// 延遲分布的區間上限
+var MetricsBuckets = []time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond,
+	50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second,
+}
+
+// 慢查詢保留的指紋數量 超過時移除最大耗時最小的
+var SlowQueryTopN = 50
+
+// 依連線源、資料表、操作統計
+type QueryStat struct {
+	Source    string        `json:"source"`
+	Table     string        `json:"table"`
+	Operation string        `json:"operation"`
+	Count     uint64        `json:"count"`
+	Errors    uint64        `json:"errors"`
+	Rows      int64         `json:"rows"`
+	Total     time.Duration `json:"total"`
+	Buckets   []uint64      `json:"buckets"` // 對應MetricsBuckets 落在各區間的次數 最後一個為超過最大區間
+}
+
+// 正規化後相同的SQL視為同一個慢查詢
+type SlowQuery struct {
+	Source      string        `json:"source"`
+	Fingerprint string        `json:"fingerprint"`
+	Count       uint64        `json:"count"`
+	Max         time.Duration `json:"max"`
+	Total       time.Duration `json:"total"`
+	LastSeen    time.Time     `json:"lastSeen"`
+}
+
+type MetricsSnapshot struct {
+	Queries     []QueryStat `json:"queries"`
+	SlowQueries []SlowQuery `json:"slowQueries"` // 依Max由大到小
+}
+
+type statKey struct {
+	source, table, operation string
+}
+
+type slowKey struct {
+	source, fingerprint string
+}
+
+var metrics = struct {
+	sync.Mutex
+	stats map[statKey]*QueryStat
+	slows map[slowKey]*SlowQuery
+}{
+	stats: make(map[statKey]*QueryStat),
+	slows: make(map[slowKey]*SlowQuery),
+}
+
+/* 記錄每次執行的耗時、影響筆數及錯誤 超過慢查詢門檻時記錄SQL指紋 */
+type metricsPlugin struct {
+	source        string
+	slowThreshold time.Duration
+}
+
+func (p *metricsPlugin) Name() string {
+	return metricsPluginName
+}
+
+func (p *metricsPlugin) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	start := metricsPluginName + "_start"
+	// gorm v1.21的callback排序遇到"*"時會打亂預設callback的順序 需指定名稱
+	errs := []error{
+		cb.Create().Before("gorm:begin_transaction").Register(start, p.start),
+		cb.Create().After("gorm:commit_or_rollback_transaction").Register(metricsPluginName, p.end("create")),
+		cb.Query().Before("gorm:query").Register(start, p.start),
+		cb.Query().After("gorm:after_query").Register(metricsPluginName, p.end("query")),
+		cb.Update().Before("gorm:begin_transaction").Register(start, p.start),
+		cb.Update().After("gorm:commit_or_rollback_transaction").Register(metricsPluginName, p.end("update")),
+		cb.Delete().Before("gorm:begin_transaction").Register(start, p.start),
+		cb.Delete().After("gorm:commit_or_rollback_transaction").Register(metricsPluginName, p.end("delete")),
+		cb.Row().Before("gorm:row").Register(start, p.start),
+		cb.Row().After("gorm:row").Register(metricsPluginName, p.end("row")),
+		cb.Raw().Before("gorm:raw").Register(start, p.start),
+		cb.Raw().After("gorm:raw").Register(metricsPluginName, p.end("raw")),
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *metricsPlugin) start(db *gorm.DB) {
+	db.InstanceSet(metricsStartKey, time.Now())
+}
+
+func (p *metricsPlugin) end(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		v, ok := db.InstanceGet(metricsStartKey)
+		if !ok {
+			return
+		}
+		elapsed := time.Since(v.(time.Time))
+		failed := db.Error != nil && !errors.Is(db.Error, gorm.ErrRecordNotFound)
+		table := db.Statement.Table
+		if table == "" {
+			table = "-"
+		}
+
+		metrics.Lock()
+		defer metrics.Unlock()
+		key := statKey{source: p.source, table: table, operation: operation}
+		stat, ok := metrics.stats[key]
+		if !ok {
+			stat = &QueryStat{Source: p.source, Table: table, Operation: operation, Buckets: make([]uint64, len(MetricsBuckets)+1)}
+			metrics.stats[key] = stat
+		}
+		stat.Count++
+		stat.Total += elapsed
+		stat.Rows += db.RowsAffected
+		if failed {
+			stat.Errors++
+		}
+		stat.Buckets[sort.Search(len(MetricsBuckets), func(i int) bool { return MetricsBuckets[i] >= elapsed })]++
+
+		if p.slowThreshold > 0 && elapsed >= p.slowThreshold {
+			p.recordSlow(Fingerprint(db.Statement.SQL.String()), elapsed)
+		}
+	}
+}
+
+/* 需持有metrics的鎖 */
+func (p *metricsPlugin) recordSlow(fingerprint string, elapsed time.Duration) {
+	key := slowKey{source: p.source, fingerprint: fingerprint}
+	slow, ok := metrics.slows[key]
+	if !ok {
+		if len(metrics.slows) >= SlowQueryTopN && !evictSlow(elapsed) {
+			return
+		}
+		slow = &SlowQuery{Source: p.source, Fingerprint: fingerprint}
+		metrics.slows[key] = slow
+	}
+	slow.Count++
+	slow.Total += elapsed
+	slow.LastSeen = time.Now()
+	if elapsed > slow.Max {
+		slow.Max = elapsed
+	}
+}
+
+/* 移除最大耗時最小的慢查詢 新的耗時更小時不移除 */
+func evictSlow(elapsed time.Duration) bool {
+	var minKey slowKey
+	var min *SlowQuery
+	for k, s := range metrics.slows {
+		if min == nil || s.Max < min.Max {
+			minKey, min = k, s
+		}
+	}
+	if min == nil || min.Max >= elapsed {
+		return false
+	}
+	delete(metrics.slows, minKey)
+	return true
+}
+
+var (
+	fingerprintStr   = regexp.MustCompile(`'(?:[^'\\]|\\.|'')*'|"(?:[^"\\]|\\.)*"`)
+	fingerprintNum   = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+	fingerprintList  = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	fingerprintSpace = regexp.MustCompile(`\s+`)
+)
+
+/* 正規化SQL 字串及數字替換為? IN列表合併為(?) 例: "id IN (1,2,3)" => "id in (?)" */
+func Fingerprint(sql string) string {
+	sql = fingerprintStr.ReplaceAllString(sql, "?")
+	sql = fingerprintNum.ReplaceAllString(sql, "?")
+	sql = fingerprintList.ReplaceAllString(sql, "(?)")
+	sql = fingerprintSpace.ReplaceAllString(sql, " ")
+	return strings.ToLower(strings.TrimSpace(sql))
+}
+
+/* 取得目前的統計 */
+func GetMetrics() MetricsSnapshot {
+	metrics.Lock()
+	defer metrics.Unlock()
+	snap := MetricsSnapshot{
+		Queries:     make([]QueryStat, 0, len(metrics.stats)),
+		SlowQueries: make([]SlowQuery, 0, len(metrics.slows)),
+	}
+	for _, s := range metrics.stats {
+		stat := *s
+		stat.Buckets = append([]uint64{}, s.Buckets...)
+		snap.Queries = append(snap.Queries, stat)
+	}
+	for _, s := range metrics.slows {
+		snap.SlowQueries = append(snap.SlowQueries, *s)
+	}
+	sort.Slice(snap.Queries, func(i, j int) bool {
+		a, b := snap.Queries[i], snap.Queries[j]
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		if a.Table != b.Table {
+			return a.Table < b.Table
+		}
+		return a.Operation < b.Operation
+	})
+	sort.Slice(snap.SlowQueries, func(i, j int) bool { return snap.SlowQueries[i].Max > snap.SlowQueries[j].Max })
+	return snap
+}
+
+/* 清除所有統計 */
+func ResetMetrics() {
+	metrics.Lock()
+	defer metrics.Unlock()
+	metrics.stats = make(map[statKey]*QueryStat)
+	metrics.slows = make(map[slowKey]*SlowQuery)
+}
+
+/* 以prometheus text格式輸出 */
+func WriteMetrics(w io.Writer) error {
+	snap := GetMetrics()
+	var sb strings.Builder
+	sb.WriteString("# TYPE cgorm_query_duration_seconds histogram\n")
+	for _, s := range snap.Queries {
+		labels := fmt.Sprintf(`source=%q,table=%q,operation=%q`, s.Source, s.Table, s.Operation)
+		var cumulative uint64
+		for i, b := range MetricsBuckets {
+			cumulative += s.Buckets[i]
+			fmt.Fprintf(&sb, "cgorm_query_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, b.Seconds(), cumulative)
+		}
+		fmt.Fprintf(&sb, "cgorm_query_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, s.Count)
+		fmt.Fprintf(&sb, "cgorm_query_duration_seconds_sum{%s} %g\n", labels, s.Total.Seconds())
+		fmt.Fprintf(&sb, "cgorm_query_duration_seconds_count{%s} %d\n", labels, s.Count)
+	}
+	sb.WriteString("# TYPE cgorm_query_rows_total counter\n")
+	for _, s := range snap.Queries {
+		fmt.Fprintf(&sb, "cgorm_query_rows_total{source=%q,table=%q,operation=%q} %d\n", s.Source, s.Table, s.Operation, s.Rows)
+	}
+	sb.WriteString("# TYPE cgorm_query_errors_total counter\n")
+	for _, s := range snap.Queries {
+		fmt.Fprintf(&sb, "cgorm_query_errors_total{source=%q,table=%q,operation=%q} %d\n", s.Source, s.Table, s.Operation, s.Errors)
+	}
+	sb.WriteString("# TYPE cgorm_slow_query_max_seconds gauge\n")
+	for _, s := range snap.SlowQueries {
+		fmt.Fprintf(&sb, "cgorm_slow_query_max_seconds{source=%q,fingerprint=%q} %g\n", s.Source, s.Fingerprint, s.Max.Seconds())
+	}
+	sb.WriteString("# TYPE cgorm_slow_query_total counter\n")
+	for _, s := range snap.SlowQueries {
+		fmt.Fprintf(&sb, "cgorm_slow_query_total{source=%q,fingerprint=%q} %d\n", s.Source, s.Fingerprint, s.Count)
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+/* 提供prometheus抓取的handler 例: mux.Handle("/metrics/db", cgorm.MetricsHandler()) */
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteMetrics(w)
+	})
+}
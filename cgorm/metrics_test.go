@@ -0,0 +1,83 @@
+package cgorm
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFingerprint(t *testing.T) {
+	cases := map[string]string{
+		"SELECT * FROM `demo` WHERE id IN (1, 2,3) AND name = 'a''b'": "select * from `demo` where id in (?) and name = ?",
+		"UPDATE t1 SET age=18\n  WHERE id = ?":                        "update t1 set age=? where id = ?",
+		"SELECT * FROM demo WHERE id IN (?,?,?)":                      "select * from demo where id in (?)",
+	}
+	for sql, want := range cases {
+		if got := Fingerprint(sql); got != want {
+			t.Errorf("Fingerprint(%q) = %q, want %q", sql, got, want)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ResetMetrics()
+	if err := NewMemoryDb("metrics"); err != nil {
+		t.Fatal(err)
+	}
+	db := GetDB("metrics")
+	db.AutoMigrate(&Demo{})
+	db.Create(&[]Demo{{Name: "a"}, {Name: "b"}})
+	var list []Demo
+	db.Find(&list)
+	db.Table("nothing").Find(&list)
+
+	var stat *QueryStat
+	for _, s := range GetMetrics().Queries {
+		s := s
+		if s.Source == "metrics" && s.Table == "demo" && s.Operation == "create" {
+			stat = &s
+		}
+	}
+	if stat == nil || stat.Count != 1 || stat.Rows != 2 {
+		t.Fatalf("unexpected create stat %+v", stat)
+	}
+	var errCount uint64
+	for _, s := range GetMetrics().Queries {
+		if s.Table == "nothing" {
+			errCount += s.Errors
+		}
+	}
+	if errCount != 1 {
+		t.Fatalf("want 1 error, got %d", errCount)
+	}
+
+	// 慢查詢只保留耗時最大的TopN
+	p := &metricsPlugin{source: "slow", slowThreshold: time.Millisecond}
+	defer func(n int) { SlowQueryTopN = n }(SlowQueryTopN)
+	SlowQueryTopN = 2
+	metrics.Lock()
+	p.recordSlow("q1", 10*time.Millisecond)
+	p.recordSlow("q2", 20*time.Millisecond)
+	p.recordSlow("q3", 5*time.Millisecond)
+	p.recordSlow("q4", 30*time.Millisecond)
+	p.recordSlow("q4", 40*time.Millisecond)
+	metrics.Unlock()
+	slows := GetMetrics().SlowQueries
+	if len(slows) != 2 || slows[0].Fingerprint != "q4" || slows[0].Count != 2 || slows[1].Fingerprint != "q2" {
+		t.Fatalf("unexpected slow queries %+v", slows)
+	}
+
+	rec := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`cgorm_query_duration_seconds_count{source="metrics",table="demo",operation="create"} 1`,
+		`cgorm_query_rows_total{source="metrics",table="demo",operation="create"} 2`,
+		`cgorm_slow_query_total{source="slow",fingerprint="q4"} 2`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("metrics output missing %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+// 資料庫版本遷移 每個cgorm連線源各自維護已執行的版本
+//
+//	//go:embed migrations/*.sql
+//	var fsys embed.FS
+//
+//	ms, _ := migrate.LoadFS(fsys, "migrations")
+//	err := migrate.ForSource("source2", ms).Up(ctx)
+//
+// 檔名格式: {version}_{name}.up.sql / {version}_{name}.down.sql 例: 0001_create_user.up.sql
+// 多個SQL以行尾的";"分隔
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rickylin614/common/cgorm"
+	"github.com/rickylin614/common/zlog"
+	"gorm.io/gorm"
+)
+
+// 預設記錄版本的資料表
+const DefaultTable = "schema_migrations"
+
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string // SQL
+	Down    string // SQL
+	// Go撰寫的遷移 有設定時取代Up/Down的SQL
+	UpFunc   func(tx *gorm.DB) error
+	DownFunc func(tx *gorm.DB) error
+}
+
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt *time.Time
+}
+
+// 已執行的版本紀錄
+type record struct {
+	Version   int64  `gorm:"primaryKey;autoIncrement:false"`
+	Name      string `gorm:"size:255"`
+	AppliedAt time.Time
+}
+
+type Migrator struct {
+	db          *gorm.DB
+	migrations  []Migration
+	table       string
+	lockName    string
+	lockTimeout time.Duration
+	dryRun      bool
+}
+
+type Option func(*Migrator)
+
+/* 記錄版本的資料表名稱 */
+func WithTable(table string) Option {
+	return func(m *Migrator) {
+		m.table = table
+	}
+}
+
+/* 多個pod同時啟動時 只有取得鎖的pod執行遷移 預設鎖名為資料表名稱 等待60秒 */
+func WithLock(name string, timeout time.Duration) Option {
+	return func(m *Migrator) {
+		m.lockName = name
+		m.lockTimeout = timeout
+	}
+}
+
+/* 只輸出將執行的SQL 不實際執行也不記錄版本 */
+func WithDryRun() Option {
+	return func(m *Migrator) {
+		m.dryRun = true
+	}
+}
+
+/* db通常為cgorm.GetDB(sourceName) */
+func New(db *gorm.DB, migrations []Migration, opts ...Option) *Migrator {
+	m := &Migrator{
+		db:          db,
+		migrations:  append([]Migration{}, migrations...),
+		table:       DefaultTable,
+		lockTimeout: 60 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.lockName == "" {
+		m.lockName = m.table
+	}
+	sort.Slice(m.migrations, func(i, j int) bool {
+		return m.migrations[i].Version < m.migrations[j].Version
+	})
+	return m
+}
+
+/* 對InitDB註冊的連線源執行遷移 sourceName空字串為預設連線源 */
+func ForSource(sourceName string, migrations []Migration, opts ...Option) *Migrator {
+	if sourceName == "" {
+		return New(cgorm.GetDB(), migrations, opts...)
+	}
+	return New(cgorm.GetDB(sourceName), migrations, opts...)
+}
+
+var fileRegexp = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+/* 從fs(通常為embed.FS)的dir讀取SQL遷移檔 */
+func LoadFS(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int64]*Migration)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		match := fileRegexp.FindStringSubmatch(e.Name())
+		if match == nil {
+			continue
+		}
+		version, _ := strconv.ParseInt(match[1], 10, 64)
+		b, err := fs.ReadFile(fsys, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = mig
+		} else if mig.Name != match[2] {
+			return nil, fmt.Errorf("migration version %d has different names: %s, %s", version, mig.Name, match[2])
+		}
+		if match[3] == "up" {
+			mig.Up = string(b)
+		} else {
+			mig.Down = string(b)
+		}
+	}
+	list := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		list = append(list, *mig)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version < list[j].Version })
+	return list, nil
+}
+
+/* 執行所有尚未執行的版本 */
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.withLock(ctx, func(db *gorm.DB) error {
+		applied, err := m.applied(db)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+			if err := m.run(db, mig, true); err != nil {
+				return fmt.Errorf("migrate up %d_%s: %w", mig.Version, mig.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+/* 由最新版本往回復原steps個版本 */
+func (m *Migrator) Down(ctx context.Context, steps int) error {
+	return m.withLock(ctx, func(db *gorm.DB) error {
+		applied, err := m.applied(db)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && steps > 0; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+			if err := m.run(db, mig, false); err != nil {
+				return fmt.Errorf("migrate down %d_%s: %w", mig.Version, mig.Name, err)
+			}
+			steps--
+		}
+		return nil
+	})
+}
+
+/* 所有版本的執行狀態 */
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied(m.primary(ctx))
+	if err != nil {
+		return nil, err
+	}
+	list := make([]MigrationStatus, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		s := MigrationStatus{Version: mig.Version, Name: mig.Name}
+		if r, ok := applied[mig.Version]; ok {
+			s.Applied = true
+			appliedAt := r.AppliedAt
+			s.AppliedAt = &appliedAt
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+/* 讀取走主庫 避免讀寫分離時讀到落後的副本 */
+func (m *Migrator) primary(ctx context.Context) *gorm.DB {
+	return m.db.WithContext(ctx).Clauses(cgorm.UsePrimary).Session(&gorm.Session{})
+}
+
+/* 取得已執行的版本 資料表不存在時建立 */
+func (m *Migrator) applied(db *gorm.DB) (map[int64]record, error) {
+	if !db.Migrator().HasTable(m.table) {
+		if m.dryRun {
+			return map[int64]record{}, nil
+		}
+		if err := db.Table(m.table).AutoMigrate(&record{}); err != nil {
+			return nil, err
+		}
+	}
+	var records []record
+	if err := db.Table(m.table).Find(&records).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[int64]record, len(records))
+	for _, r := range records {
+		applied[r.Version] = r
+	}
+	return applied, nil
+}
+
+/* 在交易中執行單一版本並更新紀錄 */
+func (m *Migrator) run(db *gorm.DB, mig Migration, up bool) error {
+	sqlText, fn := mig.Down, mig.DownFunc
+	direction := "down"
+	if up {
+		sqlText, fn = mig.Up, mig.UpFunc
+		direction = "up"
+	}
+	if fn == nil && strings.TrimSpace(sqlText) == "" {
+		return errors.New("no " + direction + " migration")
+	}
+
+	if m.dryRun {
+		zlog.Infof("[dry run] migrate %s %d_%s", direction, mig.Version, mig.Name)
+		if fn != nil {
+			zlog.Info("[dry run] go migration")
+		}
+		for _, stmt := range splitStatements(sqlText) {
+			zlog.Info("[dry run] ", stmt)
+		}
+		return nil
+	}
+
+	zlog.Infof("migrate %s %d_%s", direction, mig.Version, mig.Name)
+	return db.Transaction(func(tx *gorm.DB) error {
+		if fn != nil {
+			if err := fn(tx); err != nil {
+				return err
+			}
+		} else {
+			for _, stmt := range splitStatements(sqlText) {
+				if err := tx.Exec(stmt).Error; err != nil {
+					return err
+				}
+			}
+		}
+		if up {
+			return tx.Table(m.table).Create(&record{Version: mig.Version, Name: mig.Name, AppliedAt: time.Now()}).Error
+		}
+		return tx.Table(m.table).Where("version = ?", mig.Version).Delete(&record{}).Error
+	})
+}
+
+/* 以行尾的";"分隔多個SQL */
+func splitStatements(sqlText string) []string {
+	stmts := make([]string, 0)
+	var sb strings.Builder
+	for _, line := range strings.Split(sqlText, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		sb.WriteString(line)
+		sb.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			if s := strings.TrimSpace(sb.String()); s != ";" {
+				stmts = append(stmts, s)
+			}
+			sb.Reset()
+		}
+	}
+	if s := strings.TrimSpace(sb.String()); s != "" {
+		stmts = append(stmts, s)
+	}
+	return stmts
+}
+
+/*
+	以資料庫的advisory lock確保只有一個程序執行遷移
+	mysql: GET_LOCK  postgres: pg_advisory_lock  其他: 不上鎖
+	鎖綁定在連線上 需使用同一條連線取得及釋放 fn的db使用同一條連線及主庫
+*/
+func (m *Migrator) withLock(ctx context.Context, fn func(db *gorm.DB) error) error {
+	if m.dryRun {
+		return fn(m.primary(ctx))
+	}
+	var lockSQL, unlockSQL string
+	var args []interface{}
+	switch m.db.Dialector.Name() {
+	case "mysql":
+		lockSQL, unlockSQL = "SELECT GET_LOCK(?, ?)", "SELECT RELEASE_LOCK(?)"
+		args = []interface{}{m.lockName, int(m.lockTimeout.Seconds())}
+	case "postgres":
+		h := fnv.New64a()
+		h.Write([]byte(m.lockName))
+		key := int64(h.Sum64())
+		// 直接使用連線執行 需使用postgres的placeholder
+		lockSQL, unlockSQL = "SELECT pg_advisory_lock($1)", "SELECT pg_advisory_unlock($1)"
+		args = []interface{}{key}
+	default:
+		return fn(m.primary(ctx))
+	}
+
+	sqlDB, err := m.db.DB()
+	if err != nil {
+		return err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if m.db.Dialector.Name() == "mysql" {
+		var got *int
+		if err := conn.QueryRowContext(ctx, lockSQL, args...).Scan(&got); err != nil {
+			return err
+		}
+		if got == nil || *got != 1 {
+			return errors.New("get migration lock timeout: " + m.lockName)
+		}
+		defer conn.ExecContext(context.Background(), unlockSQL, m.lockName)
+	} else {
+		if _, err := conn.ExecContext(ctx, lockSQL, args...); err != nil {
+			return err
+		}
+		defer conn.ExecContext(context.Background(), unlockSQL, args...)
+	}
+	db := m.primary(ctx)
+	db.Statement.ConnPool = conn
+	return fn(db)
+}
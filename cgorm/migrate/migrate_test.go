@@ -0,0 +1,169 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/rickylin614/common/cgorm"
+	"gorm.io/gorm"
+)
+
+var testFS = fstest.MapFS{
+	"migrations/0001_create_user.up.sql":   {Data: []byte("CREATE TABLE user (id INTEGER PRIMARY KEY, name TEXT);\n-- comment\nCREATE INDEX idx_user_name ON user (name);\n")},
+	"migrations/0001_create_user.down.sql": {Data: []byte("DROP TABLE user;")},
+	"migrations/0002_create_role.up.sql":   {Data: []byte("CREATE TABLE role (id INTEGER PRIMARY KEY, user_id INTEGER);")},
+	"migrations/0002_create_role.down.sql": {Data: []byte("DROP TABLE role;")},
+	"migrations/README.md":                 {Data: []byte("ignored")},
+}
+
+func TestLoadFS(t *testing.T) {
+	ms, err := LoadFS(testFS, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ms) != 2 || ms[0].Version != 1 || ms[1].Name != "create_role" || ms[0].Down == "" {
+		t.Fatalf("unexpected migrations: %+v", ms)
+	}
+	if stmts := splitStatements(ms[0].Up); len(stmts) != 2 {
+		t.Fatalf("want 2 statements, got %v", stmts)
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	if err := cgorm.NewMemoryDb("migrate"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	ms, _ := LoadFS(testFS, "migrations")
+	ms = append(ms, Migration{
+		Version: 3,
+		Name:    "seed",
+		UpFunc: func(tx *gorm.DB) error {
+			return tx.Exec("INSERT INTO role (id, user_id) VALUES (1, 1)").Error
+		},
+		DownFunc: func(tx *gorm.DB) error {
+			return tx.Exec("DELETE FROM role").Error
+		},
+	})
+	db := cgorm.GetDB("migrate")
+	applied := func() int {
+		list, err := ForSource("migrate", ms).Status(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, s := range list {
+			if s.Applied {
+				n++
+			}
+		}
+		return n
+	}
+
+	if err := ForSource("migrate", ms, WithDryRun()).Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if db.Migrator().HasTable("user") || db.Migrator().HasTable(DefaultTable) {
+		t.Fatal("dry run should not change schema")
+	}
+
+	if err := ForSource("migrate", ms).Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := applied(); n != 3 {
+		t.Fatalf("want 3 applied, got %d", n)
+	}
+	var count int64
+	db.Table("role").Count(&count)
+	if count != 1 {
+		t.Fatalf("seed not applied, count %d", count)
+	}
+
+	// 重複執行不會再次套用
+	if err := ForSource("migrate", ms).Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ForSource("migrate", ms).Down(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if n := applied(); n != 1 {
+		t.Fatalf("want 1 applied, got %d", n)
+	}
+	if db.Migrator().HasTable("role") {
+		t.Fatal("table role should be dropped")
+	}
+
+	// 失敗的版本不記錄
+	bad := append(ms[:1:1], Migration{Version: 2, Name: "bad", Up: "INSERT INTO nothing VALUES (1);"})
+	if err := ForSource("migrate", bad).Up(ctx); err == nil {
+		t.Fatal("want error")
+	}
+	if n := applied(); n != 1 {
+		t.Fatalf("want 1 applied, got %d", n)
+	}
+}
+
+func TestMigrator_MysqlLock(t *testing.T) {
+	db, mock := cgorm.GetMock()
+	m := New(db, nil, WithLock("app", 5*time.Second))
+
+	mock.ExpectQuery("SELECT GET_LOCK").WithArgs("app", 5).WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(1))
+	mock.ExpectExec("SELECT RELEASE_LOCK").WithArgs("app").WillReturnResult(sqlmock.NewResult(0, 0))
+	called := false
+	if err := m.withLock(context.Background(), func(db *gorm.DB) error {
+		called = true
+		if _, ok := db.Statement.ConnPool.(*sql.Conn); !ok {
+			t.Errorf("db should use the locked connection, got %T", db.Statement.ConnPool)
+		}
+		return nil
+	}); err != nil || !called {
+		t.Fatal(err, called)
+	}
+
+	mock.ExpectQuery("SELECT GET_LOCK").WithArgs("app", 5).WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(0))
+	if err := m.withLock(context.Background(), func(db *gorm.DB) error {
+		t.Fatal("should not run without lock")
+		return nil
+	}); err == nil {
+		t.Fatal("want lock timeout error")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrator_ReadsPrimary(t *testing.T) {
+	if err := cgorm.NewMemoryDb("migrate_primary"); err != nil {
+		t.Fatal(err)
+	}
+	db := cgorm.GetDB("migrate_primary")
+	// 模擬讀寫分離 記錄沒有UsePrimary的查詢
+	var replicaReads []string
+	check := func(tx *gorm.DB) {
+		if _, ok := tx.Statement.Clauses["cgorm:use_primary"]; !ok {
+			replicaReads = append(replicaReads, tx.Statement.SQL.String())
+		}
+	}
+	db.Callback().Query().Before("gorm:query").Register("test:replica", check)
+	db.Callback().Row().Before("gorm:row").Register("test:replica", check)
+
+	ms, _ := LoadFS(testFS, "migrations")
+	m := ForSource("migrate_primary", ms)
+	if err := m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Status(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(replicaReads) > 0 {
+		t.Fatalf("migration reads should use the primary: %v", replicaReads)
+	}
+}
@@ -0,0 +1,229 @@
+package cgorm
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rickylin614/common/zlog"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	replicaPluginName = "cgorm:replicas"
+	usePrimaryName    = "cgorm:use_primary"
+)
+
+/*
+	強制讀取走主庫 例: 剛寫入後需立即讀取最新資料
+	cgorm.GetDB().Clauses(cgorm.UsePrimary).Find(&list)
+*/
+var UsePrimary clause.Interface = usePrimary{}
+
+type usePrimary struct{}
+
+func (usePrimary) Name() string                 { return usePrimaryName }
+func (usePrimary) Build(clause.Builder)         {}
+func (usePrimary) MergeClause(c *clause.Clause) { c.Expression = usePrimary{} }
+
+// 副本選擇策略
+const (
+	PolicyRandom     = "random"
+	PolicyRoundRobin = "roundrobin"
+)
+
+// 單一讀取副本 未設定的欄位沿用主庫設定
+type ReplicaConfig struct {
+	Host string `yaml:"host"`
+	User string `yaml:"user"`
+	Pwd  string `yaml:"pwd"`
+}
+
+type replica struct {
+	host    string
+	db      *sql.DB
+	healthy int32
+}
+
+func (r *replica) isHealthy() bool {
+	return atomic.LoadInt32(&r.healthy) == 1
+}
+
+/* 更新健康狀態 狀態改變時記錄log */
+func (r *replica) setHealthy(ok bool) {
+	var v int32
+	if ok {
+		v = 1
+	}
+	if old := atomic.SwapInt32(&r.healthy, v); old != v {
+		if ok {
+			zlog.Info("mysql replica recovered:", r.host)
+		} else {
+			zlog.Warn("mysql replica ejected:", r.host)
+		}
+	}
+}
+
+/*
+	讀寫分離plugin
+	非交易中的查詢分配到健康的副本 寫入、交易、FOR UPDATE及UsePrimary維持在主庫
+	所有副本都不健康時讀取回到主庫
+*/
+type replicaSet struct {
+	replicas []*replica
+	policy   string
+	counter  uint64
+	stop     chan struct{}
+	once     sync.Once
+}
+
+func newReplicaSet(replicas []*replica, policy string, interval time.Duration) *replicaSet {
+	rs := &replicaSet{
+		replicas: replicas,
+		policy:   policy,
+		stop:     make(chan struct{}),
+	}
+	for _, r := range replicas {
+		r.healthy = 1
+	}
+	if interval > 0 {
+		go rs.healthCheck(interval)
+	}
+	return rs
+}
+
+/*
+	依主庫設定開啟所有副本 副本只作為連線池使用 不建立gorm.DB及plugin
+	無法連線的副本先剔除 由健康檢查恢復
+*/
+func openReplicas(conf Config) (*replicaSet, error) {
+	replicas := make([]*replica, 0, len(conf.Replicas))
+	for _, rc := range conf.Replicas {
+		rconf := conf
+		rconf.Host = rc.Host
+		if rc.User != "" {
+			rconf.User = rc.User
+		}
+		if rc.Pwd != "" {
+			rconf.Pwd = rc.Pwd
+		}
+		sqlDB, err := rconf.openPool()
+		if err != nil {
+			for _, r := range replicas {
+				r.db.Close()
+			}
+			return nil, err
+		}
+		replicas = append(replicas, &replica{host: rc.Host, db: sqlDB})
+	}
+	rs := newReplicaSet(replicas, conf.ReplicaPolicy, conf.HealthCheckInterval)
+	rs.check(conf.HealthCheckInterval)
+	return rs, nil
+}
+
+func (rs *replicaSet) Name() string {
+	return replicaPluginName
+}
+
+func (rs *replicaSet) Initialize(db *gorm.DB) error {
+	if err := db.Callback().Query().Before("gorm:query").Register(replicaPluginName, rs.switchReplica); err != nil {
+		return err
+	}
+	return db.Callback().Row().Before("gorm:row").Register(replicaPluginName, rs.switchReplica)
+}
+
+func (rs *replicaSet) switchReplica(db *gorm.DB) {
+	stmt := db.Statement
+	if _, ok := stmt.ConnPool.(gorm.TxCommitter); ok {
+		return
+	}
+	if _, ok := stmt.Clauses[usePrimaryName]; ok {
+		return
+	}
+	if _, locking := stmt.Clauses["FOR"]; locking {
+		return
+	}
+	if rawSQL := strings.TrimSpace(stmt.SQL.String()); rawSQL != "" && !isReadSQL(rawSQL) {
+		return
+	}
+	if r := rs.pick(); r != nil {
+		stmt.ConnPool = r.db
+	}
+}
+
+// 需在主庫執行的鎖定讀取
+var lockingReads = []string{"for update", "for share", "for no key update", "for key share", "lock in share mode"}
+
+/* Raw SQL只有SELECT且沒有鎖定讀取時才走副本 */
+func isReadSQL(rawSQL string) bool {
+	lower := strings.ToLower(strings.Join(strings.Fields(rawSQL), " "))
+	if !strings.HasPrefix(lower, "select") {
+		return false
+	}
+	for _, lock := range lockingReads {
+		if strings.Contains(lower, lock) {
+			return false
+		}
+	}
+	return true
+}
+
+/* 依策略挑選健康的副本 沒有可用副本時回傳nil */
+func (rs *replicaSet) pick() *replica {
+	healthy := make([]*replica, 0, len(rs.replicas))
+	for _, r := range rs.replicas {
+		if r.isHealthy() {
+			healthy = append(healthy, r)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+	if rs.policy == PolicyRoundRobin {
+		n := atomic.AddUint64(&rs.counter, 1)
+		return healthy[(n-1)%uint64(len(healthy))]
+	}
+	return healthy[rand.Intn(len(healthy))]
+}
+
+func (rs *replicaSet) healthCheck(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rs.stop:
+			return
+		case <-ticker.C:
+			rs.check(interval)
+		}
+	}
+}
+
+/* ping所有副本並更新健康狀態 */
+func (rs *replicaSet) check(timeout time.Duration) {
+	for _, r := range rs.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := r.db.PingContext(ctx)
+		cancel()
+		r.setHealthy(err == nil)
+	}
+}
+
+/* 停止健康檢查並關閉所有副本連線 */
+func (rs *replicaSet) Close() error {
+	var err error
+	rs.once.Do(func() {
+		close(rs.stop)
+		for _, r := range rs.replicas {
+			if e := r.db.Close(); e != nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
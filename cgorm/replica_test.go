@@ -0,0 +1,147 @@
+package cgorm
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+func newReplicaTestDB(t *testing.T, policy string) (*gorm.DB, sqlmock.Sqlmock, []sqlmock.Sqlmock, *replicaSet) {
+	primary, mock, _ := sqlmock.New()
+	gormDB, err := gorm.Open(mysql.New(mysql.Config{
+		SkipInitializeWithVersion: true,
+		Conn:                      primary,
+	}), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replicas := make([]*replica, 0)
+	mocks := make([]sqlmock.Sqlmock, 0)
+	for _, host := range []string{"r1", "r2"} {
+		sqlDB, m, _ := sqlmock.New()
+		replicas = append(replicas, &replica{host: host, db: sqlDB})
+		mocks = append(mocks, m)
+	}
+	rs := newReplicaSet(replicas, policy, 0)
+	if err := gormDB.Use(rs); err != nil {
+		t.Fatal(err)
+	}
+	return gormDB, mock, mocks, rs
+}
+
+func TestReplicaSet_Route(t *testing.T) {
+	gormDB, primary, replicas, rs := newReplicaTestDB(t, PolicyRoundRobin)
+	defer rs.Close()
+
+	rows := func() *sqlmock.Rows { return sqlmock.NewRows([]string{"id", "name"}).AddRow(1, "a") }
+
+	// 讀取依round robin分配到副本
+	replicas[0].ExpectQuery("SELECT \\* FROM `demo`").WillReturnRows(rows())
+	replicas[1].ExpectQuery("SELECT \\* FROM `demo`").WillReturnRows(rows())
+	for i := 0; i < 2; i++ {
+		var list []Demo
+		if err := gormDB.Find(&list).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// UsePrimary及FOR UPDATE的Raw SQL走主庫
+	primary.ExpectQuery("SELECT \\* FROM `demo`").WillReturnRows(rows())
+	primary.ExpectQuery("SELECT \\* FROM demo FOR UPDATE").WillReturnRows(rows())
+	var list []Demo
+	if err := gormDB.Clauses(UsePrimary).Find(&list).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := gormDB.Raw("SELECT * FROM demo FOR UPDATE").Scan(&list).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// 寫入及交易中的讀取走主庫
+	primary.ExpectBegin()
+	primary.ExpectExec("INSERT INTO `demo`").WillReturnResult(sqlmock.NewResult(2, 1))
+	primary.ExpectQuery("SELECT \\* FROM `demo`").WillReturnRows(rows())
+	primary.ExpectCommit()
+	err := gormDB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&Demo{Name: "b"}).Error; err != nil {
+			return err
+		}
+		return tx.Find(&list).Error
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 副本全部不健康時回到主庫
+	for _, r := range rs.replicas {
+		r.setHealthy(false)
+	}
+	primary.ExpectQuery("SELECT \\* FROM `demo`").WillReturnRows(rows())
+	if err := gormDB.Find(&list).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, m := range append(replicas, primary) {
+		if err := m.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestOpenReplicas_Unreachable(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "missing")
+	conf := Config{
+		Dialect:             DialectSqlite,
+		Schema:              filepath.Join(dir, "replica.db"),
+		Replicas:            []ReplicaConfig{{Host: "r1"}},
+		HealthCheckInterval: time.Hour,
+	}.withDefault()
+	rs, err := openReplicas(conf)
+	if err != nil {
+		t.Fatalf("unreachable replica should not fail init: %v", err)
+	}
+	defer rs.Close()
+	if r := rs.pick(); r != nil {
+		t.Fatalf("unreachable replica should start ejected, got %s", r.host)
+	}
+
+	// 可以連線後由健康檢查恢復
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	rs.check(time.Second)
+	if rs.pick() != rs.replicas[0] {
+		t.Fatal("replica should recover after health check")
+	}
+}
+
+func TestIsReadSQL(t *testing.T) {
+	tests := []struct {
+		sql  string
+		read bool
+	}{
+		{"SELECT * FROM users", true},
+		{"SELECT * FROM users;", true},
+		{"  select 1  \n", true},
+		{"SELECT * FROM users WHERE id = 1 FOR UPDATE", false},
+		{"select * from users for update;\n", false},
+		{"SELECT * FROM users FOR UPDATE NOWAIT", false},
+		{"SELECT * FROM users FOR UPDATE SKIP LOCKED", false},
+		{"SELECT * FROM users FOR SHARE", false},
+		{"SELECT * FROM users FOR NO KEY UPDATE", false},
+		{"SELECT * FROM users LOCK IN SHARE MODE", false},
+		{"SELECT * FROM users FOR\n\tUPDATE", false},
+		{"UPDATE users SET name = 'a'", false},
+		{"INSERT INTO users (name) SELECT name FROM tmp", false},
+	}
+	for _, tt := range tests {
+		if got := isReadSQL(tt.sql); got != tt.read {
+			t.Errorf("isReadSQL(%q) = %v, want %v", tt.sql, got, tt.read)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package cgorm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/rickylin614/common/utils"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/schema"
+)
+
+// 分頁查詢時params中使用的key
+const (
+	ParamSort   = "sort"   // 排序 例: "-age,name" 前綴"-"為desc
+	ParamCursor = "cursor" // 有此key時改用keyset分頁 值為上一頁回傳的NextCursor 第一頁給空字串
+)
+
+// 分頁每頁最多筆數 超過時以此為準
+const MaxPageSize = 1000
+
+// 可被params使用的過濾條件
+type repoFilter struct {
+	param  string
+	column string
+	op     string
+}
+
+type repoOptions struct {
+	source  string
+	filters []repoFilter
+	sorts   map[string]string
+	key     string
+}
+
+type RepoOption func(*repoOptions)
+
+/* 指定連線源 未指定時為預設連線源 */
+func RepoSource(sourceName string) RepoOption {
+	return func(o *repoOptions) {
+		o.source = sourceName
+	}
+}
+
+/*
+	允許以params[param]過濾column
+	op: = != > >= < <= like in 例: RepoFilter("minAge", "age", ">=")
+*/
+func RepoFilter(param, column, op string) RepoOption {
+	return func(o *repoOptions) {
+		o.filters = append(o.filters, repoFilter{param: param, column: column, op: strings.ToLower(op)})
+	}
+}
+
+/* 允許以params["sort"]排序的欄位 param名稱即為欄位名稱 */
+func RepoSorts(columns ...string) RepoOption {
+	return func(o *repoOptions) {
+		for _, c := range columns {
+			o.sorts[c] = c
+		}
+	}
+}
+
+/* keyset分頁使用的欄位 需唯一且有索引 預設id */
+func RepoKey(column string) RepoOption {
+	return func(o *repoOptions) {
+		o.key = column
+	}
+}
+
+/*
+	通用CRUD及分頁查詢
+	連線以GetDBWithContext取得 在WithTx中呼叫時會加入同一個交易
+*/
+type Repository[T any] struct {
+	opts repoOptions
+}
+
+type PageResult[T any] struct {
+	Items      []T    `json:"items"`
+	Total      int64  `json:"total"` // keyset分頁時不計算 為-1
+	PageNo     int    `json:"pageNo"`
+	PageSize   int    `json:"pageSize"`
+	TotalPage  int    `json:"totalPage"`
+	NextCursor string `json:"nextCursor,omitempty"` // keyset分頁的下一頁cursor 沒有下一頁時為空
+}
+
+func NewRepository[T any](opts ...RepoOption) *Repository[T] {
+	o := repoOptions{
+		sorts:   make(map[string]string),
+		key:     "id",
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Repository[T]{opts: o}
+}
+
+func (r *Repository[T]) db(ctx context.Context) *gorm.DB {
+	if r.opts.source == "" {
+		return GetDBWithContext(ctx)
+	}
+	return GetDBWithContext(ctx, r.opts.source)
+}
+
+func (r *Repository[T]) Create(ctx context.Context, entity *T) error {
+	return r.db(ctx).Create(entity).Error
+}
+
+/* 依主鍵取得 查無資料時回傳gorm.ErrRecordNotFound */
+func (r *Repository[T]) Get(ctx context.Context, id interface{}) (*T, error) {
+	var entity T
+	if err := r.db(ctx).Where(primaryEq(id)).First(&entity).Error; err != nil {
+		return nil, err
+	}
+	return &entity, nil
+}
+
+/* 依主鍵更新所有欄位 */
+func (r *Repository[T]) Update(ctx context.Context, entity *T) error {
+	return r.db(ctx).Save(entity).Error
+}
+
+/* 依主鍵刪除 */
+func (r *Repository[T]) Delete(ctx context.Context, id interface{}) error {
+	var entity T
+	return r.db(ctx).Where(primaryEq(id)).Delete(&entity).Error
+}
+
+/* 主鍵條件 id一律作為參數 避免字串被gorm視為SQL條件 */
+func primaryEq(id interface{}) clause.Eq {
+	return clause.Eq{Column: clause.PrimaryColumn, Value: id}
+}
+
+/* 依params的過濾及排序條件取得所有資料 */
+func (r *Repository[T]) List(ctx context.Context, params map[string]interface{}) ([]T, error) {
+	tx, err := r.query(r.db(ctx), params)
+	if err != nil {
+		return nil, err
+	}
+	if tx, err = r.order(tx, params); err != nil {
+		return nil, err
+	}
+	list := make([]T, 0)
+	err = tx.Find(&list).Error
+	return list, err
+}
+
+/*
+	分頁查詢 頁碼以utils.GetPage取得
+	params有cursor時改用keyset分頁 不計算總數
+*/
+func (r *Repository[T]) Page(ctx context.Context, params map[string]interface{}) (*PageResult[T], error) {
+	pageNo, pageSize := utils.GetPage(params)
+	if pageNo < 1 {
+		pageNo = 1
+	}
+	if pageSize < 1 {
+		pageSize = 20
+	}
+	if pageSize > MaxPageSize {
+		pageSize = MaxPageSize
+	}
+	res := &PageResult[T]{Items: make([]T, 0), PageNo: pageNo, PageSize: pageSize}
+
+	tx, err := r.query(r.db(ctx), params)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := params[ParamCursor]; ok {
+		return r.keysetPage(tx, params, res)
+	}
+
+	// count與查詢各自組合條件 避免共用同一個statement
+	countTx, _ := r.query(r.db(ctx), params)
+	if err = countTx.Count(&res.Total).Error; err != nil {
+		return nil, err
+	}
+	res.TotalPage = int((res.Total + int64(pageSize) - 1) / int64(pageSize))
+	if res.Total == 0 {
+		return res, nil
+	}
+	if tx, err = r.order(tx, params); err != nil {
+		return nil, err
+	}
+	err = tx.Offset((pageNo - 1) * pageSize).Limit(pageSize).Find(&res.Items).Error
+	return res, err
+}
+
+/* 以key欄位大於(desc時小於)cursor取得下一頁 多取一筆判斷是否有下一頁 */
+func (r *Repository[T]) keysetPage(tx *gorm.DB, params map[string]interface{}, res *PageResult[T]) (*PageResult[T], error) {
+	res.Total = -1
+	field, err := r.keyField(tx)
+	if err != nil {
+		return nil, err
+	}
+	desc := params[ParamSort] == "-"+r.opts.key
+	if cursor := utils.ToStr(params[ParamCursor]); cursor != "" {
+		v, err := cursorValue(field, cursor)
+		if err != nil {
+			return nil, err
+		}
+		op := ">"
+		if desc {
+			op = "<"
+		}
+		tx = tx.Where(clause.Expr{SQL: "? " + op + " ?", Vars: []interface{}{clause.Column{Name: field.DBName}, v}})
+	}
+	tx = tx.Order(clause.OrderByColumn{Column: clause.Column{Name: field.DBName}, Desc: desc})
+	if err := tx.Limit(res.PageSize + 1).Find(&res.Items).Error; err != nil {
+		return nil, err
+	}
+	if len(res.Items) > res.PageSize {
+		res.Items = res.Items[:res.PageSize]
+		v, _ := field.ValueOf(reflect.ValueOf(&res.Items[res.PageSize-1]).Elem())
+		res.NextCursor = fmt.Sprint(v)
+	}
+	return res, nil
+}
+
+/* 取得keyset分頁使用的欄位 */
+func (r *Repository[T]) keyField(tx *gorm.DB) (*schema.Field, error) {
+	var entity T
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(&entity); err != nil {
+		return nil, err
+	}
+	field := stmt.Schema.LookUpField(r.opts.key)
+	if field == nil {
+		return nil, errors.New("repository key field not found: " + r.opts.key)
+	}
+	return field, nil
+}
+
+/* cursor依欄位型別轉換 避免數字欄位與字串比較 */
+func cursorValue(field *schema.Field, cursor string) (interface{}, error) {
+	switch field.DataType {
+	case schema.Int, schema.Uint:
+		return utils.ToInt64(cursor)
+	case schema.Float:
+		return utils.ToFloat64(cursor)
+	default:
+		return cursor, nil
+	}
+}
+
+/* 只接受白名單內的過濾條件 */
+func (r *Repository[T]) query(tx *gorm.DB, params map[string]interface{}) (*gorm.DB, error) {
+	var entity T
+	tx = tx.Model(&entity)
+	for _, f := range r.opts.filters {
+		v, ok := params[f.param]
+		if !ok || v == nil || v == "" {
+			continue
+		}
+		col := clause.Column{Name: f.column}
+		switch f.op {
+		case "=", "!=", ">", ">=", "<", "<=":
+			tx = tx.Where(clause.Expr{SQL: "? " + f.op + " ?", Vars: []interface{}{col, v}})
+		case "like":
+			tx = tx.Where(clause.Expr{SQL: "? LIKE ?", Vars: []interface{}{col, "%" + utils.ToStr(v) + "%"}})
+		case "in":
+			if reflect.ValueOf(v).Kind() != reflect.Slice {
+				return nil, fmt.Errorf("filter %s must be an array", f.param)
+			}
+			tx = tx.Where(clause.IN{Column: col, Values: toValues(v)})
+		default:
+			return nil, fmt.Errorf("unsupported filter operator: %s", f.op)
+		}
+	}
+	return tx, nil
+}
+
+/* 只接受白名單內的排序欄位 */
+func (r *Repository[T]) order(tx *gorm.DB, params map[string]interface{}) (*gorm.DB, error) {
+	sort, _ := params[ParamSort].(string)
+	if sort == "" {
+		return tx, nil
+	}
+	for _, s := range strings.Split(sort, ",") {
+		s = strings.TrimSpace(s)
+		desc := strings.HasPrefix(s, "-")
+		column, ok := r.opts.sorts[strings.TrimPrefix(s, "-")]
+		if !ok {
+			return nil, fmt.Errorf("unsupported sort field: %s", s)
+		}
+		tx = tx.Order(clause.OrderByColumn{Column: clause.Column{Name: column}, Desc: desc})
+	}
+	return tx, nil
+}
+
+func toValues(v interface{}) []interface{} {
+	rv := reflect.ValueOf(v)
+	values := make([]interface{}, rv.Len())
+	for i := range values {
+		values[i] = rv.Index(i).Interface()
+	}
+	return values
+}
@@ -0,0 +1,121 @@
+package cgorm
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func newTestRepo(t *testing.T) *Repository[Demo] {
+	if err := NewMemoryDb("repo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := GetDB("repo").AutoMigrate(&Demo{}); err != nil {
+		t.Fatal(err)
+	}
+	repo := NewRepository[Demo](
+		RepoSource("repo"),
+		RepoFilter("name", "name", "like"),
+		RepoFilter("minAge", "age", ">="),
+		RepoFilter("ids", "id", "in"),
+		RepoSorts("age", "name"),
+	)
+	ctx := context.Background()
+	for i := 1; i <= 5; i++ {
+		if err := repo.Create(ctx, &Demo{Name: "user" + string(rune('0'+i)), Age: 10 * i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return repo
+}
+
+func TestRepository_CRUD(t *testing.T) {
+	repo := newTestRepo(t)
+	ctx := context.Background()
+
+	d, err := repo.Get(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Phone = "0912"
+	if err := repo.Update(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ = repo.Get(ctx, 2); d.Phone != "0912" {
+		t.Errorf("Phone = %s, want 0912", d.Phone)
+	}
+	// 字串id作為參數 不可被當成SQL條件
+	if _, err := repo.Get(ctx, "1 OR 1=1"); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Get() with injected id err = %v", err)
+	}
+	if err := repo.Delete(ctx, "1 OR 1=1"); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := repo.Get(ctx, "3"); err != nil || d.Id != 3 {
+		t.Fatalf("Get() with string id = %+v, %v", d, err)
+	}
+	if err := repo.Delete(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Get(ctx, 2); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Get() after delete err = %v", err)
+	}
+
+	list, err := repo.List(ctx, map[string]interface{}{"minAge": float64(30), "sort": "-age"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[0].Age != 50 {
+		t.Errorf("List() = %+v", list)
+	}
+	if _, err := repo.List(ctx, map[string]interface{}{"sort": "phone"}); err == nil {
+		t.Error("List() expected error for sort field not in whitelist")
+	}
+}
+
+func TestRepository_Page(t *testing.T) {
+	repo := newTestRepo(t)
+	ctx := context.Background()
+
+	res, err := repo.Page(ctx, map[string]interface{}{"pageNo": float64(2), "pageSize": float64(2), "sort": "age", "name": "user"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Total != 5 || res.TotalPage != 3 || len(res.Items) != 2 || res.Items[0].Age != 30 {
+		t.Errorf("Page() = %+v", res)
+	}
+
+	if res, _ = repo.Page(ctx, map[string]interface{}{"pageSize": float64(100000)}); res.PageSize != MaxPageSize {
+		t.Errorf("Page() pageSize = %d, want %d", res.PageSize, MaxPageSize)
+	}
+
+	res, err = repo.Page(ctx, map[string]interface{}{"ids": []interface{}{float64(1), float64(3)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Total != 2 {
+		t.Errorf("Page() with in filter total = %d, want 2", res.Total)
+	}
+
+	// keyset分頁 依序取完所有資料
+	params := map[string]interface{}{"pageSize": float64(2), "cursor": ""}
+	ids := make([]int64, 0)
+	for i := 0; i < 5; i++ {
+		res, err := repo.Page(ctx, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range res.Items {
+			ids = append(ids, d.Id)
+		}
+		if res.NextCursor == "" {
+			break
+		}
+		params["cursor"] = res.NextCursor
+	}
+	if len(ids) != 5 || ids[4] != 5 {
+		t.Errorf("keyset ids = %v", ids)
+	}
+}
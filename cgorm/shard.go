@@ -0,0 +1,303 @@
+package cgorm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+var ErrShardNotFound = errors.New("shard not found")
+
+/*
+	分片位置 Source為InitDB註冊的連線源名稱 空字串為預設連線源
+	Suffix為資料表後綴 例: "_3"
+*/
+type Shard struct {
+	Source string
+	Suffix string
+}
+
+/* 加上後綴的資料表名稱 例: Table("user") => "user_3" */
+func (s Shard) Table(name string) string {
+	return name + s.Suffix
+}
+
+/* 分片策略 依分片鍵(例: user id)取得分片位置 */
+type ShardStrategy interface {
+	Locate(key int64) (Shard, error)
+	// 所有分片 供跨分片查詢使用
+	Shards() []Shard
+}
+
+var (
+	shardLock     sync.RWMutex
+	shardStrategy ShardStrategy
+)
+
+/* 設定分片策略 */
+func SetShardStrategy(s ShardStrategy) {
+	shardLock.Lock()
+	defer shardLock.Unlock()
+	shardStrategy = s
+}
+
+func getShardStrategy() (ShardStrategy, error) {
+	shardLock.RLock()
+	defer shardLock.RUnlock()
+	if shardStrategy == nil {
+		return nil, errors.New("shard strategy not set")
+	}
+	return shardStrategy, nil
+}
+
+/*
+	依分片鍵取得連線及資料表後綴
+	db, shard, err := cgorm.ShardDB(userId)
+	db.Table(shard.Table("user")).Find(&list)
+*/
+func ShardDB(key int64) (*gorm.DB, Shard, error) {
+	s, err := getShardStrategy()
+	if err != nil {
+		return nil, Shard{}, err
+	}
+	shard, err := s.Locate(key)
+	if err != nil {
+		return nil, Shard{}, err
+	}
+	db, err := shardSourceDB(shard.Source)
+	if err != nil {
+		return nil, Shard{}, err
+	}
+	return db, shard, nil
+}
+
+/* 連線源未註冊時回傳ErrShardNotFound 不使用GetDB避免panic */
+func shardSourceDB(source string) (*gorm.DB, error) {
+	lock.RLock()
+	defer lock.RUnlock()
+	gormdb := db
+	if source != "" {
+		gormdb = dbs[source]
+	}
+	if gormdb == nil {
+		return nil, fmt.Errorf("%w: source %q not registered", ErrShardNotFound, source)
+	}
+	return gormdb, nil
+}
+
+/*
+	跨分片查詢 對每個分片並行執行fn 任一分片錯誤時回傳第一個錯誤並取消其他分片的ctx
+	fn中的db已帶入ctx
+*/
+func ShardScatter(ctx context.Context, fn func(ctx context.Context, db *gorm.DB, shard Shard) error) error {
+	s, err := getShardStrategy()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var once sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+	for _, shard := range s.Shards() {
+		wg.Add(1)
+		go func(shard Shard) {
+			defer wg.Done()
+			db, err := shardSourceDB(shard.Source)
+			if err == nil {
+				err = fn(ctx, db.WithContext(ctx), shard)
+			}
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(shard)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+/*
+	跨分片查詢並合併結果 結果順序依分片順序
+	users, err := cgorm.ShardGather(ctx, func(ctx context.Context, db *gorm.DB, shard cgorm.Shard) ([]User, error) {
+		var list []User
+		err := db.Table(shard.Table("user")).Where("status = ?", 1).Find(&list).Error
+		return list, err
+	})
+*/
+func ShardGather[T any](ctx context.Context, fn func(ctx context.Context, db *gorm.DB, shard Shard) ([]T, error)) ([]T, error) {
+	s, err := getShardStrategy()
+	if err != nil {
+		return nil, err
+	}
+	shards := s.Shards()
+	results := make([][]T, len(shards))
+	index := make(map[Shard]int, len(shards))
+	for i, shard := range shards {
+		index[shard] = i
+	}
+	var lock sync.Mutex
+	err = ShardScatter(ctx, func(ctx context.Context, db *gorm.DB, shard Shard) error {
+		list, err := fn(ctx, db, shard)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		results[index[shard]] = list
+		lock.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	all := make([]T, 0)
+	for _, list := range results {
+		all = append(all, list...)
+	}
+	return all, nil
+}
+
+/*
+	取模分片 key % (連線源數*每個連線源的表數)
+	例: 2個連線源各2張表 key=5 => 第1張表(5%4) 位於sources[0] 後綴"_1"
+*/
+type ModStrategy struct {
+	sources         []string
+	tablesPerSource int
+}
+
+/* tablesPerSource<=1時不分表 後綴為空字串 */
+func NewModStrategy(sources []string, tablesPerSource int) *ModStrategy {
+	if tablesPerSource < 1 {
+		tablesPerSource = 1
+	}
+	return &ModStrategy{sources: sources, tablesPerSource: tablesPerSource}
+}
+
+func (m *ModStrategy) Locate(key int64) (Shard, error) {
+	total := int64(len(m.sources) * m.tablesPerSource)
+	if total == 0 {
+		return Shard{}, ErrShardNotFound
+	}
+	idx := key % total
+	if idx < 0 {
+		idx += total
+	}
+	return m.shard(int(idx)), nil
+}
+
+func (m *ModStrategy) Shards() []Shard {
+	shards := make([]Shard, 0, len(m.sources)*m.tablesPerSource)
+	for i := 0; i < len(m.sources)*m.tablesPerSource; i++ {
+		shards = append(shards, m.shard(i))
+	}
+	return shards
+}
+
+func (m *ModStrategy) shard(idx int) Shard {
+	shard := Shard{Source: m.sources[idx/m.tablesPerSource]}
+	if m.tablesPerSource > 1 {
+		shard.Suffix = "_" + strconv.Itoa(idx)
+	}
+	return shard
+}
+
+// 範圍分片的單一區間 包含Min 不包含Max
+type ShardRange struct {
+	Min   int64
+	Max   int64
+	Shard Shard
+}
+
+/* 範圍分片 例: id 0~1000萬在source1 1000萬~2000萬在source2 */
+type RangeStrategy struct {
+	ranges []ShardRange
+}
+
+func NewRangeStrategy(ranges ...ShardRange) *RangeStrategy {
+	sorted := append([]ShardRange{}, ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Min < sorted[j].Min })
+	return &RangeStrategy{ranges: sorted}
+}
+
+func (r *RangeStrategy) Locate(key int64) (Shard, error) {
+	i := sort.Search(len(r.ranges), func(i int) bool { return r.ranges[i].Max > key })
+	if i < len(r.ranges) && r.ranges[i].Min <= key {
+		return r.ranges[i].Shard, nil
+	}
+	return Shard{}, fmt.Errorf("%w: key %d", ErrShardNotFound, key)
+}
+
+func (r *RangeStrategy) Shards() []Shard {
+	return uniqueShards(len(r.ranges), func(i int) Shard { return r.ranges[i].Shard })
+}
+
+/*
+	一致性雜湊分片 增減分片時只有少部分key需要搬移
+	replicas為每個分片的虛擬節點數 預設100
+*/
+type HashStrategy struct {
+	shards []Shard
+	ring   []uint32
+	nodes  map[uint32]Shard
+}
+
+func NewHashStrategy(shards []Shard, replicas int) *HashStrategy {
+	if replicas <= 0 {
+		replicas = 100
+	}
+	h := &HashStrategy{
+		shards: shards,
+		nodes:  make(map[uint32]Shard, len(shards)*replicas),
+	}
+	for _, shard := range shards {
+		for i := 0; i < replicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(shard.Source + "#" + shard.Suffix + "#" + strconv.Itoa(i)))
+			if _, ok := h.nodes[hash]; ok {
+				continue
+			}
+			h.nodes[hash] = shard
+			h.ring = append(h.ring, hash)
+		}
+	}
+	sort.Slice(h.ring, func(i, j int) bool { return h.ring[i] < h.ring[j] })
+	return h
+}
+
+func (h *HashStrategy) Locate(key int64) (Shard, error) {
+	if len(h.ring) == 0 {
+		return Shard{}, ErrShardNotFound
+	}
+	hash := crc32.ChecksumIEEE([]byte(strconv.FormatInt(key, 10)))
+	i := sort.Search(len(h.ring), func(i int) bool { return h.ring[i] >= hash })
+	if i == len(h.ring) {
+		i = 0
+	}
+	return h.nodes[h.ring[i]], nil
+}
+
+func (h *HashStrategy) Shards() []Shard {
+	return uniqueShards(len(h.shards), func(i int) Shard { return h.shards[i] })
+}
+
+func uniqueShards(n int, get func(i int) Shard) []Shard {
+	shards := make([]Shard, 0, n)
+	seen := make(map[Shard]bool, n)
+	for i := 0; i < n; i++ {
+		shard := get(i)
+		if !seen[shard] {
+			seen[shard] = true
+			shards = append(shards, shard)
+		}
+	}
+	return shards
+}
@@ -0,0 +1,141 @@
+package cgorm
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func TestModStrategy(t *testing.T) {
+	s := NewModStrategy([]string{"s0", "s1"}, 2)
+	cases := map[int64]Shard{
+		0:  {Source: "s0", Suffix: "_0"},
+		1:  {Source: "s0", Suffix: "_1"},
+		2:  {Source: "s1", Suffix: "_2"},
+		7:  {Source: "s1", Suffix: "_3"},
+		-1: {Source: "s1", Suffix: "_3"},
+	}
+	for key, want := range cases {
+		if got, _ := s.Locate(key); got != want {
+			t.Errorf("key %d: want %+v, got %+v", key, want, got)
+		}
+	}
+	if n := len(s.Shards()); n != 4 {
+		t.Fatalf("want 4 shards, got %d", n)
+	}
+	if got, _ := NewModStrategy([]string{"s0", "s1"}, 0).Locate(3); got != (Shard{Source: "s1"}) {
+		t.Fatalf("unexpected shard %+v", got)
+	}
+}
+
+func TestRangeStrategy(t *testing.T) {
+	s := NewRangeStrategy(
+		ShardRange{Min: 100, Max: 200, Shard: Shard{Source: "s1"}},
+		ShardRange{Min: 0, Max: 100, Shard: Shard{Source: "s0"}},
+	)
+	if got, _ := s.Locate(99); got.Source != "s0" {
+		t.Fatalf("want s0, got %+v", got)
+	}
+	if got, _ := s.Locate(100); got.Source != "s1" {
+		t.Fatalf("want s1, got %+v", got)
+	}
+	if _, err := s.Locate(200); !errors.Is(err, ErrShardNotFound) {
+		t.Fatalf("want ErrShardNotFound, got %v", err)
+	}
+}
+
+func TestHashStrategy(t *testing.T) {
+	shards := []Shard{{Source: "s0"}, {Source: "s1"}, {Source: "s2"}}
+	s := NewHashStrategy(shards, 0)
+	count := make(map[Shard]int)
+	for key := int64(0); key < 3000; key++ {
+		shard, err := s.Locate(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count[shard]++
+	}
+	for _, shard := range shards {
+		if count[shard] < 500 {
+			t.Fatalf("unbalanced distribution: %v", count)
+		}
+	}
+
+	// 新增分片時 原本的key只會搬移到新分片
+	grown := NewHashStrategy(append(shards, Shard{Source: "s3"}), 0)
+	for key := int64(0); key < 3000; key++ {
+		before, _ := s.Locate(key)
+		after, _ := grown.Locate(key)
+		if before != after && after.Source != "s3" {
+			t.Fatalf("key %d moved from %v to %v", key, before, after)
+		}
+	}
+}
+
+func TestShardDB(t *testing.T) {
+	for _, source := range []string{"shard0", "shard1"} {
+		if err := NewMemoryDb(source); err != nil {
+			t.Fatal(err)
+		}
+		if err := GetDB(source).Table("demo_" + source[5:]).AutoMigrate(&Demo{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	SetShardStrategy(NewModStrategy([]string{"shard0", "shard1"}, 1))
+	defer SetShardStrategy(nil)
+
+	// 單表時以連線源區分 測試資料表依連線源命名
+	table := func(shard Shard) string {
+		return "demo_" + shard.Source[5:]
+	}
+	for id := int64(1); id <= 4; id++ {
+		db, shard, err := ShardDB(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Table(table(shard)).Create(&Demo{Id: id, Name: "u"}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	var n int64
+	GetDB("shard1").Table("demo_1").Count(&n)
+	if n != 2 {
+		t.Fatalf("want 2 rows in shard1, got %d", n)
+	}
+
+	list, err := ShardGather(context.Background(), func(ctx context.Context, db *gorm.DB, shard Shard) ([]Demo, error) {
+		var list []Demo
+		err := db.Table(table(shard)).Find(&list).Error
+		return list, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 4 || list[0].Id != 2 {
+		t.Fatalf("unexpected gather result: %+v", list)
+	}
+
+	wantErr := errors.New("fail")
+	err = ShardScatter(context.Background(), func(ctx context.Context, db *gorm.DB, shard Shard) error {
+		if shard.Source == "shard1" {
+			return wantErr
+		}
+		return nil
+	})
+	if err != wantErr {
+		t.Fatalf("want %v, got %v", wantErr, err)
+	}
+
+	SetShardStrategy(NewModStrategy([]string{"shard0", "shard_missing"}, 1))
+	if _, _, err := ShardDB(1); !errors.Is(err, ErrShardNotFound) {
+		t.Fatalf("unregistered source: want ErrShardNotFound, got %v", err)
+	}
+	err = ShardScatter(context.Background(), func(ctx context.Context, db *gorm.DB, shard Shard) error {
+		return nil
+	})
+	if !errors.Is(err, ErrShardNotFound) {
+		t.Fatalf("scatter unregistered source: want ErrShardNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,238 @@
+package cgorm
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	gomysql "github.com/go-sql-driver/mysql"
+	"gorm.io/gorm"
+)
+
+// mysql可重試的錯誤碼
+const (
+	errLockWaitTimeout = 1205 // Lock wait timeout exceeded
+	errDeadlock        = 1213 // Deadlock found when trying to get lock
+)
+
+type txKey struct {
+	source string
+}
+
+// context中保存的交易 depth為savepoint的層數
+type txState struct {
+	tx    *gorm.DB
+	depth int
+	hooks *commitHooks
+}
+
+// ctx所在的所有WithTx交易 由外而內
+type openTxKey struct{}
+
+// 最外層交易commit後執行 rollback時捨棄
+type commitHooks struct {
+	lock sync.Mutex
+	fns  []func()
+}
+
+func (h *commitHooks) add(fn func()) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.fns = append(h.fns, fn)
+}
+
+func (h *commitHooks) len() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return len(h.fns)
+}
+
+/* savepoint rollback時捨棄其中加入的hook */
+func (h *commitHooks) truncate(n int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if n < len(h.fns) {
+		h.fns = h.fns[:n]
+	}
+}
+
+func (h *commitHooks) run() {
+	h.lock.Lock()
+	fns := h.fns
+	h.fns = nil
+	h.lock.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+func withOpenTx(ctx context.Context, state *txState) context.Context {
+	list, _ := ctx.Value(openTxKey{}).([]*txState)
+	return context.WithValue(ctx, openTxKey{}, append(append([]*txState{}, list...), state))
+}
+
+/*
+	交易commit後執行fn
+	db在WithTx的交易中時 等最外層交易commit後執行 rollback時不執行
+	db不在交易中時直接執行 以db.Transaction/Begin自行開啟的交易無法得知commit時機 也直接執行
+*/
+func afterCommit(db *gorm.DB, fn func()) {
+	if _, inTx := db.Statement.ConnPool.(gorm.TxCommitter); !inTx || db.Statement.Context == nil {
+		fn()
+		return
+	}
+	list, _ := db.Statement.Context.Value(openTxKey{}).([]*txState)
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i].tx.Statement.ConnPool == db.Statement.ConnPool {
+			list[i].hooks.add(fn)
+			return
+		}
+	}
+	fn()
+}
+
+type txOptions struct {
+	source  string
+	retries int
+	backoff time.Duration
+	sqlOpts *sql.TxOptions
+}
+
+type TxOption func(*txOptions)
+
+/* 指定連線源 未指定時為預設連線源 */
+func TxSource(sourceName string) TxOption {
+	return func(o *txOptions) {
+		o.source = sourceName
+	}
+}
+
+/* deadlock/lock wait timeout時的重試次數及初始等待時間 預設3次/50ms 每次重試等待加倍 */
+func TxRetry(retries int, backoff time.Duration) TxOption {
+	return func(o *txOptions) {
+		o.retries = retries
+		o.backoff = backoff
+	}
+}
+
+/* 交易隔離等級等設定 */
+func TxSqlOptions(opts *sql.TxOptions) TxOption {
+	return func(o *txOptions) {
+		o.sqlOpts = opts
+	}
+}
+
+/*
+	在交易中執行fn fn回傳nil時commit 回傳錯誤或panic時rollback
+	交易保存在ctx中 fn內以GetDBWithContext(ctx)取得的連線會加入同一個交易
+	ctx已在同連線源的交易中時 以savepoint執行 失敗只rollback到savepoint
+	最外層交易遇到deadlock(1213)/lock wait timeout(1205)時自動重試
+*/
+func WithTx(ctx context.Context, fn func(ctx context.Context, tx *gorm.DB) error, opts ...TxOption) error {
+	o := &txOptions{retries: 3, backoff: 50 * time.Millisecond}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if state, ok := ctx.Value(txKey{o.source}).(*txState); ok {
+		return runSavePoint(ctx, state, o, fn)
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := runTx(ctx, o, fn)
+		if err == nil || !IsRetryableErr(err) || attempt >= o.retries {
+			return err
+		}
+		wait := o.backoff << attempt
+		wait += time.Duration(rand.Int63n(int64(wait)/2 + 1))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+func runTx(ctx context.Context, o *txOptions, fn func(ctx context.Context, tx *gorm.DB) error) (err error) {
+	var base *gorm.DB
+	if o.source == "" {
+		base = GetDB()
+	} else {
+		base = GetDB(o.source)
+	}
+	// 交易的連線帶有交易資訊 callback中可取得 用於commit後執行的hook
+	state := &txState{hooks: &commitHooks{}}
+	ctx = withOpenTx(context.WithValue(ctx, txKey{o.source}, state), state)
+	tx := base.WithContext(ctx).Begin(o.sqlOpts)
+	if tx.Error != nil {
+		return tx.Error
+	}
+	state.tx = tx
+
+	panicked := true
+	defer func() {
+		if panicked || err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	err = fn(ctx, tx)
+	panicked = false
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit().Error; err != nil {
+		return err
+	}
+	state.hooks.run()
+	return nil
+}
+
+func runSavePoint(ctx context.Context, state *txState, o *txOptions, fn func(ctx context.Context, tx *gorm.DB) error) (err error) {
+	name := fmt.Sprintf("sp%d", state.depth+1)
+	if err = state.tx.SavePoint(name).Error; err != nil {
+		return err
+	}
+
+	hooks := state.hooks.len()
+	panicked := true
+	defer func() {
+		if panicked || err != nil {
+			state.tx.RollbackTo(name)
+			state.hooks.truncate(hooks)
+		}
+	}()
+
+	inner := &txState{tx: state.tx, depth: state.depth + 1, hooks: state.hooks}
+	err = fn(context.WithValue(ctx, txKey{o.source}, inner), state.tx)
+	panicked = false
+	return err
+}
+
+/*
+	取得連線 ctx在WithTx的交易中時回傳該交易
+	repository以此取得連線即可加入呼叫端的交易
+*/
+func GetDBWithContext(ctx context.Context, sourceName ...string) *gorm.DB {
+	source := ""
+	if len(sourceName) > 0 {
+		source = sourceName[0]
+	}
+	if state, ok := ctx.Value(txKey{source}).(*txState); ok {
+		return state.tx
+	}
+	return GetDB(sourceName...).WithContext(ctx)
+}
+
+/* mysql deadlock或lock wait timeout 可重試整個交易 */
+func IsRetryableErr(err error) bool {
+	var mysqlErr *gomysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == errDeadlock || mysqlErr.Number == errLockWaitTimeout
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package cgorm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	gomysql "github.com/go-sql-driver/mysql"
+	"gorm.io/gorm"
+)
+
+func TestWithTx(t *testing.T) {
+	mock := NewMockDb("tx")
+	ctx := context.Background()
+	insert := func(ctx context.Context, name string) error {
+		return GetDBWithContext(ctx, "tx").Create(&Demo{Name: name}).Error
+	}
+
+	t.Run("commit", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO `demo`").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+		err := WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+			return insert(ctx, "a")
+		}, TxSource("tx"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectRollback()
+		wantErr := errors.New("fail")
+		err := WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+			return wantErr
+		}, TxSource("tx"))
+		if err != wantErr {
+			t.Fatalf("err = %v, want %v", err, wantErr)
+		}
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectRollback()
+		defer func() {
+			if r := recover(); r == nil {
+				t.Error("expected panic")
+			}
+		}()
+		WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+			panic("boom")
+		}, TxSource("tx"))
+	})
+
+	t.Run("savepoint", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO `demo`").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("SAVEPOINT sp1").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO `demo`").WillReturnResult(sqlmock.NewResult(2, 1))
+		mock.ExpectExec("ROLLBACK TO SAVEPOINT sp1").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectCommit()
+		err := WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+			if err := insert(ctx, "outer"); err != nil {
+				return err
+			}
+			// 內層失敗只rollback到savepoint 外層仍commit
+			innerErr := WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+				if err := insert(ctx, "inner"); err != nil {
+					return err
+				}
+				return errors.New("inner fail")
+			}, TxSource("tx"))
+			if innerErr == nil {
+				t.Error("expected inner error")
+			}
+			return nil
+		}, TxSource("tx"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("retry deadlock", func(t *testing.T) {
+		deadlock := &gomysql.MySQLError{Number: 1213, Message: "Deadlock found"}
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO `demo`").WillReturnError(deadlock)
+		mock.ExpectRollback()
+		mock.ExpectBegin()
+		mock.ExpectExec("INSERT INTO `demo`").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectCommit()
+		calls := 0
+		err := WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+			calls++
+			return insert(ctx, "a")
+		}, TxSource("tx"), TxRetry(2, time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calls != 2 {
+			t.Errorf("calls = %d, want 2", calls)
+		}
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,382 @@
+package ckafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// 建立topic的設定
+type TopicSpec struct {
+	Name              string            `json:"name" yaml:"name"`
+	Partitions        int               `json:"partitions" yaml:"partitions"`               // 預設1
+	ReplicationFactor int               `json:"replicationFactor" yaml:"replicationFactor"` // 預設1
+	Configs           map[string]string `json:"configs" yaml:"configs"`                     // topic設定 例: retention.ms
+}
+
+type TopicInfo struct {
+	Name       string          `json:"name"`
+	Internal   bool            `json:"internal"`
+	Partitions []PartitionInfo `json:"partitions"`
+}
+
+type PartitionInfo struct {
+	Id       int   `json:"id"`
+	Leader   int   `json:"leader"`
+	Replicas []int `json:"replicas"`
+	Isr      []int `json:"isr"`
+}
+
+type GroupInfo struct {
+	Id      string        `json:"id"`
+	State   string        `json:"state"`
+	Members []GroupMember `json:"members"`
+}
+
+type GroupMember struct {
+	Id          string           `json:"id"`
+	ClientId    string           `json:"clientId"`
+	Host        string           `json:"host"`
+	Assignments map[string][]int `json:"assignments"` // topic => partitions
+}
+
+// consumer group在partition的落後量
+type PartitionLag struct {
+	Group     string `json:"group"`
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Committed int64  `json:"committed"` // -1為尚未commit
+	End       int64  `json:"end"`
+	Lag       int64  `json:"lag"` // 尚未commit時為partition中所有的訊息數
+}
+
+/* topic及consumer group管理 */
+type Admin struct {
+	client *kafka.Client
+}
+
+/* transport為nil時使用kafka.DefaultTransport SASL/TLS可用Manage.NewAdmin沿用SetConfig的設定 */
+func NewAdmin(brokers []string, transport kafka.RoundTripper) (*Admin, error) {
+	if len(brokers) == 0 {
+		return nil, errors.New("not setting kafka.brokers")
+	}
+	return &Admin{client: &kafka.Client{
+		Addr:      kafka.TCP(brokers...),
+		Timeout:   10 * time.Second,
+		Transport: transport,
+	}}, nil
+}
+
+/* 建立topic 回傳第一個失敗的topic錯誤 已存在時可用errors.Is(err, kafka.TopicAlreadyExists)判斷 */
+func (a *Admin) CreateTopics(ctx context.Context, specs ...TopicSpec) error {
+	topics := make([]kafka.TopicConfig, 0, len(specs))
+	for _, s := range specs {
+		if s.Partitions <= 0 {
+			s.Partitions = 1
+		}
+		if s.ReplicationFactor <= 0 {
+			s.ReplicationFactor = 1
+		}
+		entries := make([]kafka.ConfigEntry, 0, len(s.Configs))
+		for k, v := range s.Configs {
+			entries = append(entries, kafka.ConfigEntry{ConfigName: k, ConfigValue: v})
+		}
+		topics = append(topics, kafka.TopicConfig{
+			Topic:             s.Name,
+			NumPartitions:     s.Partitions,
+			ReplicationFactor: s.ReplicationFactor,
+			ConfigEntries:     entries,
+		})
+	}
+	res, err := a.client.CreateTopics(ctx, &kafka.CreateTopicsRequest{Topics: topics})
+	if err != nil {
+		return err
+	}
+	return topicErr("create", specNames(specs), res.Errors)
+}
+
+func (a *Admin) DeleteTopics(ctx context.Context, names ...string) error {
+	res, err := a.client.DeleteTopics(ctx, &kafka.DeleteTopicsRequest{Topics: names})
+	if err != nil {
+		return err
+	}
+	return topicErr("delete", names, res.Errors)
+}
+
+func specNames(specs []TopicSpec) []string {
+	names := make([]string, 0, len(specs))
+	for _, s := range specs {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+/* 依傳入順序回傳第一個錯誤 */
+func topicErr(action string, names []string, errs map[string]error) error {
+	for _, name := range names {
+		if err := errs[name]; err != nil {
+			return fmt.Errorf("%s topic %s: %w", action, name, err)
+		}
+	}
+	return nil
+}
+
+/* 取得topic及partition資訊 未指定時回傳所有topic 依名稱排序 */
+func (a *Admin) ListTopics(ctx context.Context, names ...string) ([]TopicInfo, error) {
+	res, err := a.client.Metadata(ctx, &kafka.MetadataRequest{Topics: names})
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]TopicInfo, 0, len(res.Topics))
+	for _, t := range res.Topics {
+		if t.Error != nil {
+			return nil, fmt.Errorf("describe topic %s: %w", t.Name, t.Error)
+		}
+		info := TopicInfo{Name: t.Name, Internal: t.Internal, Partitions: make([]PartitionInfo, 0, len(t.Partitions))}
+		for _, p := range t.Partitions {
+			info.Partitions = append(info.Partitions, PartitionInfo{
+				Id:       p.ID,
+				Leader:   p.Leader.ID,
+				Replicas: brokerIds(p.Replicas),
+				Isr:      brokerIds(p.Isr),
+			})
+		}
+		sort.Slice(info.Partitions, func(i, j int) bool { return info.Partitions[i].Id < info.Partitions[j].Id })
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos, nil
+}
+
+func brokerIds(brokers []kafka.Broker) []int {
+	ids := make([]int, 0, len(brokers))
+	for _, b := range brokers {
+		ids = append(ids, b.ID)
+	}
+	return ids
+}
+
+/* 所有consumer group的id */
+func (a *Admin) ListGroups(ctx context.Context) ([]string, error) {
+	res, err := a.client.ListGroups(ctx, &kafka.ListGroupsRequest{})
+	if err != nil {
+		return nil, err
+	}
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	ids := make([]string, 0, len(res.Groups))
+	for _, g := range res.Groups {
+		ids = append(ids, g.GroupID)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+/* consumer group的狀態及成員分配的partition */
+func (a *Admin) DescribeGroups(ctx context.Context, groupIds ...string) ([]GroupInfo, error) {
+	res, err := a.client.DescribeGroups(ctx, &kafka.DescribeGroupsRequest{GroupIDs: groupIds})
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]GroupInfo, 0, len(res.Groups))
+	for _, g := range res.Groups {
+		if g.Error != nil {
+			return nil, fmt.Errorf("describe group %s: %w", g.GroupID, g.Error)
+		}
+		info := GroupInfo{Id: g.GroupID, State: g.GroupState, Members: make([]GroupMember, 0, len(g.Members))}
+		for _, m := range g.Members {
+			member := GroupMember{Id: m.MemberID, ClientId: m.ClientID, Host: m.ClientHost, Assignments: make(map[string][]int)}
+			for _, t := range m.MemberAssignments.Topics {
+				member.Assignments[t.Topic] = t.Partitions
+			}
+			info.Members = append(info.Members, member)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+/*
+	consumer group在各partition的落後量
+	未指定topics時取group已commit過offset的topic及成員分配到的topic 所有consumer停止時仍可取得
+	kafka-go的OffsetFetch無法查詢group的所有topic 因此對所有非內部topic查詢後過濾
+*/
+func (a *Admin) Lag(ctx context.Context, groupId string, topics ...string) ([]PartitionLag, error) {
+	derive := len(topics) == 0
+	infos, err := a.ListTopics(ctx, topics...)
+	if err != nil {
+		return nil, err
+	}
+	partitions := make(map[string][]int)
+	for _, t := range infos {
+		if derive && t.Internal {
+			continue
+		}
+		for _, p := range t.Partitions {
+			partitions[t.Name] = append(partitions[t.Name], p.Id)
+		}
+	}
+	committed, err := a.client.OffsetFetch(ctx, &kafka.OffsetFetchRequest{GroupID: groupId, Topics: partitions})
+	if err != nil {
+		return nil, err
+	}
+	if committed.Error != nil {
+		return nil, committed.Error
+	}
+	if derive {
+		keep := committedTopics(committed.Topics)
+		groups, err := a.DescribeGroups(ctx, groupId)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			for _, m := range g.Members {
+				for t := range m.Assignments {
+					keep[t] = true
+				}
+			}
+		}
+		for t := range partitions {
+			if !keep[t] {
+				delete(partitions, t)
+				delete(committed.Topics, t)
+			}
+		}
+		if len(partitions) == 0 {
+			return []PartitionLag{}, nil
+		}
+	}
+
+	requests := make(map[string][]kafka.OffsetRequest)
+	for t, ps := range partitions {
+		for _, p := range ps {
+			requests[t] = append(requests[t], kafka.FirstOffsetOf(p), kafka.LastOffsetOf(p))
+		}
+	}
+	offsets, err := a.client.ListOffsets(ctx, &kafka.ListOffsetsRequest{Topics: requests})
+	if err != nil {
+		return nil, err
+	}
+	return computeLag(groupId, committed.Topics, offsets.Topics)
+}
+
+/* 有任一partition已commit的topic */
+func committedTopics(committed map[string][]kafka.OffsetFetchPartition) map[string]bool {
+	topics := make(map[string]bool)
+	for t, ps := range committed {
+		for _, p := range ps {
+			if p.Error == nil && p.CommittedOffset >= 0 {
+				topics[t] = true
+				break
+			}
+		}
+	}
+	return topics
+}
+
+func computeLag(groupId string, committed map[string][]kafka.OffsetFetchPartition, offsets map[string][]kafka.PartitionOffsets) ([]PartitionLag, error) {
+	type key struct {
+		topic     string
+		partition int
+	}
+	commits := make(map[key]int64)
+	for topic, ps := range committed {
+		for _, p := range ps {
+			if p.Error != nil {
+				return nil, fmt.Errorf("fetch offset %s[%d]: %w", topic, p.Partition, p.Error)
+			}
+			commits[key{topic, p.Partition}] = p.CommittedOffset
+		}
+	}
+	lags := make([]PartitionLag, 0)
+	for topic, ps := range offsets {
+		for _, p := range ps {
+			if p.Error != nil {
+				return nil, fmt.Errorf("list offset %s[%d]: %w", topic, p.Partition, p.Error)
+			}
+			c, ok := commits[key{topic, p.Partition}]
+			if !ok {
+				c = -1
+			}
+			from := c
+			if from < p.FirstOffset {
+				from = p.FirstOffset
+			}
+			lag := p.LastOffset - from
+			if lag < 0 {
+				lag = 0
+			}
+			lags = append(lags, PartitionLag{Group: groupId, Topic: topic, Partition: p.Partition, Committed: c, End: p.LastOffset, Lag: lag})
+		}
+	}
+	sort.Slice(lags, func(i, j int) bool {
+		if lags[i].Topic != lags[j].Topic {
+			return lags[i].Topic < lags[j].Topic
+		}
+		return lags[i].Partition < lags[j].Partition
+	})
+	return lags, nil
+}
+
+/* 以prometheus text格式輸出落後量 */
+func WriteLag(w io.Writer, lags []PartitionLag) error {
+	var sb strings.Builder
+	sb.WriteString("# TYPE ckafka_consumer_lag gauge\n")
+	for _, l := range lags {
+		fmt.Fprintf(&sb, "ckafka_consumer_lag{group=%q,topic=%q,partition=\"%d\"} %d\n", l.Group, l.Topic, l.Partition, l.Lag)
+	}
+	sb.WriteString("# TYPE ckafka_consumer_committed_offset gauge\n")
+	for _, l := range lags {
+		fmt.Fprintf(&sb, "ckafka_consumer_committed_offset{group=%q,topic=%q,partition=\"%d\"} %d\n", l.Group, l.Topic, l.Partition, l.Committed)
+	}
+	// 多個group讀取同一個topic時 end offset只輸出一次
+	sb.WriteString("# TYPE ckafka_partition_end_offset gauge\n")
+	type partition struct {
+		topic string
+		id    int
+	}
+	seen := make(map[partition]bool)
+	for _, l := range lags {
+		if seen[partition{l.Topic, l.Partition}] {
+			continue
+		}
+		seen[partition{l.Topic, l.Partition}] = true
+		fmt.Fprintf(&sb, "ckafka_partition_end_offset{topic=%q,partition=\"%d\"} %d\n", l.Topic, l.Partition, l.End)
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+/*
+	輸出指定consumer group的落後量 預設prometheus text格式 ?format=json時輸出json
+	例: mux.Handle("/metrics/kafka", admin.LagHandler("billing", "report"))
+*/
+func (a *Admin) LagHandler(groupIds ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lags := make([]PartitionLag, 0)
+		for _, g := range groupIds {
+			l, err := a.Lag(r.Context(), g)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			lags = append(lags, l...)
+		}
+		if r.URL.Query().Get("format") == "json" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(lags)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteLag(w, lags)
+	})
+}
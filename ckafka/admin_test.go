@@ -0,0 +1,73 @@
+package ckafka
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+func TestComputeLag(t *testing.T) {
+	committed := map[string][]kafka.OffsetFetchPartition{
+		"order": {{Partition: 0, CommittedOffset: 90}, {Partition: 1, CommittedOffset: -1}},
+	}
+	offsets := map[string][]kafka.PartitionOffsets{
+		"order": {
+			{Partition: 1, FirstOffset: 20, LastOffset: 50},
+			{Partition: 0, FirstOffset: 0, LastOffset: 100},
+		},
+	}
+	lags, err := computeLag("billing", committed, offsets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PartitionLag{
+		{Group: "billing", Topic: "order", Partition: 0, Committed: 90, End: 100, Lag: 10},
+		{Group: "billing", Topic: "order", Partition: 1, Committed: -1, End: 50, Lag: 30},
+	}
+	for i := range want {
+		if lags[i] != want[i] {
+			t.Fatalf("lag %d: want %+v, got %+v", i, want[i], lags[i])
+		}
+	}
+
+	offsets["order"][0].Error = kafka.UnknownTopicOrPartition
+	if _, err := computeLag("billing", committed, offsets); err == nil {
+		t.Fatal("partition error should be returned")
+	}
+}
+
+func TestWriteLag(t *testing.T) {
+	w := httptest.NewRecorder()
+	err := WriteLag(w, []PartitionLag{
+		{Group: "billing", Topic: "order", Partition: 1, Committed: 5, End: 8, Lag: 3},
+		{Group: "report", Topic: "order", Partition: 1, Committed: 6, End: 8, Lag: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := w.Body.String()
+	for _, line := range []string{
+		`ckafka_consumer_lag{group="billing",topic="order",partition="1"} 3`,
+		`ckafka_consumer_committed_offset{group="billing",topic="order",partition="1"} 5`,
+		`ckafka_partition_end_offset{topic="order",partition="1"} 8`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("missing %s in\n%s", line, body)
+		}
+	}
+	if n := strings.Count(body, "ckafka_partition_end_offset{"); n != 1 {
+		t.Fatalf("end offset series should be written once, got %d in\n%s", n, body)
+	}
+}
+
+func TestCommittedTopics(t *testing.T) {
+	topics := committedTopics(map[string][]kafka.OffsetFetchPartition{
+		"order":   {{Partition: 0, CommittedOffset: -1}, {Partition: 1, CommittedOffset: 3}},
+		"payment": {{Partition: 0, CommittedOffset: -1}},
+	})
+	if !topics["order"] || topics["payment"] {
+		t.Fatalf("unexpected topics %v", topics)
+	}
+}
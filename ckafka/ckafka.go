@@ -5,149 +5,330 @@ import (
 	"errors"
 	"os"
 	"os/signal"
+	"reflect"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/rickylin614/common/utils"
 	"github.com/rickylin614/common/zlog"
 	"github.com/segmentio/kafka-go"
 )
 
 type IManager interface {
 	NewReader(topic, groupId string) (<-chan kafka.Message, error)
+	NewConsumer(conf ConsumerConfig, handler Handler) (*Consumer, error)
+	NewAdmin() (*Admin, error)
 	SetBrokers(broker []string)
 	SetLeaderAddr(lead string)
+	SetConfig(conf Config) error
 	WriteMultiTopic(key, value []byte, topics []string) error
 	Write(key, value []byte, topic string) error
+	WriteMessages(ctx context.Context, topic string, msgs ...kafka.Message) error
+	SetProducerConfig(conf ProducerConfig)
+	Flush(ctx context.Context) error
+	Close() error
 }
 
 type Manager struct {
 	brokers    []string
 	leaderAddr string
+
+	lock         sync.Mutex
+	producer     *Producer
+	producerConf ProducerConfig // SetProducerConfig的設定 優先於SetConfig
+	configConf   ProducerConfig // SetConfig的寫入器設定及連線設定
+	conf         *Config        // 目前套用的SetConfig設定 相同設定不重複套用
+	consumerConf ConsumerConfig // 讀取器的預設值
+	shutdownOnce sync.Once
+	retired      sync.WaitGroup // 設定變更後替換掉的寫入器 Close時等待其送出並關閉
 }
 
 var Manage IManager = &Manager{}
 
 func (this *Manager) SetBrokers(broker []string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if reflect.DeepEqual(this.brokers, broker) {
+		return
+	}
 	this.brokers = broker
+	this.resetProducer()
 }
 
 func (this *Manager) SetLeaderAddr(lead string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.leaderAddr == lead {
+		return
+	}
 	this.leaderAddr = lead
+	this.resetProducer()
+}
+
+/*
+	套用完整設定(brokers、leader、clientId、SASL、TLS、寫入器及讀取器預設值)
+	設定有誤時回傳錯誤且不變更 已建立的讀取器不受影響
+	設定與目前相同時不做任何變更 只有讀取器設定改變時不重建寫入器
+	寫入器以SetProducerConfig設定的欄位(OnDelivery、批次設定等)為優先
+*/
+func (this *Manager) SetConfig(conf Config) error {
+	this.lock.Lock()
+	unchanged := this.conf != nil && reflect.DeepEqual(*this.conf, conf) && this.sameAddrs(conf)
+	this.lock.Unlock()
+	if unchanged {
+		return nil
+	}
+	dialer, transport, err := conf.connection()
+	if err != nil {
+		return err
+	}
+	if err = conf.Consumer.validate(); err != nil {
+		return err
+	}
+	producerConf := conf.Producer
+	producerConf.Transport = transport
+	if err = producerConf.withDefault().validate(); err != nil {
+		return err
+	}
+	consumerConf := conf.Consumer
+	consumerConf.Topic, consumerConf.GroupId, consumerConf.OnError = "", "", nil
+	consumerConf.Dialer = dialer
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	// 讀取器設定不影響寫入器
+	old, next := Config{}, conf
+	if this.conf != nil {
+		old = *this.conf
+	}
+	old.Consumer, next.Consumer = ConsumerConfig{}, ConsumerConfig{}
+	if this.conf == nil || !reflect.DeepEqual(old, next) || !this.sameAddrs(conf) {
+		this.brokers = conf.Brokers
+		this.leaderAddr = conf.Leader
+		this.configConf = producerConf
+		this.resetProducer()
+	}
+	this.consumerConf = consumerConf
+	this.conf = &conf
+	return nil
+}
+
+/* brokers、leader未被SetBrokers、SetLeaderAddr改變 需持有lock */
+func (this *Manager) sameAddrs(conf Config) bool {
+	return reflect.DeepEqual(this.brokers, []string(conf.Brokers)) && this.leaderAddr == conf.Leader
+}
+
+/* 寫入器設定 未設定的欄位及連線設定(Transport)沿用SetConfig 變更後重建寫入器 */
+func (this *Manager) SetProducerConfig(conf ProducerConfig) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.producerConf = conf
+	this.resetProducer()
+}
+
+/* SetProducerConfig與SetConfig合併後的寫入器設定 需持有lock */
+func (this *Manager) producerConfig() ProducerConfig {
+	return this.producerConf.merge(this.configConf)
+}
+
+/*
+	替換寫入器 下次寫入時依新設定重建 需持有lock
+	舊的寫入器等寫入中的呼叫完成後送出並關閉 Close時等待
+*/
+func (this *Manager) resetProducer() {
+	if this.producer == nil {
+		return
+	}
+	old := this.producer
+	this.producer = nil
+	this.retired.Add(1)
+	go func() {
+		defer this.retired.Done()
+		if err := old.Close(); err != nil {
+			zlog.Error("close replaced kafka producer err:", err)
+		}
+	}()
+}
+
+/* 取得共用的寫入器 有設定leader時寫入leader 否則寫入brokers 第一次建立時註冊關機時關閉 */
+func (this *Manager) getProducer() (*Producer, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.producer != nil {
+		return this.producer, nil
+	}
+	addrs := this.brokers
+	if this.leaderAddr != "" {
+		addrs = []string{this.leaderAddr}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("not setting kafka.leader")
+	}
+	p, err := NewProducer(addrs, this.producerConfig())
+	if err != nil {
+		return nil, err
+	}
+	this.producer = p
+	this.shutdownOnce.Do(func() {
+		utils.OnShutdown(func(ctx context.Context) error {
+			if err := this.Flush(ctx); err != nil {
+				return err
+			}
+			return this.Close()
+		})
+	})
+	return p, nil
+}
+
+/* 目前的寫入器設定是否為非同步寫入 */
+func (this *Manager) Async() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.producerConfig().Async
+}
+
+/* 等待非同步寫入的訊息全部送出 */
+func (this *Manager) Flush(ctx context.Context) error {
+	this.lock.Lock()
+	p := this.producer
+	this.lock.Unlock()
+	if p == nil {
+		return nil
+	}
+	return p.Flush(ctx)
+}
+
+/* 關閉寫入器 未送出的訊息會先送出 並等待設定變更時替換掉的寫入器關閉 */
+func (this *Manager) Close() error {
+	this.lock.Lock()
+	p := this.producer
+	this.producer = nil
+	this.lock.Unlock()
+	var err error
+	if p != nil {
+		err = p.Close()
+	}
+	this.retired.Wait()
+	return err
+}
+
+/* 以共用的寫入器寫入 寫入器剛因設定變更被替換時以新的寫入器重試 */
+func (this *Manager) write(fn func(p *Producer) error) error {
+	for {
+		p, err := this.getProducer()
+		if err != nil {
+			return err
+		}
+		if err = fn(p); err != ErrProducerClosed {
+			return err
+		}
+		this.lock.Lock()
+		replaced := this.producer != p
+		this.lock.Unlock()
+		if !replaced {
+			return err
+		}
+	}
 }
 
 // 閱讀器 groupId為空可所有程序皆可接收指定訊息
 func (this *Manager) NewReader(topic, groupId string) (<-chan kafka.Message, error) {
+	conf := this.consumerConfig(ConsumerConfig{Topic: topic, GroupId: groupId})
 	// 給brokers值
-	if this.brokers == nil || len(this.brokers) == 0 {
+	if len(conf.Brokers) == 0 {
 		return nil, errors.New("not setting kafka.brokers")
 	}
 
-	// 設定kafka連線數據
-	r := kafka.NewReader(kafka.ReaderConfig{
-		Brokers:   this.brokers,
-		Topic:     topic,
-		GroupID:   groupId,
-		Partition: 0,
-		MinBytes:  1,                      // 1B
-		MaxBytes:  10e6,                   // 10MB
-		MaxWait:   time.Millisecond * 500, // 500ms
-	})
+	// 設定kafka連線數據 未設定時為1B~10MB 最多等待500ms
+	r := kafka.NewReader(conf.withDefault().readerConfig())
 	zlog.Info("ready to read", topic)
 
-	// 創建訊息接收通道
+	// 創建訊息接收通道 讀取結束時關閉
 	msgChan := make(chan kafka.Message)
 
 	sigchan := make(chan os.Signal, 1)
 	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// 收到關閉訊號 不再接收
+	go func() {
+		<-sigchan
+		signal.Stop(sigchan)
+		cancel()
+	}()
 
 	// 建立協程接收訊息
 	go func() {
-	loop:
+		defer close(msgChan)
 		for {
-			select {
-			case <-sigchan: //收到關閉訊號 直接退出不再接收
-				break loop
-			default:
-				m, err := r.ReadMessage(context.Background())
-				if err != nil {
-					zlog.Error("read msg fail err:", err)
-					continue loop
+			m, err := r.ReadMessage(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					break
 				}
-				msgChan <- m
+				zlog.Error("read msg fail err:", err)
+				// 避免連線異常時不斷重試
+				select {
+				case <-ctx.Done():
+				case <-time.After(time.Second):
+				}
+				continue
+			}
+			select {
+			case msgChan <- m:
+			case <-ctx.Done():
 			}
 		}
 		if err := r.Close(); err != nil {
 			zlog.Error("kafka read close fail", err)
-			return
 		}
 	}()
 	return msgChan, nil
 }
 
-/* 寫入多個topic */
-func (this *Manager) WriteMultiTopic(key, value []byte, topics []string) error {
-	if this.leaderAddr == "" {
-		return errors.New("not setting kafka.leader")
-	}
-
-	// 寫入器基礎設定
-	w := &kafka.Writer{
-		Addr:         kafka.TCP(this.leaderAddr),
-		Balancer:     &kafka.LeastBytes{},
-		BatchTimeout: time.Millisecond * 100,
-	}
+/*
+	建立consumer 未設定的欄位使用SetBrokers、SetConfig的設定
+	handler成功才commit 需自行呼叫Run(ctx)
+*/
+func (this *Manager) NewConsumer(conf ConsumerConfig, handler Handler) (*Consumer, error) {
+	return NewConsumer(this.consumerConfig(conf), handler)
+}
 
-	// 組合要送的訊息
-	kmsg := make([]kafka.Message, 0)
-	for _, v := range topics {
-		k := kafka.Message{
-			Topic: v,
-			Key:   key,
-			Value: value,
-		}
-		kmsg = append(kmsg, k)
-	}
+/* 未設定的欄位使用SetConfig的讀取器預設值 */
+func (this *Manager) consumerConfig(conf ConsumerConfig) ConsumerConfig {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	def := this.consumerConf
+	def.Brokers = this.brokers
+	return conf.merge(def)
+}
 
-	// 送出訊息
-	err := w.WriteMessages(context.Background(), kmsg...)
-	if err != nil {
-		zlog.Error("failed to write messages:", err)
-		return err
-	}
+/* 建立管理介面 使用SetBrokers、SetConfig的brokers及連線設定 */
+func (this *Manager) NewAdmin() (*Admin, error) {
+	this.lock.Lock()
+	brokers, transport := this.brokers, this.producerConfig().Transport
+	this.lock.Unlock()
+	return NewAdmin(brokers, transport)
+}
 
-	if err := w.Close(); err != nil {
-		zlog.Error("failed to close writer:", err)
-		return err
-	}
-	return nil
+/* 寫入多個topic */
+func (this *Manager) WriteMultiTopic(key, value []byte, topics []string) error {
+	return this.write(func(p *Producer) error {
+		return p.WriteMultiTopic(context.Background(), kafka.Message{Key: key, Value: value}, topics)
+	})
 }
 
 // 寫速單個topic裡面
 func (this *Manager) Write(key, value []byte, topic string) error {
-	if this.leaderAddr == "" {
-		return errors.New("not setting kafka.leader")
-	}
-
-	// 寫入器基礎設定
-	w := &kafka.Writer{
-		Topic:        topic,
-		Addr:         kafka.TCP(this.leaderAddr),
-		Balancer:     &kafka.LeastBytes{},
-		BatchTimeout: time.Millisecond * 100,
-	}
+	return this.write(func(p *Producer) error {
+		return p.Write(context.Background(), topic, kafka.Message{Key: key, Value: value})
+	})
+}
 
-	// 送出訊息
-	err := w.WriteMessages(context.Background(), kafka.Message{
-		Key:   key,
-		Value: value,
+/* 寫入完整的訊息(含header) */
+func (this *Manager) WriteMessages(ctx context.Context, topic string, msgs ...kafka.Message) error {
+	return this.write(func(p *Producer) error {
+		return p.Write(ctx, topic, msgs...)
 	})
-	if err != nil {
-		zlog.Error("failed to write messages:", err)
-		return err
-	}
-	if err := w.Close(); err != nil {
-		zlog.Error("failed to close writer:", err)
-		return err
-	}
-	return nil
 }
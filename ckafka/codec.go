@@ -0,0 +1,88 @@
+package ckafka
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+/* 訊息編碼 Name會寫入content-type header 讀取時依header選擇解碼方式 */
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	JSONCodec     Codec = jsonCodec{}
+	MsgpackCodec  Codec = msgpackCodec{}
+	ProtobufCodec Codec = protobufCodec{}
+)
+
+var codecs = struct {
+	sync.RWMutex
+	m map[string]Codec
+}{
+	m: map[string]Codec{
+		JSONCodec.Name():     JSONCodec,
+		MsgpackCodec.Name():  MsgpackCodec,
+		ProtobufCodec.Name(): ProtobufCodec,
+	},
+}
+
+/* 註冊自訂編碼 同名時覆蓋 */
+func RegisterCodec(c Codec) {
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.m[c.Name()] = c
+}
+
+/* 依名稱取得編碼 未註冊時回傳nil */
+func GetCodec(name string) Codec {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	return codecs.m[name]
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return "application/json" }
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+/* 與utils.ToMsgpackStr相同的msgpack編碼 kafka的value為binary 不需base64 */
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return "application/msgpack" }
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) { return msgpack.Marshal(v) }
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error { return msgpack.Unmarshal(data, v) }
+
+/* 訊息型別需實作proto.Message */
+type protobufCodec struct{}
+
+var errNotProto = errors.New("protobuf codec requires proto.Message")
+
+func (protobufCodec) Name() string { return "application/protobuf" }
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, errNotProto
+	}
+	return proto.Marshal(m)
+}
+
+func (protobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return errNotProto
+	}
+	return proto.Unmarshal(data, m)
+}
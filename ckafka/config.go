@@ -0,0 +1,171 @@
+package ckafka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+	kafka完整設定 對應apollo的kafka yaml
+	例:
+		brokers: 10.0.0.1:9093,10.0.0.2:9093
+		clientId: order-service
+		sasl:
+			mechanism: scram-sha-512
+			username: user
+			password: pwd
+		tls:
+			enable: true
+			caFile: /etc/kafka/ca.pem
+		producer:
+			compression: snappy
+		consumer:
+			startOffset: last
+			balancers: [roundrobin, range]
+*/
+type Config struct {
+	Brokers  BrokerList     `yaml:"brokers"`
+	Leader   string         `yaml:"leader"` // 有設定時寫入只連到leader
+	ClientId string         `yaml:"clientId"`
+	SASL     SASLConfig     `yaml:"sasl"`
+	TLS      TLSConfig      `yaml:"tls"`
+	Producer ProducerConfig `yaml:"producer"`
+	Consumer ConsumerConfig `yaml:"consumer"` // 讀取器的預設值 topic、groupId不使用
+}
+
+type SASLConfig struct {
+	Mechanism string `yaml:"mechanism"` // plain/scram-sha-256/scram-sha-512 空白為不驗證
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+}
+
+type TLSConfig struct {
+	Enable             bool   `yaml:"enable"`
+	CAFile             string `yaml:"caFile"`   // 未設定時使用系統CA
+	CertFile           string `yaml:"certFile"` // client憑證 與KeyFile同時設定
+	KeyFile            string `yaml:"keyFile"`
+	ServerName         string `yaml:"serverName"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
+
+/* brokers可為逗號分隔的字串或列表 */
+type BrokerList []string
+
+func (b *BrokerList) UnmarshalYAML(node *yaml.Node) error {
+	var list []string
+	if node.Kind == yaml.ScalarNode {
+		list = strings.Split(node.Value, ",")
+	} else if err := node.Decode(&list); err != nil {
+		return err
+	}
+	*b = (*b)[:0]
+	for _, s := range list {
+		if s = strings.TrimSpace(s); s != "" {
+			*b = append(*b, s)
+		}
+	}
+	return nil
+}
+
+func (c SASLConfig) mechanism() (sasl.Mechanism, error) {
+	switch strings.ToLower(c.Mechanism) {
+	case "":
+		return nil, nil
+	case "plain":
+		return plain.Mechanism{Username: c.Username, Password: c.Password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, c.Username, c.Password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, c.Username, c.Password)
+	default:
+		return nil, errors.New("unsupported kafka sasl mechanism: " + c.Mechanism)
+	}
+}
+
+func (c TLSConfig) config() (*tls.Config, error) {
+	if !c.Enable {
+		return nil, nil
+	}
+	conf := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("kafka tls caFile has no certificate: " + c.CAFile)
+		}
+		conf.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+/* 依設定建立讀取器使用的Dialer及寫入器使用的Transport */
+func (c Config) connection() (*kafka.Dialer, *kafka.Transport, error) {
+	mechanism, err := c.SASL.mechanism()
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConf, err := c.TLS.config()
+	if err != nil {
+		return nil, nil, err
+	}
+	dialer := &kafka.Dialer{
+		ClientID:      c.ClientId,
+		Timeout:       10 * time.Second,
+		DualStack:     true,
+		TLS:           tlsConf,
+		SASLMechanism: mechanism,
+	}
+	transport := &kafka.Transport{
+		ClientID: c.ClientId,
+		TLS:      tlsConf,
+		SASL:     mechanism,
+	}
+	return dialer, transport, nil
+}
+
+/* 讀取器的連線設定轉為寫入器使用 */
+func transportOf(d *kafka.Dialer) kafka.RoundTripper {
+	if d == nil {
+		return nil
+	}
+	return &kafka.Transport{ClientID: d.ClientID, TLS: d.TLS, SASL: d.SASLMechanism}
+}
+
+func groupBalancers(names []string) ([]kafka.GroupBalancer, error) {
+	balancers := make([]kafka.GroupBalancer, 0, len(names))
+	for _, name := range names {
+		switch strings.ToLower(name) {
+		case "range":
+			balancers = append(balancers, kafka.RangeGroupBalancer{})
+		case "roundrobin":
+			balancers = append(balancers, kafka.RoundRobinGroupBalancer{})
+		default:
+			return nil, errors.New("unsupported kafka group balancer: " + name)
+		}
+	}
+	return balancers, nil
+}
@@ -0,0 +1,173 @@
+package ckafka
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"gopkg.in/yaml.v3"
+)
+
+func TestConfig_Yaml(t *testing.T) {
+	str := `
+brokers: 10.0.0.1:9093, 10.0.0.2:9093
+clientId: order
+sasl:
+  mechanism: scram-sha-512
+  username: user
+  password: pwd
+tls:
+  enable: true
+producer:
+  compression: snappy
+consumer:
+  startOffset: last
+  balancers: [roundrobin, range]
+  sessionTimeout: 10s
+`
+	var conf Config
+	if err := yaml.Unmarshal([]byte(str), &conf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]string(conf.Brokers), []string{"10.0.0.1:9093", "10.0.0.2:9093"}) {
+		t.Fatalf("brokers %v", conf.Brokers)
+	}
+	if conf.Consumer.SessionTimeout != 10*time.Second || conf.Producer.Compression != "snappy" {
+		t.Fatalf("unexpected %+v", conf)
+	}
+
+	dialer, transport, err := conf.connection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dialer.ClientID != "order" || dialer.TLS == nil || dialer.SASLMechanism.Name() != "SCRAM-SHA-512" || transport.SASL == nil {
+		t.Fatalf("unexpected dialer %+v", dialer)
+	}
+
+	var list Config
+	if err := yaml.Unmarshal([]byte("brokers: [a:9092, b:9092]"), &list); err != nil || len(list.Brokers) != 2 {
+		t.Fatalf("list brokers %v %v", list.Brokers, err)
+	}
+}
+
+func TestConfig_Invalid(t *testing.T) {
+	tests := []Config{
+		{SASL: SASLConfig{Mechanism: "gssapi"}},
+		{TLS: TLSConfig{Enable: true, CAFile: "not-exist.pem"}},
+		{Consumer: ConsumerConfig{Balancers: []string{"sticky"}}},
+		{Consumer: ConsumerConfig{StartOffset: "middle"}},
+		{Producer: ProducerConfig{Compression: "brotli"}},
+	}
+	for i, conf := range tests {
+		m := &Manager{}
+		if err := m.SetConfig(conf); err == nil {
+			t.Fatalf("case %d should fail", i)
+		}
+	}
+}
+
+func TestManager_SetConfig(t *testing.T) {
+	m := &Manager{}
+	err := m.SetConfig(Config{
+		Brokers:  BrokerList{"a:9092"},
+		ClientId: "order",
+		Consumer: ConsumerConfig{Concurrency: 4, StartOffset: "last", Balancers: []string{"roundrobin"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := m.consumerConfig(ConsumerConfig{Topic: "t", GroupId: "g", Concurrency: 2})
+	if conf.Concurrency != 2 || conf.StartOffset != "last" || conf.Brokers[0] != "a:9092" || conf.Dialer.ClientID != "order" {
+		t.Fatalf("unexpected %+v", conf)
+	}
+	rc := conf.withDefault().readerConfig()
+	if rc.StartOffset != kafka.LastOffset || len(rc.GroupBalancers) != 1 || rc.Dialer == nil {
+		t.Fatalf("unexpected reader config %+v", rc)
+	}
+}
+
+func TestManager_ProducerConfigMerge(t *testing.T) {
+	m := &Manager{}
+	onDelivery := func(messages []kafka.Message, err error) {}
+	m.SetProducerConfig(ProducerConfig{BatchSize: 10, OnDelivery: onDelivery})
+	err := m.SetConfig(Config{
+		Brokers:  BrokerList{"a:9092"},
+		ClientId: "order",
+		Producer: ProducerConfig{BatchSize: 50, Compression: "gzip"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := m.producerConfig()
+	if conf.BatchSize != 10 || conf.Compression != "gzip" || conf.OnDelivery == nil || conf.Transport == nil {
+		t.Fatalf("unexpected %+v", conf)
+	}
+
+	// 之後的SetProducerConfig保留SetConfig的連線設定
+	m.SetProducerConfig(ProducerConfig{BatchSize: 20})
+	conf = m.producerConfig()
+	if conf.BatchSize != 20 || conf.Compression != "gzip" || conf.Transport == nil {
+		t.Fatalf("unexpected %+v", conf)
+	}
+	if tr, ok := conf.Transport.(*kafka.Transport); !ok || tr.ClientID != "order" {
+		t.Fatalf("unexpected transport %+v", conf.Transport)
+	}
+}
+
+func TestManager_ResetProducer(t *testing.T) {
+	m := &Manager{}
+	m.SetBrokers([]string{"localhost:9092"})
+	p1, err := m.getProducer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetBrokers([]string{"localhost:9092"})
+	if p, _ := m.getProducer(); p != p1 {
+		t.Fatal("same brokers should keep the producer")
+	}
+	m.SetBrokers([]string{"localhost:9093"})
+	p2, _ := m.getProducer()
+	if p2 == p1 {
+		t.Fatal("producer should be replaced")
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Close等待替換掉的寫入器關閉
+	if !p1.closed || !p2.closed {
+		t.Fatal("replaced producer should be closed before Close returns")
+	}
+}
+
+func TestManager_SetConfigUnchanged(t *testing.T) {
+	m := &Manager{}
+	defer m.Close()
+	conf := Config{Brokers: BrokerList{"localhost:9092"}, ClientId: "order"}
+	if err := m.SetConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	p1, _ := m.getProducer()
+	if err := m.SetConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	// 只有讀取器設定改變
+	conf.Consumer.Concurrency = 4
+	if err := m.SetConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := m.getProducer(); p != p1 {
+		t.Fatal("producer should be kept when producer settings are unchanged")
+	}
+	if c := m.consumerConfig(ConsumerConfig{}); c.Concurrency != 4 {
+		t.Fatalf("consumer config not applied: %+v", c)
+	}
+
+	conf.ClientId = "billing"
+	if err := m.SetConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := m.getProducer(); p == p1 {
+		t.Fatal("producer should be replaced when connection settings change")
+	}
+}
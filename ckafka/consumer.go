@@ -0,0 +1,381 @@
+package ckafka
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/rickylin614/common/zlog"
+	"github.com/segmentio/kafka-go"
+	"go.elastic.co/apm"
+)
+
+/* 訊息處理 回傳nil才會commit offset */
+type Handler func(ctx context.Context, msg kafka.Message) error
+
+/* handler失敗時呼叫 回傳nil視為已處理(commit) 回傳錯誤則等待RetryBackoff後重新處理 */
+type ErrorHandler func(ctx context.Context, msg kafka.Message, err error) error
+
+// 讀取器設定 未設定的欄位使用預設值
+type ConsumerConfig struct {
+	Brokers      []string      `yaml:"brokers"`
+	Topic        string        `yaml:"topic"`
+	GroupId      string        `yaml:"groupId"`
+	Concurrency  int           `yaml:"concurrency"`  // 每個partition的併發數 同key依序處理 預設1
+	QueueSize    int           `yaml:"queueSize"`    // 每個處理通道的緩衝數 預設100
+	MinBytes     int           `yaml:"minBytes"`     // 預設1B
+	MaxBytes     int           `yaml:"maxBytes"`     // 預設10MB
+	MaxWait      time.Duration `yaml:"maxWait"`      // 預設500ms
+	StartOffset  string        `yaml:"startOffset"`  // 沒有commit紀錄時的起始位置 first/last 預設first
+	RetryBackoff time.Duration `yaml:"retryBackoff"` // handler失敗後重試的間隔 預設1s
+	// partition分配策略 依優先順序 range/roundrobin 預設range
+	Balancers         []string      `yaml:"balancers"`
+	QueueCapacity     int           `yaml:"queueCapacity"`     // 內部預先讀取的訊息數 預設100
+	HeartbeatInterval time.Duration `yaml:"heartbeatInterval"` // 預設3s
+	SessionTimeout    time.Duration `yaml:"sessionTimeout"`    // 預設30s
+	RebalanceTimeout  time.Duration `yaml:"rebalanceTimeout"`  // 預設30s
+	// 連線設定(clientId、SASL、TLS) 未設定時使用預設連線
+	Dialer *kafka.Dialer `yaml:"-"`
+	// handler失敗時呼叫 未設定時持續重試直到成功
+	OnError ErrorHandler `yaml:"-"`
+}
+
+func (c ConsumerConfig) withDefault() ConsumerConfig {
+	if c.Concurrency <= 0 {
+		c.Concurrency = 1
+	}
+	if c.QueueSize <= 0 {
+		c.QueueSize = 100
+	}
+	if c.MinBytes == 0 {
+		c.MinBytes = 1
+	}
+	if c.MaxBytes == 0 {
+		c.MaxBytes = 10e6
+	}
+	if c.MaxWait == 0 {
+		c.MaxWait = 500 * time.Millisecond
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = time.Second
+	}
+	return c
+}
+
+/* 未設定的欄位使用def的設定 Topic、GroupId、OnError除外 */
+func (c ConsumerConfig) merge(def ConsumerConfig) ConsumerConfig {
+	if len(c.Brokers) == 0 {
+		c.Brokers = def.Brokers
+	}
+	if c.Concurrency == 0 {
+		c.Concurrency = def.Concurrency
+	}
+	if c.QueueSize == 0 {
+		c.QueueSize = def.QueueSize
+	}
+	if c.MinBytes == 0 {
+		c.MinBytes = def.MinBytes
+	}
+	if c.MaxBytes == 0 {
+		c.MaxBytes = def.MaxBytes
+	}
+	if c.MaxWait == 0 {
+		c.MaxWait = def.MaxWait
+	}
+	if c.StartOffset == "" {
+		c.StartOffset = def.StartOffset
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = def.RetryBackoff
+	}
+	if len(c.Balancers) == 0 {
+		c.Balancers = def.Balancers
+	}
+	if c.QueueCapacity == 0 {
+		c.QueueCapacity = def.QueueCapacity
+	}
+	if c.HeartbeatInterval == 0 {
+		c.HeartbeatInterval = def.HeartbeatInterval
+	}
+	if c.SessionTimeout == 0 {
+		c.SessionTimeout = def.SessionTimeout
+	}
+	if c.RebalanceTimeout == 0 {
+		c.RebalanceTimeout = def.RebalanceTimeout
+	}
+	if c.Dialer == nil {
+		c.Dialer = def.Dialer
+	}
+	return c
+}
+
+func (c ConsumerConfig) validate() error {
+	switch c.StartOffset {
+	case "", "first", "last":
+	default:
+		return errors.New("unsupported kafka startOffset: " + c.StartOffset)
+	}
+	_, err := groupBalancers(c.Balancers)
+	return err
+}
+
+/* 需先validate */
+func (c ConsumerConfig) readerConfig() kafka.ReaderConfig {
+	startOffset := kafka.FirstOffset
+	if c.StartOffset == "last" {
+		startOffset = kafka.LastOffset
+	}
+	balancers, _ := groupBalancers(c.Balancers)
+	return kafka.ReaderConfig{
+		Brokers:           c.Brokers,
+		Topic:             c.Topic,
+		GroupID:           c.GroupId,
+		Dialer:            c.Dialer,
+		MinBytes:          c.MinBytes,
+		MaxBytes:          c.MaxBytes,
+		MaxWait:           c.MaxWait,
+		StartOffset:       startOffset,
+		GroupBalancers:    balancers,
+		QueueCapacity:     c.QueueCapacity,
+		HeartbeatInterval: c.HeartbeatInterval,
+		SessionTimeout:    c.SessionTimeout,
+		RebalanceTimeout:  c.RebalanceTimeout,
+	}
+}
+
+// kafka.Reader中Consumer使用的方法 測試時可替換 例: kafkatest
+type MessageReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+/*
+	consumer group讀取器
+	訊息依partition及key分配到處理通道 同partition同key依序處理
+	handler成功後才commit 且同partition只commit到連續完成的最大offset
+*/
+type Consumer struct {
+	conf    ConsumerConfig
+	handler Handler
+	reader  MessageReader
+
+	commitLock sync.Mutex
+	partitions map[int]*partitionOffsets
+}
+
+// 同一個partition中已讀取尚未commit的offset
+type partitionOffsets struct {
+	pending    []kafka.Message // 依讀取順序
+	done       map[int64]bool
+	target     *kafka.Message // 待commit的最大offset
+	committing bool           // 已有goroutine在commit 由其接續commit target
+}
+
+func NewConsumer(conf ConsumerConfig, handler Handler) (*Consumer, error) {
+	if len(conf.Brokers) == 0 {
+		return nil, errors.New("not setting kafka.brokers")
+	}
+	if conf.Topic == "" || conf.GroupId == "" {
+		return nil, errors.New("consumer topic and groupId are required")
+	}
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	conf = conf.withDefault()
+	return newConsumer(conf, handler, kafka.NewReader(conf.readerConfig())), nil
+}
+
+/* 以自訂的讀取器建立consumer 讀取器需自行處理topic及groupId */
+func NewConsumerWithReader(conf ConsumerConfig, handler Handler, reader MessageReader) *Consumer {
+	return newConsumer(conf, handler, reader)
+}
+
+func newConsumer(conf ConsumerConfig, handler Handler, reader MessageReader) *Consumer {
+	return &Consumer{
+		conf:       conf.withDefault(),
+		handler:    handler,
+		reader:     reader,
+		partitions: make(map[int]*partitionOffsets),
+	}
+}
+
+type laneKey struct {
+	partition int
+	lane      int
+}
+
+/*
+	開始讀取直到ctx取消 取消後不再處理尚未開始的訊息(未commit 下次重新讀取)
+	等待處理中的訊息結束並關閉讀取器後回傳
+*/
+func (c *Consumer) Run(ctx context.Context) error {
+	zlog.Info("ready to read", c.conf.Topic)
+	lanes := make(map[laneKey]chan kafka.Message)
+	var wg sync.WaitGroup
+	defer func() {
+		for _, ch := range lanes {
+			close(ch)
+		}
+		wg.Wait()
+		if err := c.reader.Close(); err != nil {
+			zlog.Error("kafka read close fail", err)
+		}
+	}()
+
+	for {
+		msg, err := c.reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			zlog.Error("read msg fail err:", err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(c.conf.RetryBackoff):
+			}
+			continue
+		}
+		c.track(msg)
+
+		key := laneKey{partition: msg.Partition, lane: c.lane(msg)}
+		ch, ok := lanes[key]
+		if !ok {
+			ch = make(chan kafka.Message, c.conf.QueueSize)
+			lanes[key] = ch
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				c.work(ctx, ch)
+			}()
+		}
+		select {
+		case ch <- msg:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+/* 有key時依key分配 同key同通道 沒有key時依offset分散 */
+func (c *Consumer) lane(msg kafka.Message) int {
+	if c.conf.Concurrency == 1 {
+		return 0
+	}
+	if len(msg.Key) == 0 {
+		return int(msg.Offset % int64(c.conf.Concurrency))
+	}
+	h := fnv.New32a()
+	h.Write(msg.Key)
+	return int(h.Sum32() % uint32(c.conf.Concurrency))
+}
+
+func (c *Consumer) work(ctx context.Context, ch <-chan kafka.Message) {
+	for msg := range ch {
+		if ctx.Err() != nil {
+			continue
+		}
+		if c.traceHandle(ctx, msg) {
+			c.complete(msg)
+		}
+	}
+}
+
+/* 每則訊息一個apm transaction 接續寫入端的trace */
+func (c *Consumer) traceHandle(ctx context.Context, msg kafka.Message) bool {
+	tx, ctx := StartTransaction(ctx, msg)
+	defer tx.End()
+	ok := c.handle(ctx, msg)
+	if ok {
+		tx.Result = "success"
+	} else {
+		tx.Result = "failure"
+	}
+	return ok
+}
+
+/* 處理訊息 失敗時交由OnError 直到成功或ctx取消 回傳是否可commit */
+func (c *Consumer) handle(ctx context.Context, msg kafka.Message) bool {
+	for {
+		err := c.safeHandle(ctx, msg)
+		if err == nil {
+			return true
+		}
+		if c.conf.OnError != nil {
+			if err = c.conf.OnError(ctx, msg, err); err == nil {
+				return true
+			}
+		}
+		apm.CaptureError(ctx, err).Send()
+		zlog.Errorf("kafka handle msg fail topic:%s partition:%d offset:%d err:%v", msg.Topic, msg.Partition, msg.Offset, err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(c.conf.RetryBackoff):
+		}
+	}
+}
+
+/* handler panic時視為失敗 */
+func (c *Consumer) safeHandle(ctx context.Context, msg kafka.Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			zlog.Error("kafka handler panic:", r)
+			err = errors.New("kafka handler panic")
+		}
+	}()
+	return c.handler(ctx, msg)
+}
+
+/* 記錄讀取的offset 需在分配到處理通道前呼叫 */
+func (c *Consumer) track(msg kafka.Message) {
+	c.commitLock.Lock()
+	defer c.commitLock.Unlock()
+	p, ok := c.partitions[msg.Partition]
+	if !ok {
+		p = &partitionOffsets{done: make(map[int64]bool)}
+		c.partitions[msg.Partition] = p
+	}
+	p.pending = append(p.pending, msg)
+}
+
+/*
+	標記完成 commit到該partition連續完成的最大offset ctx取消時處理完的訊息仍需commit
+	commit不持有commitLock 同一個partition同時只有一個goroutine commit 避免較舊的offset覆蓋較新的
+*/
+func (c *Consumer) complete(msg kafka.Message) {
+	c.commitLock.Lock()
+	p := c.partitions[msg.Partition]
+	p.done[msg.Offset] = true
+	for len(p.pending) > 0 && p.done[p.pending[0].Offset] {
+		m := p.pending[0]
+		p.target = &m
+		delete(p.done, m.Offset)
+		p.pending = p.pending[1:]
+	}
+	if p.target == nil || p.committing {
+		c.commitLock.Unlock()
+		return
+	}
+	p.committing = true
+	for p.target != nil {
+		last := *p.target
+		p.target = nil
+		c.commitLock.Unlock()
+		c.commit(last)
+		c.commitLock.Lock()
+	}
+	p.committing = false
+	c.commitLock.Unlock()
+}
+
+func (c *Consumer) commit(msg kafka.Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.reader.CommitMessages(ctx, msg); err != nil {
+		zlog.Error("kafka commit fail:", err)
+	}
+}
@@ -0,0 +1,188 @@
+package ckafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+type fakeReader struct {
+	msgs    chan kafka.Message
+	lock    sync.Mutex
+	commits []kafka.Message
+	closed  bool
+}
+
+func newFakeReader(msgs ...kafka.Message) *fakeReader {
+	r := &fakeReader{msgs: make(chan kafka.Message, len(msgs))}
+	for _, m := range msgs {
+		r.msgs <- m
+	}
+	return r
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	select {
+	case m := <-r.msgs:
+		return m, nil
+	case <-ctx.Done():
+		return kafka.Message{}, ctx.Err()
+	}
+}
+
+func (r *fakeReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.commits = append(r.commits, msgs...)
+	return nil
+}
+
+func (r *fakeReader) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closed = true
+	return nil
+}
+
+func (r *fakeReader) lastCommit() int64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.commits) == 0 {
+		return -1
+	}
+	return r.commits[len(r.commits)-1].Offset
+}
+
+func TestConsumer_KeyOrderAndCommit(t *testing.T) {
+	msgs := make([]kafka.Message, 0)
+	for i := 0; i < 40; i++ {
+		msgs = append(msgs, kafka.Message{Topic: "t", Offset: int64(i), Key: []byte(fmt.Sprint("k", i%5))})
+	}
+	reader := newFakeReader(msgs...)
+
+	var lock sync.Mutex
+	seen := make(map[string][]int64)
+	failed := make(map[int64]bool)
+	handler := func(ctx context.Context, msg kafka.Message) error {
+		lock.Lock()
+		defer lock.Unlock()
+		// offset 3第一次處理失敗 需重試後才可commit
+		if msg.Offset == 3 && !failed[3] {
+			failed[3] = true
+			return errors.New("fail")
+		}
+		seen[string(msg.Key)] = append(seen[string(msg.Key)], msg.Offset)
+		return nil
+	}
+	c := newConsumer(ConsumerConfig{Concurrency: 4, RetryBackoff: 10 * time.Millisecond}, handler, reader)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.Run(ctx) }()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for reader.lastCommit() != 39 {
+		if time.Now().After(deadline) {
+			t.Fatalf("last commit %d", reader.lastCommit())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !reader.closed {
+		t.Fatal("reader should be closed")
+	}
+
+	for key, offsets := range seen {
+		if len(offsets) != 8 {
+			t.Fatalf("key %s: want 8 messages, got %v", key, offsets)
+		}
+		for i := 1; i < len(offsets); i++ {
+			if offsets[i] < offsets[i-1] {
+				t.Fatalf("key %s out of order: %v", key, offsets)
+			}
+		}
+	}
+	var prev int64 = -1
+	for _, m := range reader.commits {
+		if m.Offset <= prev {
+			t.Fatalf("commits not increasing: %v", reader.commits)
+		}
+		prev = m.Offset
+	}
+}
+
+func TestConsumer_NoCommitOnCancel(t *testing.T) {
+	reader := newFakeReader(kafka.Message{Topic: "t", Offset: 0})
+	started := make(chan struct{})
+	c := newConsumer(ConsumerConfig{RetryBackoff: 10 * time.Millisecond}, func(ctx context.Context, msg kafka.Message) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}, reader)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.Run(ctx) }()
+	<-started
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run should return after cancel")
+	}
+	if reader.lastCommit() != -1 {
+		t.Fatal("failed message should not be committed")
+	}
+}
+
+// commit時阻塞直到release關閉
+type slowCommitReader struct {
+	fakeReader
+	started chan struct{}
+	release chan struct{}
+}
+
+func (r *slowCommitReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.started <- struct{}{}
+	<-r.release
+	return r.fakeReader.CommitMessages(ctx, msgs...)
+}
+
+func TestConsumer_CommitOutsideLock(t *testing.T) {
+	reader := &slowCommitReader{started: make(chan struct{}, 2), release: make(chan struct{})}
+	c := newConsumer(ConsumerConfig{}, nil, reader)
+	m0, m1 := kafka.Message{Offset: 0}, kafka.Message{Offset: 1}
+	c.track(m0)
+	done := make(chan struct{})
+	go func() {
+		c.complete(m0)
+		close(done)
+	}()
+	<-reader.started
+
+	// commit進行中仍可讀取及完成其他訊息 由commit中的goroutine接續commit
+	tracked := make(chan struct{})
+	go func() {
+		c.track(m1)
+		c.complete(m1)
+		close(tracked)
+	}()
+	select {
+	case <-tracked:
+	case <-time.After(time.Second):
+		t.Fatal("track blocked by commit")
+	}
+	close(reader.release)
+	<-done
+	if reader.lastCommit() != 1 || len(reader.commits) != 2 {
+		t.Fatalf("unexpected commits %v", reader.commits)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rickylin614/common/ckafka"
+)
+
+/*
+	將dead-letter topic的訊息重新投遞到原topic
+	例: go run ./ckafka/dlqreplay -brokers 127.0.0.1:9092 -topic order -limit 100
+*/
+func main() {
+	brokers := flag.String("brokers", "127.0.0.1:9092", "kafka brokers 以逗號分隔")
+	topic := flag.String("topic", "", "原topic名稱 讀取<topic>.dlq")
+	groupId := flag.String("group", "dlq-replay", "記錄重新投遞進度的consumer group")
+	limit := flag.Int("limit", 0, "最多投遞數量 0為不限制")
+	idle := flag.Duration("idle", 5*time.Second, "沒有新訊息多久後結束")
+	flag.Parse()
+	if *topic == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	count, err := ckafka.ReplayDLQ(ctx, ckafka.ConsumerConfig{
+		Brokers: strings.Split(*brokers, ","),
+		Topic:   *topic,
+		GroupId: *groupId,
+	}, *limit, *idle)
+	fmt.Printf("replayed %d messages from %s\n", count, ckafka.DLQTopic(*topic))
+	if err != nil {
+		fmt.Println("replay fail:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,340 @@
+/*
+	單元測試用的記憶體kafka
+	實作ckafka.IManager及ckafka.MessageReader 支援topic、partition、key、consumer group的offset及同程序內的rebalance
+
+	b := kafkatest.Install(t, 3)
+	ckafka.Manage.Write([]byte("k"), []byte("v"), "order")
+	msgs := b.Messages("order")
+*/
+package kafkatest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rickylin614/common/ckafka"
+	"github.com/segmentio/kafka-go"
+)
+
+type topicLog struct {
+	partitions [][]kafka.Message
+	all        []kafka.Message // 依寫入順序
+}
+
+// 同一個group讀取同一個topic的成員
+type groupTopic struct {
+	members    []*Reader
+	generation int
+	committed  map[int]int64 // partition => 下一個讀取的offset
+}
+
+/* 記憶體中的broker 可同時給多個Manager、Reader使用 */
+type Broker struct {
+	lock       sync.Mutex
+	notify     chan struct{} // 有新訊息、commit或rebalance時關閉並重建
+	partitions int
+	balancer   kafka.Hash
+	topics     map[string]*topicLog
+	groups     map[string]map[string]*groupTopic // groupId => topic
+}
+
+/* 自動建立的topic有partitions個partition 預設1 */
+func NewBroker(partitions int) *Broker {
+	if partitions <= 0 {
+		partitions = 1
+	}
+	return &Broker{
+		notify:     make(chan struct{}),
+		partitions: partitions,
+		topics:     make(map[string]*topicLog),
+		groups:     make(map[string]map[string]*groupTopic),
+	}
+}
+
+/* 建立broker並替換ckafka.Manage 測試結束時還原 */
+func Install(t testing.TB, partitions int) *Broker {
+	b := NewBroker(partitions)
+	old := ckafka.Manage
+	m := b.Manager()
+	ckafka.Manage = m
+	t.Cleanup(func() {
+		m.Close()
+		ckafka.Manage = old
+	})
+	return b
+}
+
+/* 需持有lock */
+func (b *Broker) changed() {
+	close(b.notify)
+	b.notify = make(chan struct{})
+}
+
+/* 需持有lock */
+func (b *Broker) topic(name string) *topicLog {
+	t, ok := b.topics[name]
+	if !ok {
+		t = &topicLog{partitions: make([][]kafka.Message, b.partitions)}
+		b.topics[name] = t
+	}
+	return t
+}
+
+/* 建立指定partition數的topic 已存在時不變更 */
+func (b *Broker) CreateTopic(name string, partitions int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if _, ok := b.topics[name]; ok {
+		return
+	}
+	if partitions <= 0 {
+		partitions = 1
+	}
+	b.topics[name] = &topicLog{partitions: make([][]kafka.Message, partitions)}
+}
+
+/* 寫入訊息 有key時依hash分配partition 與Balancer為hash的ckafka.Producer相同 */
+func (b *Broker) Produce(topic string, msgs ...kafka.Message) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	t := b.topic(topic)
+	ids := make([]int, len(t.partitions))
+	for i := range ids {
+		ids[i] = i
+	}
+	now := time.Now()
+	for _, m := range msgs {
+		m.Topic = topic
+		m.Partition = b.balancer.Balance(m, ids...)
+		m.Offset = int64(len(t.partitions[m.Partition]))
+		m.Headers = append([]kafka.Header{}, m.Headers...)
+		if m.Time.IsZero() {
+			m.Time = now
+		}
+		t.partitions[m.Partition] = append(t.partitions[m.Partition], m)
+		t.all = append(t.all, m)
+	}
+	b.changed()
+}
+
+/* 依寫入順序回傳topic所有的訊息 */
+func (b *Broker) Messages(topic string) []kafka.Message {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	t, ok := b.topics[topic]
+	if !ok {
+		return nil
+	}
+	return append([]kafka.Message{}, t.all...)
+}
+
+/* group在partition已commit的offset(下一個讀取的offset) 尚未commit為-1 */
+func (b *Broker) Committed(groupId, topic string, partition int) int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if off, ok := b.group(groupId, topic).committed[partition]; ok {
+		return off
+	}
+	return -1
+}
+
+/* group在topic尚未commit的訊息數 */
+func (b *Broker) Lag(groupId, topic string) int64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.lag(groupId, topic)
+}
+
+/* 需持有lock */
+func (b *Broker) lag(groupId, topic string) int64 {
+	g := b.group(groupId, topic)
+	var lag int64
+	for p, log := range b.topic(topic).partitions {
+		lag += int64(len(log)) - g.committed[p]
+	}
+	return lag
+}
+
+/* 等待group commit完topic所有的訊息 */
+func (b *Broker) WaitCommitted(ctx context.Context, groupId, topic string) error {
+	for {
+		b.lock.Lock()
+		lag := b.lag(groupId, topic)
+		wait := b.notify
+		b.lock.Unlock()
+		if lag == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wait:
+		}
+	}
+}
+
+/* 需持有lock */
+func (b *Broker) group(groupId, topic string) *groupTopic {
+	topics, ok := b.groups[groupId]
+	if !ok {
+		topics = make(map[string]*groupTopic)
+		b.groups[groupId] = topics
+	}
+	g, ok := topics[topic]
+	if !ok {
+		g = &groupTopic{committed: make(map[int]int64)}
+		topics[topic] = g
+	}
+	return g
+}
+
+/*
+	建立讀取器 groupId為空時讀取所有partition且不可commit
+	同group的讀取器平均分配partition 加入或關閉時rebalance 從已commit的offset繼續讀取
+*/
+func (b *Broker) NewReader(topic, groupId string) *Reader {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.topic(topic)
+	r := &Reader{broker: b, topic: topic, groupId: groupId, generation: -1}
+	if groupId != "" {
+		g := b.group(groupId, topic)
+		g.members = append(g.members, r)
+		g.generation++
+		b.changed()
+	}
+	return r
+}
+
+/* 實作ckafka.MessageReader */
+type Reader struct {
+	broker     *Broker
+	topic      string
+	groupId    string
+	generation int
+	assigned   []int
+	positions  map[int]int64
+	cursor     int
+	closed     bool
+}
+
+/* 需持有broker.lock rebalance後重新分配partition 並從已commit的offset讀取 */
+func (r *Reader) sync() {
+	log := r.broker.topic(r.topic)
+	if r.groupId == "" {
+		if r.positions == nil {
+			r.positions = make(map[int]int64)
+			for p := range log.partitions {
+				r.assigned = append(r.assigned, p)
+			}
+		}
+		return
+	}
+	g := r.broker.group(r.groupId, r.topic)
+	if r.generation == g.generation {
+		return
+	}
+	r.generation = g.generation
+	r.assigned = r.assigned[:0]
+	r.positions = make(map[int]int64)
+	index := 0
+	for i, m := range g.members {
+		if m == r {
+			index = i
+		}
+	}
+	for p := range log.partitions {
+		if p%len(g.members) == index {
+			r.assigned = append(r.assigned, p)
+			r.positions[p] = g.committed[p]
+		}
+	}
+}
+
+/* 需持有broker.lock 依序輪流讀取分配到的partition */
+func (r *Reader) next() (kafka.Message, bool) {
+	r.sync()
+	log := r.broker.topic(r.topic)
+	for i := 0; i < len(r.assigned); i++ {
+		p := r.assigned[(r.cursor+i)%len(r.assigned)]
+		if pos := r.positions[p]; pos < int64(len(log.partitions[p])) {
+			r.positions[p] = pos + 1
+			r.cursor = (r.cursor + i + 1) % len(r.assigned)
+			return log.partitions[p][pos], true
+		}
+	}
+	return kafka.Message{}, false
+}
+
+func (r *Reader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	for {
+		r.broker.lock.Lock()
+		if r.closed {
+			r.broker.lock.Unlock()
+			return kafka.Message{}, io.EOF
+		}
+		msg, ok := r.next()
+		wait := r.broker.notify
+		r.broker.lock.Unlock()
+		if ok {
+			return msg, nil
+		}
+		select {
+		case <-ctx.Done():
+			return kafka.Message{}, ctx.Err()
+		case <-wait:
+		}
+	}
+}
+
+/* 讀取並commit 與kafka.Reader.ReadMessage相同 */
+func (r *Reader) ReadMessage(ctx context.Context) (kafka.Message, error) {
+	msg, err := r.FetchMessage(ctx)
+	if err != nil || r.groupId == "" {
+		return msg, err
+	}
+	return msg, r.CommitMessages(ctx, msg)
+}
+
+/* commit到訊息的下一個offset 不會倒退 */
+func (r *Reader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if r.groupId == "" {
+		return errors.New("unavailable when GroupID is not set")
+	}
+	r.broker.lock.Lock()
+	defer r.broker.lock.Unlock()
+	g := r.broker.group(r.groupId, r.topic)
+	for _, m := range msgs {
+		if m.Offset+1 > g.committed[m.Partition] {
+			g.committed[m.Partition] = m.Offset + 1
+		}
+	}
+	r.broker.changed()
+	return nil
+}
+
+/* 離開group 其他成員rebalance */
+func (r *Reader) Close() error {
+	r.broker.lock.Lock()
+	defer r.broker.lock.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	if r.groupId != "" {
+		g := r.broker.group(r.groupId, r.topic)
+		for i, m := range g.members {
+			if m == r {
+				g.members = append(g.members[:i], g.members[i+1:]...)
+				break
+			}
+		}
+		g.generation++
+	}
+	r.broker.changed()
+	return nil
+}
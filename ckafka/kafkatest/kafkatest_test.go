@@ -0,0 +1,130 @@
+package kafkatest
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rickylin614/common/ckafka"
+	"github.com/segmentio/kafka-go"
+	"go.elastic.co/apm/apmtest"
+)
+
+func TestBroker_KeyPartition(t *testing.T) {
+	b := Install(t, 4)
+	for _, key := range []string{"a", "b", "a", "c", "a"} {
+		if err := ckafka.Manage.Write([]byte(key), []byte(key), "order"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgs := b.Messages("order")
+	if len(msgs) != 5 {
+		t.Fatalf("want 5 messages, got %d", len(msgs))
+	}
+	partition := map[string]int{}
+	for _, m := range msgs {
+		if p, ok := partition[string(m.Key)]; ok && p != m.Partition {
+			t.Fatalf("key %s in partitions %d and %d", m.Key, p, m.Partition)
+		}
+		partition[string(m.Key)] = m.Partition
+	}
+}
+
+func TestManager_WriteMessagesKeepsHeaders(t *testing.T) {
+	b := Install(t, 1)
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+	msgs := []kafka.Message{{Value: []byte("a"), Headers: []kafka.Header{{Key: "a", Value: []byte("1")}}}}
+	tracer.WithTransaction(func(ctx context.Context) {
+		if err := ckafka.Manage.WriteMessages(ctx, "order", msgs...); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if len(msgs[0].Headers) != 1 {
+		t.Fatalf("caller's headers modified: %v", msgs[0].Headers)
+	}
+	if got := b.Messages("order"); len(got) != 1 || ckafka.GetHeader(got[0], ckafka.HeaderTraceparent) == "" {
+		t.Fatalf("unexpected messages %+v", got)
+	}
+}
+
+func TestBroker_Consumer(t *testing.T) {
+	b := Install(t, 3)
+	type order struct {
+		Id int `json:"id"`
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 10; i++ {
+		if _, err := ckafka.Publish(ctx, "order", order{Id: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var lock sync.Mutex
+	seen := make(map[int]bool)
+	c, err := ckafka.Subscribe(ckafka.ConsumerConfig{Topic: "order", GroupId: "billing", Concurrency: 2},
+		func(ctx context.Context, e ckafka.Envelope, v order) error {
+			lock.Lock()
+			defer lock.Unlock()
+			seen[v.Id] = true
+			return nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runCtx, stop := context.WithCancel(ctx)
+	done := make(chan error)
+	go func() { done <- c.Run(runCtx) }()
+
+	if err := b.WaitCommitted(ctx, "billing", "order"); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	<-done
+	if len(seen) != 10 || b.Lag("billing", "order") != 0 {
+		t.Fatalf("seen %d lag %d", len(seen), b.Lag("billing", "order"))
+	}
+}
+
+func TestBroker_Rebalance(t *testing.T) {
+	b := NewBroker(4)
+	for i := 0; i < 8; i++ {
+		b.Produce("t", kafka.Message{Value: []byte{byte(i)}})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	r1 := b.NewReader("t", "g")
+	r2 := b.NewReader("t", "g")
+	parts := func(r *Reader, n int) map[int]bool {
+		got := map[int]bool{}
+		for i := 0; i < n; i++ {
+			m, err := r.ReadMessage(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got[m.Partition] = true
+		}
+		return got
+	}
+	p1, p2 := parts(r1, 2), parts(r2, 2)
+	for p := range p1 {
+		if p2[p] {
+			t.Fatalf("partition %d assigned to both readers", p)
+		}
+	}
+
+	// r2離開後r1分配到所有partition 從已commit的offset繼續
+	r2.Close()
+	parts(r1, 4)
+	if b.Lag("g", "t") != 0 {
+		t.Fatalf("lag %d", b.Lag("g", "t"))
+	}
+	short, stop := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer stop()
+	if _, err := r1.FetchMessage(short); err == nil {
+		t.Fatal("committed messages should not be redelivered")
+	}
+}
@@ -0,0 +1,122 @@
+package kafkatest
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/rickylin614/common/ckafka"
+	"github.com/segmentio/kafka-go"
+)
+
+var ErrAdminUnsupported = errors.New("kafkatest does not support admin api")
+
+/* 以記憶體broker實作ckafka.IManager 連線相關的設定只記錄不使用 */
+type Manager struct {
+	broker *Broker
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	lock    sync.Mutex
+	brokers []string
+	leader  string
+	config  ckafka.Config
+}
+
+var _ ckafka.IManager = (*Manager)(nil)
+
+func (b *Broker) Manager() *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{broker: b, ctx: ctx, cancel: cancel}
+}
+
+func (m *Manager) SetBrokers(brokers []string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.brokers = brokers
+}
+
+func (m *Manager) SetLeaderAddr(lead string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.leader = lead
+}
+
+func (m *Manager) SetConfig(conf ckafka.Config) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.config = conf
+	return nil
+}
+
+func (m *Manager) SetProducerConfig(conf ckafka.ProducerConfig) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.config.Producer = conf
+}
+
+func (m *Manager) Write(key, value []byte, topic string) error {
+	m.broker.Produce(topic, kafka.Message{Key: key, Value: value})
+	return nil
+}
+
+func (m *Manager) WriteMultiTopic(key, value []byte, topics []string) error {
+	for _, topic := range topics {
+		m.broker.Produce(topic, kafka.Message{Key: key, Value: value})
+	}
+	return nil
+}
+
+/* 與ckafka.Producer相同寫入apm的traceparent header */
+func (m *Manager) WriteMessages(ctx context.Context, topic string, msgs ...kafka.Message) error {
+	msgs = append([]kafka.Message(nil), msgs...)
+	for i := range msgs {
+		msgs[i].Headers = ckafka.InjectTrace(ctx, msgs[i].Headers)
+	}
+	m.broker.Produce(topic, msgs...)
+	return nil
+}
+
+/* 讀取並自動commit 直到Close */
+func (m *Manager) NewReader(topic, groupId string) (<-chan kafka.Message, error) {
+	r := m.broker.NewReader(topic, groupId)
+	msgChan := make(chan kafka.Message)
+	go func() {
+		defer close(msgChan)
+		defer r.Close()
+		for {
+			msg, err := r.ReadMessage(m.ctx)
+			if err != nil {
+				return
+			}
+			select {
+			case msgChan <- msg:
+			case <-m.ctx.Done():
+				return
+			}
+		}
+	}()
+	return msgChan, nil
+}
+
+/* 以記憶體讀取器建立consumer Run結束時離開group */
+func (m *Manager) NewConsumer(conf ckafka.ConsumerConfig, handler ckafka.Handler) (*ckafka.Consumer, error) {
+	if conf.Topic == "" || conf.GroupId == "" {
+		return nil, errors.New("consumer topic and groupId are required")
+	}
+	return ckafka.NewConsumerWithReader(conf, handler, m.broker.NewReader(conf.Topic, conf.GroupId)), nil
+}
+
+func (m *Manager) NewAdmin() (*ckafka.Admin, error) {
+	return nil, ErrAdminUnsupported
+}
+
+func (m *Manager) Flush(ctx context.Context) error {
+	return nil
+}
+
+/* 結束NewReader建立的讀取器 */
+func (m *Manager) Close() error {
+	m.cancel()
+	return nil
+}
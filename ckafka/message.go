@@ -0,0 +1,209 @@
+package ckafka
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/rickylin614/common/zlog"
+	"github.com/segmentio/kafka-go"
+)
+
+// 訊息信封的header
+const (
+	HeaderMessageId     = "x-message-id"
+	HeaderMessageType   = "x-message-type"
+	HeaderMessageTime   = "x-message-time" // RFC3339Nano
+	HeaderSource        = "x-source"
+	HeaderSchemaVersion = "x-schema-version"
+	HeaderContentType   = "content-type"
+)
+
+// 寫入x-source的服務名稱 預設為執行檔名稱
+var ServiceName = filepath.Base(os.Args[0])
+
+var ErrDecode = errors.New("kafka message decode fail")
+
+// 訊息信封 放在kafka header中 value只有訊息本體
+type Envelope struct {
+	Id            string
+	Type          string
+	Time          time.Time
+	Source        string
+	SchemaVersion int
+	ContentType   string
+}
+
+/* 信封轉為kafka header */
+func (e Envelope) Headers() []kafka.Header {
+	return []kafka.Header{
+		{Key: HeaderMessageId, Value: []byte(e.Id)},
+		{Key: HeaderMessageType, Value: []byte(e.Type)},
+		{Key: HeaderMessageTime, Value: []byte(e.Time.Format(time.RFC3339Nano))},
+		{Key: HeaderSource, Value: []byte(e.Source)},
+		{Key: HeaderSchemaVersion, Value: []byte(strconv.Itoa(e.SchemaVersion))},
+		{Key: HeaderContentType, Value: []byte(e.ContentType)},
+	}
+}
+
+/* 由header取得信封 缺少的欄位為零值 */
+func EnvelopeOf(msg kafka.Message) Envelope {
+	e := Envelope{
+		Id:          GetHeader(msg, HeaderMessageId),
+		Type:        GetHeader(msg, HeaderMessageType),
+		Source:      GetHeader(msg, HeaderSource),
+		ContentType: GetHeader(msg, HeaderContentType),
+	}
+	e.Time, _ = time.Parse(time.RFC3339Nano, GetHeader(msg, HeaderMessageTime))
+	e.SchemaVersion, _ = strconv.Atoi(GetHeader(msg, HeaderSchemaVersion))
+	return e
+}
+
+type publishOptions struct {
+	key           []byte
+	codec         Codec
+	writer        MessageWriter
+	msgType       string
+	schemaVersion int
+	headers       []kafka.Header
+}
+
+type PublishOption func(*publishOptions)
+
+/* 訊息的key 同key寫入同partition */
+func WithKey(key string) PublishOption {
+	return func(o *publishOptions) { o.key = []byte(key) }
+}
+
+/* 編碼方式 預設JSONCodec */
+func WithCodec(c Codec) PublishOption {
+	return func(o *publishOptions) { o.codec = c }
+}
+
+/* 寫入器 預設使用Manage的寫入器 */
+func WithWriter(w MessageWriter) PublishOption {
+	return func(o *publishOptions) { o.writer = w }
+}
+
+/* 訊息型別 預設為T的型別名稱 */
+func WithMessageType(t string) PublishOption {
+	return func(o *publishOptions) { o.msgType = t }
+}
+
+/* schema版本 預設1 */
+func WithSchemaVersion(v int) PublishOption {
+	return func(o *publishOptions) { o.schemaVersion = v }
+}
+
+/* 額外的header */
+func WithHeader(key, value string) PublishOption {
+	return func(o *publishOptions) { o.headers = append(o.headers, kafka.Header{Key: key, Value: []byte(value)}) }
+}
+
+// 將Manage轉為MessageWriter
+type managerWriter struct{}
+
+func (managerWriter) Write(ctx context.Context, topic string, msgs ...kafka.Message) error {
+	return Manage.WriteMessages(ctx, topic, msgs...)
+}
+
+/* 編碼並加上信封後寫入topic 回傳寫入的信封 */
+func Publish[T any](ctx context.Context, topic string, v T, opts ...PublishOption) (Envelope, error) {
+	o := publishOptions{codec: JSONCodec, writer: managerWriter{}, schemaVersion: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.msgType == "" {
+		o.msgType = TypeName[T]()
+	}
+	value, err := o.codec.Marshal(v)
+	if err != nil {
+		return Envelope{}, err
+	}
+	e := Envelope{
+		Id:            NewMessageId(),
+		Type:          o.msgType,
+		Time:          time.Now(),
+		Source:        ServiceName,
+		SchemaVersion: o.schemaVersion,
+		ContentType:   o.codec.Name(),
+	}
+	msg := kafka.Message{Key: o.key, Value: value, Headers: append(e.Headers(), o.headers...)}
+	return e, o.writer.Write(ctx, topic, msg)
+}
+
+/* 依content-type解碼訊息 沒有content-type時視為JSON */
+func Decode[T any](msg kafka.Message) (Envelope, T, error) {
+	e := EnvelopeOf(msg)
+	var v T
+	codec := JSONCodec
+	if e.ContentType != "" {
+		if codec = GetCodec(e.ContentType); codec == nil {
+			return e, v, fmt.Errorf("%w: unknown content-type %s", ErrDecode, e.ContentType)
+		}
+	}
+	// T為指標時需先配置 例: protobuf的*pb.Order
+	target := interface{}(&v)
+	if rt := reflect.TypeOf(v); rt != nil && rt.Kind() == reflect.Ptr {
+		nv := reflect.New(rt.Elem())
+		reflect.ValueOf(&v).Elem().Set(nv)
+		target = nv.Interface()
+	}
+	if err := codec.Unmarshal(msg.Value, target); err != nil {
+		return e, v, fmt.Errorf("%w: %v", ErrDecode, err)
+	}
+	return e, v, nil
+}
+
+/*
+	建立解碼後處理的consumer 未設定Brokers時使用Manage的設定 需自行呼叫Run(ctx)
+	解碼失敗時回傳ErrDecode 交由OnError處理 例: 搭配RetryPolicy轉送到dlq
+	未設定OnError時記錄log後略過無法解碼的訊息 避免重試卡住同一partition
+*/
+func Subscribe[T any](conf ConsumerConfig, handler func(ctx context.Context, e Envelope, v T) error) (*Consumer, error) {
+	return Manage.NewConsumer(conf, decodeHandler(conf.OnError != nil, handler))
+}
+
+/* 解碼後呼叫handler hasOnError為false時解碼失敗直接commit */
+func decodeHandler[T any](hasOnError bool, handler func(ctx context.Context, e Envelope, v T) error) Handler {
+	return func(ctx context.Context, msg kafka.Message) error {
+		e, v, err := Decode[T](msg)
+		if err != nil {
+			if hasOnError {
+				return err
+			}
+			zlog.Errorf("kafka skip undecodable msg topic:%s partition:%d offset:%d err:%v", msg.Topic, msg.Partition, msg.Offset, err)
+			return nil
+		}
+		return handler(ctx, e, v)
+	}
+}
+
+/* 預設的訊息型別 T的型別名稱 指標取其元素 */
+func TypeName[T any]() string {
+	rt := reflect.TypeOf((*T)(nil)).Elem()
+	for rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	if rt.Name() == "" {
+		return rt.String()
+	}
+	return rt.Name()
+}
+
+/* 訊息id uuid v4格式 */
+func NewMessageId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	s := hex.EncodeToString(b)
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
@@ -0,0 +1,90 @@
+package ckafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type orderCreated struct {
+	Id     int64  `json:"id" msgpack:"id"`
+	Symbol string `json:"symbol" msgpack:"symbol"`
+}
+
+func TestPublishDecode(t *testing.T) {
+	ctx := context.Background()
+	for _, codec := range []Codec{JSONCodec, MsgpackCodec} {
+		w := &fakeWriter{}
+		e, err := Publish(ctx, "order", orderCreated{Id: 7, Symbol: "BTC"}, WithWriter(w), WithCodec(codec), WithKey("7"), WithSchemaVersion(2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.topics[0] != "order" || string(w.msgs[0].Key) != "7" {
+			t.Fatalf("unexpected write %s %s", w.topics[0], w.msgs[0].Key)
+		}
+		got, v, err := Decode[orderCreated](w.msgs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Id != 7 || v.Symbol != "BTC" {
+			t.Fatalf("%s: unexpected value %+v", codec.Name(), v)
+		}
+		if got.Id != e.Id || got.Type != "orderCreated" || got.SchemaVersion != 2 || got.Source != ServiceName ||
+			got.ContentType != codec.Name() || !got.Time.Equal(e.Time) {
+			t.Fatalf("%s: envelope %+v != %+v", codec.Name(), got, e)
+		}
+	}
+}
+
+func TestPublishDecode_Protobuf(t *testing.T) {
+	w := &fakeWriter{}
+	if _, err := Publish(context.Background(), "t", wrapperspb.String("hi"), WithWriter(w), WithCodec(ProtobufCodec)); err != nil {
+		t.Fatal(err)
+	}
+	e, v, err := Decode[*wrapperspb.StringValue](w.msgs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.GetValue() != "hi" || e.Type != "StringValue" {
+		t.Fatalf("unexpected %v %+v", v, e)
+	}
+
+	if _, err := Publish(context.Background(), "t", orderCreated{}, WithWriter(w), WithCodec(ProtobufCodec)); err == nil {
+		t.Fatal("non proto message should fail")
+	}
+}
+
+func TestDecode_Error(t *testing.T) {
+	msg := kafka.Message{Value: []byte("x"), Headers: []kafka.Header{{Key: HeaderContentType, Value: []byte("text/unknown")}}}
+	if _, _, err := Decode[orderCreated](msg); !errors.Is(err, ErrDecode) {
+		t.Fatalf("want ErrDecode, got %v", err)
+	}
+	// 沒有信封的舊訊息以JSON解碼
+	_, v, err := Decode[orderCreated](kafka.Message{Value: []byte(`{"id":1}`)})
+	if err != nil || v.Id != 1 {
+		t.Fatalf("unexpected %+v %v", v, err)
+	}
+}
+
+func TestDecodeHandler_Poison(t *testing.T) {
+	called := 0
+	handler := func(ctx context.Context, e Envelope, v orderCreated) error {
+		called++
+		return nil
+	}
+	poison := kafka.Message{Value: []byte("not json")}
+	// 未設定OnError時略過 讓consumer commit
+	if err := decodeHandler(false, handler)(context.Background(), poison); err != nil {
+		t.Fatalf("poison msg should be skipped, got %v", err)
+	}
+	// 有OnError時交由OnError處理
+	if err := decodeHandler(true, handler)(context.Background(), poison); !errors.Is(err, ErrDecode) {
+		t.Fatalf("want ErrDecode, got %v", err)
+	}
+	if err := decodeHandler(false, handler)(context.Background(), kafka.Message{Value: []byte(`{"id":1}`)}); err != nil || called != 1 {
+		t.Fatalf("unexpected %v called=%d", err, called)
+	}
+}
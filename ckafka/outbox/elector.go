@@ -0,0 +1,92 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+	"time"
+
+	"github.com/rickylin614/common/zlog"
+)
+
+/*
+	以資料庫的advisory lock選出leader 鎖綁定在連線上 連線中斷時自動釋放
+	mysql: GET_LOCK  postgres: pg_try_advisory_lock  其他(sqlite等單一程序): 直接成為leader
+*/
+type DBElector struct {
+	Source   string        // cgorm連線源 預設為預設連線源
+	Name     string        // 鎖名稱 預設outbox_relay
+	Interval time.Duration // 未取得鎖時的重試間隔及檢查連線的間隔 預設5s
+}
+
+func (e DBElector) Campaign(ctx context.Context) (context.Context, error) {
+	name, interval := e.Name, e.Interval
+	if name == "" {
+		name = "outbox_relay"
+	}
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	db := sourceDB(e.Source)
+	var lockSQL, unlockSQL string
+	var arg interface{}
+	switch db.Dialector.Name() {
+	case "mysql":
+		lockSQL, unlockSQL, arg = "SELECT GET_LOCK(?, 0) = 1", "SELECT RELEASE_LOCK(?)", name
+	case "postgres":
+		h := fnv.New64a()
+		h.Write([]byte(name))
+		lockSQL, unlockSQL, arg = "SELECT pg_try_advisory_lock($1)", "SELECT pg_advisory_unlock($1)", int64(h.Sum64())
+	default:
+		return ctx, nil
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		conn, err := sqlDB.Conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var got bool
+		if err = conn.QueryRowContext(ctx, lockSQL, arg).Scan(&got); err == nil && got {
+			leaderCtx, cancel := context.WithCancel(ctx)
+			go e.hold(leaderCtx, cancel, conn, interval, unlockSQL, arg)
+			return leaderCtx, nil
+		}
+		conn.Close()
+		if err != nil && ctx.Err() == nil {
+			zlog.Error("outbox elector lock fail:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+/* 定期檢查連線 連線中斷時鎖已失效 取消leaderCtx 結束時釋放鎖 */
+func (e DBElector) hold(ctx context.Context, cancel context.CancelFunc, conn *sql.Conn, interval time.Duration, unlockSQL string, arg interface{}) {
+	defer cancel()
+	defer conn.Close()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			releaseCtx, release := context.WithTimeout(context.Background(), 5*time.Second)
+			conn.ExecContext(releaseCtx, unlockSQL, arg)
+			release()
+			return
+		case <-ticker.C:
+			if err := conn.PingContext(ctx); err != nil && ctx.Err() == nil {
+				zlog.Error("outbox elector lost lock:", err)
+				return
+			}
+		}
+	}
+}
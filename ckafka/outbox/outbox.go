@@ -0,0 +1,300 @@
+// Package outbox 以transactional outbox保證資料庫異動與kafka訊息一致
+//
+// 業務資料與事件在同一個cgorm交易中寫入 由Relay讀取未發送的事件寫入kafka後標記已發送
+//
+//	err := cgorm.WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+//		if err := tx.Create(&order).Error; err != nil {
+//			return err
+//		}
+//		_, err := outbox.Add(tx, "order", strconv.FormatInt(order.Id, 10), OrderCreated{Id: order.Id})
+//		return err
+//	})
+//
+// 發送為at-least-once 重送的訊息有相同的x-message-id 讀取端需以此去重
+package outbox
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rickylin614/common/cgorm"
+	"github.com/rickylin614/common/ckafka"
+	"github.com/rickylin614/common/zlog"
+	"github.com/segmentio/kafka-go"
+	"gorm.io/gorm"
+)
+
+// 待發送的事件 需先AutoMigrate(&outbox.Event{})
+type Event struct {
+	Id            uint64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	MessageId     string     `gorm:"size:36;uniqueIndex" json:"messageId"` // 寫入x-message-id 重送時不變
+	Topic         string     `gorm:"size:255" json:"topic"`
+	AggregateId   string     `gorm:"size:255" json:"aggregateId"` // 作為訊息key 同aggregate依序發送
+	Type          string     `gorm:"size:255" json:"type"`
+	SchemaVersion int        `json:"schemaVersion"`
+	ContentType   string     `gorm:"size:64" json:"contentType"`
+	Payload       []byte     `json:"payload"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `gorm:"size:1024" json:"lastError"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	SentAt        *time.Time `gorm:"index" json:"sentAt"` // nil為未發送
+}
+
+func (Event) TableName() string {
+	return "outbox"
+}
+
+type addOptions struct {
+	codec         ckafka.Codec
+	msgType       string
+	schemaVersion int
+}
+
+type Option func(*addOptions)
+
+/* 編碼方式 預設ckafka.JSONCodec */
+func WithCodec(c ckafka.Codec) Option {
+	return func(o *addOptions) { o.codec = c }
+}
+
+/* 訊息型別 預設為T的型別名稱 */
+func WithMessageType(t string) Option {
+	return func(o *addOptions) { o.msgType = t }
+}
+
+/* schema版本 預設1 */
+func WithSchemaVersion(v int) Option {
+	return func(o *addOptions) { o.schemaVersion = v }
+}
+
+/* 在tx中新增事件 需與業務資料使用同一個交易 */
+func Add[T any](tx *gorm.DB, topic, aggregateId string, v T, opts ...Option) (*Event, error) {
+	o := addOptions{codec: ckafka.JSONCodec, schemaVersion: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.msgType == "" {
+		o.msgType = ckafka.TypeName[T]()
+	}
+	payload, err := o.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	e := &Event{
+		MessageId:     ckafka.NewMessageId(),
+		Topic:         topic,
+		AggregateId:   aggregateId,
+		Type:          o.msgType,
+		SchemaVersion: o.schemaVersion,
+		ContentType:   o.codec.Name(),
+		Payload:       payload,
+	}
+	if err = tx.Create(e).Error; err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+/* 轉為kafka訊息 信封的時間為事件建立時間 */
+func (e Event) Message() kafka.Message {
+	env := ckafka.Envelope{
+		Id:            e.MessageId,
+		Type:          e.Type,
+		Time:          e.CreatedAt,
+		Source:        ckafka.ServiceName,
+		SchemaVersion: e.SchemaVersion,
+		ContentType:   e.ContentType,
+	}
+	return kafka.Message{Key: []byte(e.AggregateId), Value: e.Payload, Headers: env.Headers()}
+}
+
+/*
+	多個relay同時執行時選出一個發送 避免同aggregate的事件亂序
+	Campaign阻塞直到成為leader 回傳的ctx在失去leader或ctx取消時結束
+*/
+type Elector interface {
+	Campaign(ctx context.Context) (context.Context, error)
+}
+
+// relay設定 未設定的欄位使用預設值
+type RelayConfig struct {
+	Source    string               // cgorm連線源 預設為預設連線源
+	Writer    ckafka.MessageWriter // 預設使用ckafka.Manage 需為同步寫入 非同步時回傳ErrAsyncWriter
+	Interval  time.Duration        // 沒有待發送事件時的輪詢間隔 預設1s
+	BatchSize int                  // 每次讀取的事件數 預設100
+	Retention time.Duration        // 已發送事件保留時間 0為不刪除
+	// 未設定時為單一relay輪詢 多個程序同時執行需設定
+	Elector Elector
+}
+
+/* 讀取outbox寫入kafka */
+type Relay struct {
+	conf RelayConfig
+}
+
+// 非同步寫入在送達前就回傳 事件會在送達前被標記已發送
+var ErrAsyncWriter = errors.New("outbox relay requires a synchronous kafka writer")
+
+// 可回報是否為非同步寫入的writer 例: *ckafka.Producer、*ckafka.Manager
+type asyncWriter interface {
+	Async() bool
+}
+
+func isAsync(w interface{}) bool {
+	aw, ok := w.(asyncWriter)
+	return ok && aw.Async()
+}
+
+// 將ckafka.Manage轉為MessageWriter
+type managerWriter struct{}
+
+func (managerWriter) Write(ctx context.Context, topic string, msgs ...kafka.Message) error {
+	return ckafka.Manage.WriteMessages(ctx, topic, msgs...)
+}
+
+func (managerWriter) Async() bool {
+	return isAsync(ckafka.Manage)
+}
+
+/* 建立relay 寫入器為非同步時回傳ErrAsyncWriter */
+func NewRelay(conf RelayConfig) (*Relay, error) {
+	if conf.Writer == nil {
+		conf.Writer = managerWriter{}
+	}
+	if isAsync(conf.Writer) {
+		return nil, ErrAsyncWriter
+	}
+	if conf.Interval <= 0 {
+		conf.Interval = time.Second
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = 100
+	}
+	return &Relay{conf: conf}, nil
+}
+
+/* 執行直到ctx取消 有設定Elector時只在成為leader期間發送 */
+func (r *Relay) Run(ctx context.Context) error {
+	if r.conf.Elector == nil {
+		r.poll(ctx)
+		return nil
+	}
+	for ctx.Err() == nil {
+		leaderCtx, err := r.conf.Elector.Campaign(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			zlog.Error("outbox relay campaign fail:", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(r.conf.Interval):
+			}
+			continue
+		}
+		zlog.Info("outbox relay become leader")
+		r.poll(leaderCtx)
+	}
+	return nil
+}
+
+func (r *Relay) poll(ctx context.Context) {
+	for ctx.Err() == nil {
+		n, err := r.RelayOnce(ctx)
+		if err != nil && ctx.Err() == nil {
+			zlog.Error("outbox relay fail:", err)
+		}
+		// 讀滿一批時可能還有待發送的事件 直接繼續
+		if err == nil && n >= r.conf.BatchSize {
+			continue
+		}
+		r.cleanup()
+		select {
+		case <-ctx.Done():
+		case <-time.After(r.conf.Interval):
+		}
+	}
+}
+
+/*
+	讀取一批未發送的事件依id順序寫入 成功的標記已發送 回傳讀取的數量
+	同topic一次寫入 寫入失敗時該topic的事件下次整批重送 保持同aggregate的順序
+	寫入器之後被改為非同步時(例: ckafka.Manage.SetConfig)回傳ErrAsyncWriter 不發送
+*/
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	if isAsync(r.conf.Writer) {
+		return 0, ErrAsyncWriter
+	}
+	db := sourceDB(r.conf.Source).WithContext(ctx)
+	var events []Event
+	if err := db.Where("sent_at IS NULL").Order("id").Limit(r.conf.BatchSize).Find(&events).Error; err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	topics := make([]string, 0)
+	msgs := make(map[string][]kafka.Message)
+	ids := make(map[string][]uint64)
+	for _, e := range events {
+		if _, ok := msgs[e.Topic]; !ok {
+			topics = append(topics, e.Topic)
+		}
+		msgs[e.Topic] = append(msgs[e.Topic], e.Message())
+		ids[e.Topic] = append(ids[e.Topic], e.Id)
+	}
+
+	var firstErr error
+	sent := make([]uint64, 0, len(events))
+	for _, topic := range topics {
+		if err := r.conf.Writer.Write(ctx, topic, msgs[topic]...); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			r.markFail(ids[topic], err)
+			continue
+		}
+		sent = append(sent, ids[topic]...)
+	}
+	if len(sent) > 0 {
+		// 標記失敗時下次重送 讀取端以x-message-id去重
+		err := sourceDB(r.conf.Source).Model(&Event{}).Where("id IN ?", sent).Update("sent_at", time.Now()).Error
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return len(events), firstErr
+}
+
+func (r *Relay) markFail(ids []uint64, err error) {
+	msg := err.Error()
+	if len(msg) > 1024 {
+		msg = msg[:1024]
+	}
+	res := sourceDB(r.conf.Source).Model(&Event{}).Where("id IN ?", ids).
+		Updates(map[string]interface{}{"attempts": gorm.Expr("attempts + 1"), "last_error": msg})
+	if res.Error != nil {
+		zlog.Error("outbox mark fail err:", res.Error)
+	}
+}
+
+/* Source為空時使用預設連線源 */
+func sourceDB(source string) *gorm.DB {
+	if source == "" {
+		return cgorm.GetDB()
+	}
+	return cgorm.GetDB(source)
+}
+
+/* 刪除超過保留時間的已發送事件 */
+func (r *Relay) cleanup() {
+	if r.conf.Retention <= 0 {
+		return
+	}
+	err := sourceDB(r.conf.Source).Where("sent_at < ?", time.Now().Add(-r.conf.Retention)).Delete(&Event{}).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		zlog.Error("outbox cleanup fail:", err)
+	}
+}
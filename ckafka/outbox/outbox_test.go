@@ -0,0 +1,211 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rickylin614/common/cgorm"
+	"github.com/rickylin614/common/ckafka"
+	"github.com/segmentio/kafka-go"
+	"gorm.io/gorm"
+)
+
+type order struct {
+	Id     int64 `gorm:"primaryKey"`
+	Amount int
+}
+
+type orderCreated struct {
+	Id     int64 `json:"id"`
+	Amount int   `json:"amount"`
+}
+
+type fakeWriter struct {
+	lock sync.Mutex
+	fail int // 前幾次寫入失敗
+	msgs []kafka.Message
+}
+
+func (w *fakeWriter) Write(ctx context.Context, topic string, msgs ...kafka.Message) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.fail > 0 {
+		w.fail--
+		return errors.New("broker down")
+	}
+	for _, m := range msgs {
+		m.Topic = topic
+		w.msgs = append(w.msgs, m)
+	}
+	return nil
+}
+
+func TestRelay(t *testing.T) {
+	if err := cgorm.NewMemoryDb("outbox"); err != nil {
+		t.Fatal(err)
+	}
+	db := cgorm.GetDB("outbox")
+	if err := db.AutoMigrate(&order{}, &Event{}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	for i := 1; i <= 3; i++ {
+		err := cgorm.WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+			o := order{Id: int64(i), Amount: i * 10}
+			if err := tx.Create(&o).Error; err != nil {
+				return err
+			}
+			_, err := Add(tx, "order", strconv.Itoa(i%2), orderCreated{Id: o.Id, Amount: o.Amount})
+			return err
+		}, cgorm.TxSource("outbox"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 交易rollback時事件也不寫入
+	cgorm.WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		if _, err := Add(tx, "order", "9", orderCreated{Id: 9}); err != nil {
+			return err
+		}
+		return errors.New("rollback")
+	}, cgorm.TxSource("outbox"))
+
+	w := &fakeWriter{fail: 1}
+	relay, err := NewRelay(RelayConfig{Source: "outbox", Writer: w, BatchSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := relay.RelayOnce(ctx); err == nil {
+		t.Fatal("first relay should fail")
+	}
+	var failed Event
+	db.First(&failed)
+	if failed.Attempts != 1 || failed.LastError != "broker down" || failed.SentAt != nil {
+		t.Fatalf("unexpected failed event %+v", failed)
+	}
+
+	for {
+		n, err := relay.RelayOnce(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+	}
+	if len(w.msgs) != 3 {
+		t.Fatalf("want 3 messages, got %d", len(w.msgs))
+	}
+	for i, m := range w.msgs {
+		e, v, err := ckafka.Decode[orderCreated](m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Id != int64(i+1) || m.Topic != "order" || string(m.Key) != strconv.Itoa((i+1)%2) || e.Type != "orderCreated" {
+			t.Fatalf("unexpected message %d: %+v %+v", i, v, e)
+		}
+	}
+	var events []Event
+	db.Order("id").Find(&events)
+	for i, e := range events {
+		if e.SentAt == nil || e.MessageId != ckafka.GetHeader(w.msgs[i], ckafka.HeaderMessageId) {
+			t.Fatalf("event %d not sent or id mismatch: %+v", i, e)
+		}
+	}
+}
+
+func TestDBElector_Sqlite(t *testing.T) {
+	if err := cgorm.NewMemoryDb("elector"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderCtx, err := DBElector{Source: "elector"}.Campaign(ctx)
+	if err != nil || leaderCtx.Err() != nil {
+		t.Fatalf("should be leader: %v", err)
+	}
+	cancel()
+	<-leaderCtx.Done()
+}
+
+func TestRelay_DefaultSource(t *testing.T) {
+	if err := cgorm.NewMemoryDb(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cgorm.GetDB().AutoMigrate(&Event{}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := cgorm.WithTx(ctx, func(ctx context.Context, tx *gorm.DB) error {
+		_, err := Add(tx, "order", "1", orderCreated{Id: 1})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &fakeWriter{}
+	relay, err := NewRelay(RelayConfig{Writer: w, Interval: 10 * time.Millisecond, Retention: time.Hour, Elector: DBElector{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- relay.Run(ctx) }()
+	for {
+		var pending int64
+		cgorm.GetDB().Model(&Event{}).Where("sent_at IS NULL").Count(&pending)
+		if pending == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("event not relayed on default source")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.msgs) != 1 {
+		t.Fatalf("want 1 message, got %d", len(w.msgs))
+	}
+}
+
+func TestNewRelay_Async(t *testing.T) {
+	p, err := ckafka.NewProducer([]string{"localhost:9092"}, ckafka.ProducerConfig{Async: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if _, err := NewRelay(RelayConfig{Writer: p}); !errors.Is(err, ErrAsyncWriter) {
+		t.Fatalf("want ErrAsyncWriter, got %v", err)
+	}
+
+	// 建立後才改為非同步時不發送
+	w := &switchWriter{}
+	relay, err := NewRelay(RelayConfig{Writer: w})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.async = true
+	if _, err := relay.RelayOnce(context.Background()); !errors.Is(err, ErrAsyncWriter) {
+		t.Fatalf("want ErrAsyncWriter, got %v", err)
+	}
+}
+
+type switchWriter struct {
+	fakeWriter
+	async bool
+}
+
+func (w *switchWriter) Async() bool {
+	return w.async
+}
@@ -0,0 +1,341 @@
+package ckafka
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rickylin614/common/zlog"
+	"github.com/segmentio/kafka-go"
+	"go.elastic.co/apm"
+)
+
+var ErrProducerClosed = errors.New("kafka producer closed")
+
+// 寫入器設定 未設定的欄位使用預設值
+type ProducerConfig struct {
+	BatchSize    int           `yaml:"batchSize"`    // 每批最多訊息數 預設100
+	BatchBytes   int64         `yaml:"batchBytes"`   // 每批最大bytes 預設1MB
+	BatchTimeout time.Duration `yaml:"batchTimeout"` // 未滿一批時最多等待時間 預設100ms
+	Compression  string        `yaml:"compression"`  // gzip/snappy/lz4/zstd 預設不壓縮
+	RequiredAcks string        `yaml:"requiredAcks"` // none/one/all 預設one
+	MaxAttempts  int           `yaml:"maxAttempts"`  // 失敗重試次數 預設10
+	WriteTimeout time.Duration `yaml:"writeTimeout"` // 預設10s
+	Balancer     string        `yaml:"balancer"`     // leastbytes/hash/roundrobin 預設leastbytes hash時同key寫入同partition
+	// 非同步寫入 Write不等待結果 結果由OnDelivery回傳
+	Async bool `yaml:"async"`
+	// 每批寫入完成時呼叫 err為nil表示成功 同步模式也會呼叫
+	OnDelivery func(messages []kafka.Message, err error) `yaml:"-"`
+	// 連線設定(clientId、SASL、TLS) 未設定時使用kafka.DefaultTransport
+	Transport kafka.RoundTripper `yaml:"-"`
+}
+
+func (c ProducerConfig) withDefault() ProducerConfig {
+	if c.BatchSize == 0 {
+		c.BatchSize = 100
+	}
+	if c.BatchBytes == 0 {
+		c.BatchBytes = 1 << 20
+	}
+	if c.BatchTimeout == 0 {
+		c.BatchTimeout = 100 * time.Millisecond
+	}
+	if c.RequiredAcks == "" {
+		c.RequiredAcks = "one"
+	}
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = 10
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = 10 * time.Second
+	}
+	if c.Balancer == "" {
+		c.Balancer = "leastbytes"
+	}
+	return c
+}
+
+/* 未設定的欄位使用def的值 Async任一方開啟即為非同步 */
+func (c ProducerConfig) merge(def ProducerConfig) ProducerConfig {
+	if c.BatchSize == 0 {
+		c.BatchSize = def.BatchSize
+	}
+	if c.BatchBytes == 0 {
+		c.BatchBytes = def.BatchBytes
+	}
+	if c.BatchTimeout == 0 {
+		c.BatchTimeout = def.BatchTimeout
+	}
+	if c.Compression == "" {
+		c.Compression = def.Compression
+	}
+	if c.RequiredAcks == "" {
+		c.RequiredAcks = def.RequiredAcks
+	}
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = def.MaxAttempts
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = def.WriteTimeout
+	}
+	if c.Balancer == "" {
+		c.Balancer = def.Balancer
+	}
+	c.Async = c.Async || def.Async
+	if c.OnDelivery == nil {
+		c.OnDelivery = def.OnDelivery
+	}
+	if c.Transport == nil {
+		c.Transport = def.Transport
+	}
+	return c
+}
+
+func (c ProducerConfig) compression() (kafka.Compression, error) {
+	switch strings.ToLower(c.Compression) {
+	case "", "none":
+		return 0, nil
+	case "gzip":
+		return kafka.Gzip, nil
+	case "snappy":
+		return kafka.Snappy, nil
+	case "lz4":
+		return kafka.Lz4, nil
+	case "zstd":
+		return kafka.Zstd, nil
+	default:
+		return 0, errors.New("unsupported kafka compression: " + c.Compression)
+	}
+}
+
+func (c ProducerConfig) requiredAcks() (kafka.RequiredAcks, error) {
+	switch strings.ToLower(c.RequiredAcks) {
+	case "none", "0":
+		return kafka.RequireNone, nil
+	case "one", "1":
+		return kafka.RequireOne, nil
+	case "all", "-1":
+		return kafka.RequireAll, nil
+	default:
+		return 0, errors.New("unsupported kafka requiredAcks: " + c.RequiredAcks)
+	}
+}
+
+/* 每個寫入器各自建立 hash/roundrobin有內部狀態 */
+func (c ProducerConfig) balancer() (kafka.Balancer, error) {
+	switch strings.ToLower(c.Balancer) {
+	case "hash":
+		return &kafka.Hash{}, nil
+	case "leastbytes":
+		return &kafka.LeastBytes{}, nil
+	case "roundrobin":
+		return &kafka.RoundRobin{}, nil
+	default:
+		return nil, errors.New("unsupported kafka balancer: " + c.Balancer)
+	}
+}
+
+func (c ProducerConfig) validate() error {
+	if _, err := c.compression(); err != nil {
+		return err
+	}
+	if _, err := c.balancer(); err != nil {
+		return err
+	}
+	_, err := c.requiredAcks()
+	return err
+}
+
+/*
+	長駐的寫入器 每個topic保留一個kafka.Writer 批次送出
+	關機前需呼叫Close 送出所有未完成的訊息
+*/
+type Producer struct {
+	brokers []string
+	conf    ProducerConfig
+	lock    sync.Mutex
+	writers map[string]*kafka.Writer
+	closed  bool
+	pending int64          // 非同步模式尚未完成的訊息數
+	writing sync.WaitGroup // 寫入中的呼叫 Close等待完成後才關閉寫入器
+}
+
+func NewProducer(brokers []string, conf ProducerConfig) (*Producer, error) {
+	if len(brokers) == 0 {
+		return nil, errors.New("not setting kafka.brokers")
+	}
+	conf = conf.withDefault()
+	if err := conf.validate(); err != nil {
+		return nil, err
+	}
+	return &Producer{
+		brokers: brokers,
+		conf:    conf,
+		writers: make(map[string]*kafka.Writer),
+	}, nil
+}
+
+/* 開始一次寫入 已關閉時回傳ErrProducerClosed 完成後需呼叫p.writing.Done() */
+func (p *Producer) begin() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return ErrProducerClosed
+	}
+	p.writing.Add(1)
+	return nil
+}
+
+/* 取得topic的寫入器 不存在時建立 寫入器在寫入中的呼叫完成前不會關閉 */
+func (p *Producer) writer(topic string) (*kafka.Writer, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.writers == nil {
+		return nil, ErrProducerClosed
+	}
+	if w, ok := p.writers[topic]; ok {
+		return w, nil
+	}
+	compression, _ := p.conf.compression()
+	acks, _ := p.conf.requiredAcks()
+	balancer, _ := p.conf.balancer()
+	w := &kafka.Writer{
+		Addr:         kafka.TCP(p.brokers...),
+		Topic:        topic,
+		Balancer:     balancer,
+		MaxAttempts:  p.conf.MaxAttempts,
+		BatchSize:    p.conf.BatchSize,
+		BatchBytes:   p.conf.BatchBytes,
+		BatchTimeout: p.conf.BatchTimeout,
+		WriteTimeout: p.conf.WriteTimeout,
+		RequiredAcks: acks,
+		Compression:  compression,
+		Async:        p.conf.Async,
+		Completion:   p.completion,
+		Transport:    p.conf.Transport,
+	}
+	p.writers[topic] = w
+	return w, nil
+}
+
+func (p *Producer) completion(messages []kafka.Message, err error) {
+	if p.conf.Async {
+		atomic.AddInt64(&p.pending, -int64(len(messages)))
+		if err != nil {
+			zlog.Error("kafka async write fail:", err)
+		}
+	}
+	if p.conf.OnDelivery != nil {
+		p.conf.OnDelivery(messages, err)
+	}
+}
+
+/* 寫入單一topic 訊息不需設定Topic */
+func (p *Producer) Write(ctx context.Context, topic string, msgs ...kafka.Message) error {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.writing.Done()
+	return p.write(ctx, topic, msgs...)
+}
+
+func (p *Producer) write(ctx context.Context, topic string, msgs ...kafka.Message) error {
+	w, err := p.writer(topic)
+	if err != nil {
+		return err
+	}
+	span, ctx := startSendSpan(ctx, topic)
+	if span != nil {
+		defer span.End()
+	}
+	// 複製後再清除topic及寫入header 不修改呼叫端的訊息
+	msgs = append([]kafka.Message(nil), msgs...)
+	for i := range msgs {
+		msgs[i].Topic = ""
+		msgs[i].Headers = InjectTrace(ctx, msgs[i].Headers)
+	}
+	if p.conf.Async {
+		atomic.AddInt64(&p.pending, int64(len(msgs)))
+	}
+	if err = w.WriteMessages(ctx, msgs...); err != nil {
+		if p.conf.Async {
+			atomic.AddInt64(&p.pending, -int64(len(msgs)))
+		}
+		zlog.Error("failed to write messages:", err)
+		if span != nil {
+			apm.CaptureError(ctx, err).Send()
+		}
+	}
+	return err
+}
+
+/* 同一則訊息寫入多個topic 各topic並行寫入 回傳第一個錯誤 */
+func (p *Producer) WriteMultiTopic(ctx context.Context, msg kafka.Message, topics []string) error {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	defer p.writing.Done()
+	errs := make(chan error, len(topics))
+	for _, topic := range topics {
+		go func(topic string) {
+			errs <- p.write(ctx, topic, msg)
+		}(topic)
+	}
+	var firstErr error
+	for range topics {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+/* 是否為非同步寫入 */
+func (p *Producer) Async() bool {
+	return p.conf.Async
+}
+
+/* 等待非同步模式的訊息全部送出 同步模式直接回傳 */
+func (p *Producer) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&p.pending) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+/* 等待寫入中的呼叫 送出未完成的訊息並關閉所有寫入器 */
+func (p *Producer) Close() error {
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.lock.Unlock()
+	p.writing.Wait()
+
+	p.lock.Lock()
+	writers := p.writers
+	p.writers = nil
+	p.lock.Unlock()
+
+	var firstErr error
+	for topic, w := range writers {
+		if err := w.Close(); err != nil {
+			zlog.Error("failed to close writer:", topic, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,120 @@
+package ckafka
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.elastic.co/apm/apmtest"
+)
+
+func TestProducerConfig(t *testing.T) {
+	if _, err := NewProducer(nil, ProducerConfig{}); err == nil {
+		t.Fatal("want error without brokers")
+	}
+	if _, err := NewProducer([]string{"localhost:9092"}, ProducerConfig{Compression: "brotli"}); err == nil {
+		t.Fatal("want error for unsupported compression")
+	}
+	if _, err := NewProducer([]string{"localhost:9092"}, ProducerConfig{RequiredAcks: "two"}); err == nil {
+		t.Fatal("want error for unsupported acks")
+	}
+
+	p, err := NewProducer([]string{"localhost:9092"}, ProducerConfig{Compression: "zstd", RequiredAcks: "all", Async: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := p.writer("t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Compression != kafka.Zstd || w.RequiredAcks != kafka.RequireAll || !w.Async || w.BatchSize != 100 || w.Topic != "t1" {
+		t.Fatalf("unexpected writer %+v", w)
+	}
+	if _, ok := w.Balancer.(*kafka.LeastBytes); !ok {
+		t.Fatalf("default balancer should be leastbytes, got %T", w.Balancer)
+	}
+	if w2, _ := p.writer("t1"); w2 != w {
+		t.Fatal("writer should be reused per topic")
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Write(context.Background(), "t1", kafka.Message{Value: []byte("a")}); err != ErrProducerClosed {
+		t.Fatalf("want ErrProducerClosed, got %v", err)
+	}
+}
+
+func TestProducerFlush(t *testing.T) {
+	var delivered int32
+	p, _ := NewProducer([]string{"localhost:9092"}, ProducerConfig{
+		Async: true,
+		OnDelivery: func(messages []kafka.Message, err error) {
+			atomic.AddInt32(&delivered, int32(len(messages)))
+		},
+	})
+	atomic.AddInt64(&p.pending, 2)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		p.completion(make([]kafka.Message, 2), nil)
+	}()
+	if err := p.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if atomic.LoadInt32(&delivered) != 2 {
+		t.Fatal("OnDelivery not called")
+	}
+
+	atomic.AddInt64(&p.pending, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := p.Flush(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("want deadline exceeded, got %v", err)
+	}
+}
+
+func TestProducerWriteKeepsMessages(t *testing.T) {
+	p, err := NewProducer([]string{"localhost:9092"}, ProducerConfig{Async: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+	msgs := []kafka.Message{{Topic: "other", Value: []byte("a"), Headers: []kafka.Header{{Key: "a", Value: []byte("1")}}}}
+	tracer.WithTransaction(func(ctx context.Context) {
+		p.Write(ctx, "t1", msgs...)
+	})
+	if msgs[0].Topic != "other" || len(msgs[0].Headers) != 1 {
+		t.Fatalf("caller's message modified: %+v", msgs[0])
+	}
+}
+
+func TestProducerCloseWaitsWriting(t *testing.T) {
+	p, _ := NewProducer([]string{"localhost:9092"}, ProducerConfig{})
+	if err := p.begin(); err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{})
+	go func() {
+		p.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close should wait for writing calls")
+	case <-time.After(20 * time.Millisecond):
+	}
+	if err := p.Write(context.Background(), "t1"); err != ErrProducerClosed {
+		t.Fatalf("new writes after Close: want ErrProducerClosed, got %v", err)
+	}
+	p.writing.Done()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close not returned")
+	}
+}
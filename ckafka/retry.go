@@ -0,0 +1,265 @@
+package ckafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rickylin614/common/zlog"
+	"github.com/segmentio/kafka-go"
+)
+
+// 重試相關的header
+const (
+	HeaderRetryAttempt  = "x-retry-attempt"  // 已重試次數
+	HeaderRetryError    = "x-retry-error"    // 最後一次的錯誤訊息
+	HeaderOriginalTopic = "x-original-topic" // 原始topic
+	HeaderReplayed      = "x-replayed"       // 由dlq重新投遞的次數
+)
+
+/* 寫入訊息 *Producer實作此介面 */
+type MessageWriter interface {
+	Write(ctx context.Context, topic string, msgs ...kafka.Message) error
+}
+
+/*
+	失敗訊息依序轉送到各重試topic 例: order.retry.1m、order.retry.10m
+	重試次數超過MaxAttempts後轉送到dead-letter topic 例: order.dlq
+*/
+type RetryPolicy struct {
+	Writer      MessageWriter
+	Tiers       []time.Duration // 各次重試的延遲 預設1m、10m 重試次數超過層數時使用最後一層
+	MaxAttempts int             // 最多重試次數 預設為Tiers的數量
+}
+
+func (p RetryPolicy) withDefault() RetryPolicy {
+	if len(p.Tiers) == 0 {
+		p.Tiers = []time.Duration{time.Minute, 10 * time.Minute}
+	}
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = len(p.Tiers)
+	}
+	return p
+}
+
+/* 重試topic名稱 例: RetryTopic("order", time.Minute) => "order.retry.1m" */
+func RetryTopic(topic string, delay time.Duration) string {
+	return topic + ".retry." + formatDelay(delay)
+}
+
+/* dead-letter topic名稱 例: "order.dlq" */
+func DLQTopic(topic string) string {
+	return topic + ".dlq"
+}
+
+func formatDelay(d time.Duration) string {
+	switch {
+	case d >= time.Hour && d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d >= time.Minute && d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	case d >= time.Second && d%time.Second == 0:
+		return fmt.Sprintf("%ds", d/time.Second)
+	default:
+		return fmt.Sprintf("%dms", d/time.Millisecond)
+	}
+}
+
+/*
+	作為ConsumerConfig.OnError使用 將失敗的訊息轉送到下一層重試topic或dlq
+	轉送成功回傳nil 原訊息即可commit
+*/
+func (p RetryPolicy) OnError(ctx context.Context, msg kafka.Message, handleErr error) error {
+	// ctx取消造成的失敗不轉送 未commit的訊息下次重新讀取
+	if ctx.Err() != nil {
+		return handleErr
+	}
+	p = p.withDefault()
+	if p.Writer == nil {
+		return errors.New("retry policy writer is nil")
+	}
+	original := GetHeader(msg, HeaderOriginalTopic)
+	if original == "" {
+		original = msg.Topic
+	}
+	attempt, _ := strconv.Atoi(GetHeader(msg, HeaderRetryAttempt))
+
+	next := kafka.Message{
+		Key:     msg.Key,
+		Value:   msg.Value,
+		Headers: copyHeaders(msg.Headers),
+	}
+	next.Headers = SetHeader(next.Headers, HeaderOriginalTopic, original)
+	next.Headers = SetHeader(next.Headers, HeaderRetryError, handleErr.Error())
+
+	var topic string
+	if attempt >= p.MaxAttempts {
+		topic = DLQTopic(original)
+	} else {
+		tier := attempt
+		if tier >= len(p.Tiers) {
+			tier = len(p.Tiers) - 1
+		}
+		topic = RetryTopic(original, p.Tiers[tier])
+		next.Headers = SetHeader(next.Headers, HeaderRetryAttempt, strconv.Itoa(attempt+1))
+	}
+	zlog.Warnf("kafka msg move to %s attempt:%d err:%v", topic, attempt, handleErr)
+	return p.Writer.Write(ctx, topic, next)
+}
+
+/*
+	同時讀取主topic及各層重試topic 重試topic的訊息等到寫入時間+延遲後才處理
+	conf.OnError會被RetryPolicy取代 policy.Writer未設定時以conf.Brokers建立Producer
+*/
+func RunWithRetry(ctx context.Context, conf ConsumerConfig, handler Handler, policy RetryPolicy) error {
+	policy = policy.withDefault()
+	if policy.Writer == nil {
+		p, err := NewProducer(conf.Brokers, ProducerConfig{RequiredAcks: "all", Transport: transportOf(conf.Dialer)})
+		if err != nil {
+			return err
+		}
+		defer p.Close()
+		policy.Writer = p
+	}
+	conf.OnError = policy.OnError
+
+	consumers := make([]*Consumer, 0, len(policy.Tiers)+1)
+	c, err := NewConsumer(conf, handler)
+	if err != nil {
+		return err
+	}
+	consumers = append(consumers, c)
+	for _, delay := range policy.Tiers {
+		retryConf := conf
+		retryConf.Topic = RetryTopic(conf.Topic, delay)
+		c, err := NewConsumer(retryConf, delayHandler(delay, handler))
+		if err != nil {
+			return err
+		}
+		consumers = append(consumers, c)
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range consumers {
+		wg.Add(1)
+		go func(c *Consumer) {
+			defer wg.Done()
+			c.Run(ctx)
+		}(c)
+	}
+	wg.Wait()
+	return nil
+}
+
+/* 等到訊息寫入時間+delay後才處理 同partition的訊息依寫入時間排序 等待時不影響順序 */
+func delayHandler(delay time.Duration, handler Handler) Handler {
+	return func(ctx context.Context, msg kafka.Message) error {
+		if wait := time.Until(msg.Time.Add(delay)); wait > 0 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		return handler(ctx, msg)
+	}
+}
+
+/*
+	將conf.Topic的dlq訊息重新投遞到原topic 重試次數歸零
+	以conf.GroupId記錄進度 limit<=0時不限制數量 idle時間內沒有新訊息即結束 回傳投遞數量
+	第一則訊息包含加入group的時間 最多等待RebalanceTimeout+idle
+*/
+func ReplayDLQ(ctx context.Context, conf ConsumerConfig, limit int, idle time.Duration) (int, error) {
+	if idle <= 0 {
+		idle = 5 * time.Second
+	}
+	if conf.Topic == "" || conf.GroupId == "" {
+		return 0, errors.New("consumer topic and groupId are required")
+	}
+	if err := conf.validate(); err != nil {
+		return 0, err
+	}
+	p, err := NewProducer(conf.Brokers, ProducerConfig{RequiredAcks: "all", Transport: transportOf(conf.Dialer)})
+	if err != nil {
+		return 0, err
+	}
+	defer p.Close()
+	topic := conf.Topic
+	conf.Topic = DLQTopic(topic)
+	conf = conf.withDefault()
+	reader := kafka.NewReader(conf.readerConfig())
+	defer reader.Close()
+	return replay(ctx, reader, p, topic, limit, idle, conf.RebalanceTimeout+idle)
+}
+
+/* 第一則訊息最多等待join 之後每則最多等待idle */
+func replay(ctx context.Context, reader MessageReader, w MessageWriter, topic string, limit int, idle, join time.Duration) (int, error) {
+	count := 0
+	for limit <= 0 || count < limit {
+		timeout := idle
+		if count == 0 {
+			timeout = join
+		}
+		fetchCtx, cancel := context.WithTimeout(ctx, timeout)
+		msg, err := reader.FetchMessage(fetchCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded) {
+				return count, nil
+			}
+			return count, err
+		}
+
+		target := GetHeader(msg, HeaderOriginalTopic)
+		if target == "" {
+			target = topic
+		}
+		replayed, _ := strconv.Atoi(GetHeader(msg, HeaderReplayed))
+		headers := make([]kafka.Header, 0, len(msg.Headers))
+		for _, h := range msg.Headers {
+			if h.Key != HeaderRetryAttempt && h.Key != HeaderRetryError {
+				headers = append(headers, h)
+			}
+		}
+		headers = SetHeader(headers, HeaderReplayed, strconv.Itoa(replayed+1))
+		if err = w.Write(ctx, target, kafka.Message{Key: msg.Key, Value: msg.Value, Headers: headers}); err != nil {
+			return count, err
+		}
+		if err = reader.CommitMessages(ctx, msg); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+/* 取得header的值 不存在時為空字串 */
+func GetHeader(msg kafka.Message, key string) string {
+	for i := len(msg.Headers) - 1; i >= 0; i-- {
+		if msg.Headers[i].Key == key {
+			return string(msg.Headers[i].Value)
+		}
+	}
+	return ""
+}
+
+/* 設定header 已存在時覆蓋 */
+func SetHeader(headers []kafka.Header, key, value string) []kafka.Header {
+	for i := range headers {
+		if headers[i].Key == key {
+			headers[i].Value = []byte(value)
+			return headers
+		}
+	}
+	return append(headers, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+func copyHeaders(headers []kafka.Header) []kafka.Header {
+	return append(make([]kafka.Header, 0, len(headers)+3), headers...)
+}
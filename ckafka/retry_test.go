@@ -0,0 +1,114 @@
+package ckafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+type fakeWriter struct {
+	lock   sync.Mutex
+	topics []string
+	msgs   []kafka.Message
+}
+
+func (w *fakeWriter) Write(ctx context.Context, topic string, msgs ...kafka.Message) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for _, m := range msgs {
+		w.topics = append(w.topics, topic)
+		w.msgs = append(w.msgs, m)
+	}
+	return nil
+}
+
+func TestRetryPolicy_OnError(t *testing.T) {
+	w := &fakeWriter{}
+	policy := RetryPolicy{Writer: w}
+	ctx := context.Background()
+
+	msg := kafka.Message{Topic: "order", Key: []byte("k"), Value: []byte("v"), Headers: []kafka.Header{{Key: "trace", Value: []byte("1")}}}
+	want := []string{"order.retry.1m", "order.retry.10m", "order.dlq"}
+	for i, topic := range want {
+		if err := policy.OnError(ctx, msg, errors.New("boom")); err != nil {
+			t.Fatal(err)
+		}
+		if w.topics[i] != topic {
+			t.Fatalf("attempt %d: want %s, got %s", i, topic, w.topics[i])
+		}
+		msg = w.msgs[i]
+		msg.Topic = topic
+	}
+	if GetHeader(msg, HeaderOriginalTopic) != "order" || GetHeader(msg, HeaderRetryError) != "boom" ||
+		GetHeader(msg, HeaderRetryAttempt) != "2" || GetHeader(msg, "trace") != "1" {
+		t.Fatalf("unexpected headers: %v", msg.Headers)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := policy.OnError(canceled, msg, context.Canceled); err == nil || len(w.msgs) != 3 {
+		t.Fatal("canceled message should not be forwarded")
+	}
+}
+
+func TestDelayHandler(t *testing.T) {
+	delay := 50 * time.Millisecond
+	var handled time.Time
+	h := delayHandler(delay, func(ctx context.Context, msg kafka.Message) error {
+		handled = time.Now()
+		return nil
+	})
+	written := time.Now()
+	if err := h(context.Background(), kafka.Message{Time: written}); err != nil {
+		t.Fatal(err)
+	}
+	if handled.Sub(written) < delay {
+		t.Fatalf("handled too early: %v", handled.Sub(written))
+	}
+}
+
+func TestReplay(t *testing.T) {
+	reader := newFakeReader(
+		kafka.Message{Topic: "order.dlq", Offset: 0, Value: []byte("a"), Headers: []kafka.Header{
+			{Key: HeaderOriginalTopic, Value: []byte("order")},
+			{Key: HeaderRetryAttempt, Value: []byte("2")},
+			{Key: HeaderRetryError, Value: []byte("boom")},
+		}},
+		kafka.Message{Topic: "order.dlq", Offset: 1, Value: []byte("b")},
+	)
+	w := &fakeWriter{}
+	count, err := replay(context.Background(), reader, w, "order", 0, 20*time.Millisecond, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 || reader.lastCommit() != 1 {
+		t.Fatalf("count %d last commit %d", count, reader.lastCommit())
+	}
+	for i, m := range w.msgs {
+		if w.topics[i] != "order" || GetHeader(m, HeaderRetryAttempt) != "" || GetHeader(m, HeaderReplayed) != "1" {
+			t.Fatalf("unexpected replay %s %v", w.topics[i], m.Headers)
+		}
+	}
+}
+
+func TestReplay_JoinTimeout(t *testing.T) {
+	reader := newFakeReader()
+	reader.msgs = make(chan kafka.Message, 1)
+	// 加入group較慢 第一則訊息晚於idle才到
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		reader.msgs <- kafka.Message{Topic: "order.dlq", Value: []byte("a")}
+	}()
+	w := &fakeWriter{}
+	count, err := replay(context.Background(), reader, w, "order", 0, 10*time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("want 1 replayed, got %d", count)
+	}
+}
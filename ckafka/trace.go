@@ -0,0 +1,68 @@
+package ckafka
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/segmentio/kafka-go"
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/module/apmhttp"
+)
+
+// W3C trace context的header
+const (
+	HeaderTraceparent = "traceparent"
+	HeaderTracestate  = "tracestate"
+)
+
+/* 將ctx中目前的apm span(沒有時為transaction)寫入traceparent/tracestate header 回傳新的slice 不修改原本的headers ctx沒有apm交易時原樣回傳 */
+func InjectTrace(ctx context.Context, headers []kafka.Header) []kafka.Header {
+	var tc apm.TraceContext
+	if span := apm.SpanFromContext(ctx); span != nil && !span.Dropped() {
+		tc = span.TraceContext()
+	} else if tx := apm.TransactionFromContext(ctx); tx != nil {
+		tc = tx.TraceContext()
+	} else {
+		return headers
+	}
+	headers = SetHeader(copyHeaders(headers), HeaderTraceparent, apmhttp.FormatTraceparentHeader(tc))
+	if state := tc.State.String(); state != "" {
+		headers = SetHeader(headers, HeaderTracestate, state)
+	}
+	return headers
+}
+
+/* 寫入時的apm exit span ctx沒有apm交易時回傳nil */
+func startSendSpan(ctx context.Context, topic string) (*apm.Span, context.Context) {
+	if apm.TransactionFromContext(ctx) == nil {
+		return nil, ctx
+	}
+	span, ctx := apm.StartSpanOptions(ctx, "Kafka SEND to "+topic, "messaging", apm.SpanOptions{ExitSpan: true})
+	span.Subtype = "kafka"
+	span.Action = "send"
+	span.Context.SetMessage(apm.MessageSpanContext{QueueName: topic})
+	span.Context.SetDestinationService(apm.DestinationServiceSpanContext{Name: "kafka", Resource: "kafka/" + topic})
+	return span, ctx
+}
+
+/*
+	每則訊息開始一個apm transaction 有traceparent header時接續寫入端的trace
+	Consumer會自動建立 使用NewReader時可自行呼叫 處理完需呼叫tx.End()
+*/
+func StartTransaction(ctx context.Context, msg kafka.Message) (*apm.Transaction, context.Context) {
+	var opts apm.TransactionOptions
+	if h := GetHeader(msg, HeaderTraceparent); h != "" {
+		if tc, err := apmhttp.ParseTraceparentHeader(h); err == nil {
+			tc.State, _ = apmhttp.ParseTracestateHeader(GetHeader(msg, HeaderTracestate))
+			opts.TraceContext = tc
+		}
+	}
+	tx := apm.DefaultTracer.StartTransactionOptions("Kafka RECEIVE from "+msg.Topic, "messaging", opts)
+	tx.Context.SetLabel("topic", msg.Topic)
+	tx.Context.SetLabel("partition", strconv.Itoa(msg.Partition))
+	tx.Context.SetLabel("offset", strconv.FormatInt(msg.Offset, 10))
+	if id := GetHeader(msg, HeaderMessageId); id != "" {
+		tx.Context.SetLabel("message_id", id)
+	}
+	return tx, apm.ContextWithTransaction(ctx, tx)
+}
@@ -0,0 +1,81 @@
+package ckafka
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"go.elastic.co/apm"
+	"go.elastic.co/apm/apmtest"
+	"go.elastic.co/apm/module/apmhttp"
+)
+
+func TestInjectTrace(t *testing.T) {
+	headers := []kafka.Header{{Key: "a", Value: []byte("1")}}
+	if got := InjectTrace(context.Background(), headers); len(got) != 1 {
+		t.Fatalf("no transaction should keep headers, got %v", got)
+	}
+
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+	var tc apm.TraceContext
+	var got []kafka.Header
+	tracer.WithTransaction(func(ctx context.Context) {
+		span, ctx := apm.StartSpan(ctx, "send", "messaging")
+		defer span.End()
+		tc = span.TraceContext()
+		got = InjectTrace(ctx, headers)
+	})
+	if len(headers) != 1 {
+		t.Fatal("original headers should not be modified")
+	}
+	if v := GetHeader(kafka.Message{Headers: got}, HeaderTraceparent); v != apmhttp.FormatTraceparentHeader(tc) {
+		t.Fatalf("traceparent %q", v)
+	}
+}
+
+func TestStartTransaction(t *testing.T) {
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+	old := apm.DefaultTracer
+	apm.DefaultTracer = tracer.Tracer
+	defer func() { apm.DefaultTracer = old }()
+
+	parent := apm.TraceContext{Trace: apm.TraceID{1, 2, 3}, Span: apm.SpanID{4, 5, 6}, Options: apm.TraceOptions(0).WithRecorded(true)}
+	msg := kafka.Message{Topic: "order", Partition: 1, Offset: 7}
+	msg.Headers = SetHeader(msg.Headers, HeaderTraceparent, apmhttp.FormatTraceparentHeader(parent))
+
+	var traceId apm.TraceID
+	handler := func(ctx context.Context, msg kafka.Message) error {
+		traceId = apm.TransactionFromContext(ctx).TraceContext().Trace
+		return nil
+	}
+	reader := newFakeReader(msg)
+	c := newConsumer(ConsumerConfig{Concurrency: 1}, handler, reader)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- c.Run(ctx) }()
+	deadline := time.Now().Add(2 * time.Second)
+	for reader.lastCommit() != 7 {
+		if time.Now().After(deadline) {
+			t.Fatal("message not committed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if traceId != parent.Trace {
+		t.Fatalf("handler trace %v, want %v", traceId, parent.Trace)
+	}
+	tracer.Flush(nil)
+	txs := tracer.Payloads().Transactions
+	if len(txs) != 1 {
+		t.Fatalf("want 1 transaction, got %d", len(txs))
+	}
+	tx := txs[0]
+	if tx.Name != "Kafka RECEIVE from order" || tx.Result != "success" || tx.ParentID != [8]byte(parent.Span) {
+		t.Fatalf("unexpected transaction %+v", tx)
+	}
+}
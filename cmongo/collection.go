@@ -0,0 +1,201 @@
+package cmongo
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrEmptyFilter 避免沒有條件時刪除整個 collection
+var ErrEmptyFilter = errors.New("cmongo: delete without filter")
+
+// Collection 綁定 collection 名稱的泛型操作，查詢條件使用 QueryBuilder，欄位依 T 的 bson tag
+//
+//	users := cmongo.NewCollection[User](db, "users")
+//	list, err := users.Find(ctx, cmongo.NewQueryBuilder().Where("age > ?", 18).Sort("-age"))
+type Collection[T any] struct {
+	db   *MongoDB
+	name string
+}
+
+// PageResult 分頁查詢結果，Page 從 1 開始
+type PageResult[T any] struct {
+	Items []T   `json:"items"`
+	Total int64 `json:"total"`
+	Page  int64 `json:"page"`
+	Size  int64 `json:"size"`
+}
+
+func NewCollection[T any](db *MongoDB, name string) *Collection[T] {
+	return &Collection[T]{db: db, name: name}
+}
+
+func (c *Collection[T]) Name() string {
+	return c.name
+}
+
+// FindOne 取得第一筆，查無資料時回傳 mongo.ErrNoDocuments
+func (c *Collection[T]) FindOne(ctx context.Context, qb *QueryBuilder) (T, error) {
+	var zero T
+	q := cloneQuery(qb)
+	q.Limit(1)
+	results, err := c.Find(ctx, q)
+	if err != nil {
+		return zero, err
+	}
+	if len(results) == 0 {
+		return zero, mongo.ErrNoDocuments
+	}
+	return results[0], nil
+}
+
+// Find 查無資料時回傳空的 slice
+func (c *Collection[T]) Find(ctx context.Context, qb *QueryBuilder) ([]T, error) {
+	results := make([]T, 0)
+	if err := c.db.Find(ctx, c.name, cloneQuery(qb), &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Insert 新增一筆或多筆，回傳各筆的 _id
+func (c *Collection[T]) Insert(ctx context.Context, docs ...T) ([]any, error) {
+	coll := c.db.database.Collection(c.name)
+	if len(docs) == 1 {
+		res, err := coll.InsertOne(ctx, docs[0])
+		if err != nil {
+			return nil, err
+		}
+		return []any{res.InsertedID}, nil
+	}
+	documents := make([]any, len(docs))
+	for i := range docs {
+		documents[i] = docs[i]
+	}
+	res, err := coll.InsertMany(ctx, documents)
+	if err != nil {
+		return nil, err
+	}
+	return res.InsertedIDs, nil
+}
+
+// UpdateByID update 為 T 時以 $set 更新其欄位(不含 _id)，其他型別如 bson.M{"$inc": ...} 直接使用
+// 查無資料時回傳 mongo.ErrNoDocuments
+func (c *Collection[T]) UpdateByID(ctx context.Context, id any, update any) error {
+	update, err := c.updateDoc(update)
+	if err != nil {
+		return err
+	}
+	res, err := c.db.database.Collection(c.name).UpdateByID(ctx, id, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// Upsert 以 $set 更新符合條件的第一筆，不存在時新增，回傳是否為新增
+func (c *Collection[T]) Upsert(ctx context.Context, qb *QueryBuilder, doc T) (bool, error) {
+	filter, _, _, err := cloneQuery(qb).Build()
+	if err != nil {
+		return false, err
+	}
+	update, err := c.updateDoc(doc)
+	if err != nil {
+		return false, err
+	}
+	res, err := c.db.database.Collection(c.name).UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return false, err
+	}
+	return res.UpsertedCount > 0, nil
+}
+
+// Delete 刪除所有符合條件的資料並回傳筆數，沒有條件時回傳 ErrEmptyFilter
+func (c *Collection[T]) Delete(ctx context.Context, qb *QueryBuilder) (int64, error) {
+	filter, _, _, err := cloneQuery(qb).Build()
+	if err != nil {
+		return 0, err
+	}
+	if len(filter) == 0 {
+		return 0, ErrEmptyFilter
+	}
+	res, err := c.db.database.Collection(c.name).DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return res.DeletedCount, nil
+}
+
+func (c *Collection[T]) Count(ctx context.Context, qb *QueryBuilder) (int64, error) {
+	return c.db.Count(ctx, c.name, cloneQuery(qb))
+}
+
+// Page 依 QueryBuilder 的條件及排序取得第 page 頁(從 1 開始)，忽略原本的 Limit/Offset
+func (c *Collection[T]) Page(ctx context.Context, qb *QueryBuilder, page, size int64) (PageResult[T], error) {
+	if page < 1 {
+		page = 1
+	}
+	if size < 1 {
+		size = 10
+	}
+	result := PageResult[T]{Items: make([]T, 0), Page: page, Size: size}
+	total, err := c.Count(ctx, qb)
+	if err != nil {
+		return result, err
+	}
+	result.Total = total
+	if total <= (page-1)*size {
+		return result, nil
+	}
+	q := cloneQuery(qb)
+	q.Limit(size).Offset((page - 1) * size)
+	if result.Items, err = c.Find(ctx, q); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// updateDoc T 轉為 $set，其他型別原樣回傳
+func (c *Collection[T]) updateDoc(update any) (any, error) {
+	switch v := update.(type) {
+	case T:
+		return toSetDoc(v)
+	case *T:
+		return toSetDoc(v)
+	}
+	return update, nil
+}
+
+// toSetDoc 依 bson tag 轉為 {$set: doc}，移除 _id 以免修改主鍵
+func toSetDoc(v any) (bson.D, error) {
+	raw, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	fields := make(bson.D, 0, len(doc))
+	for _, e := range doc {
+		if e.Key != "_id" {
+			fields = append(fields, e)
+		}
+	}
+	return bson.D{{Key: "$set", Value: fields}}, nil
+}
+
+// cloneQuery 複製 QueryBuilder 以免修改呼叫端的 Limit/Offset，nil 視為沒有條件
+func cloneQuery(qb *QueryBuilder) *QueryBuilder {
+	if qb == nil {
+		return NewQueryBuilder()
+	}
+	q := *qb
+	return &q
+}
@@ -0,0 +1,44 @@
+package cmongo
+
+import (
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestToSetDoc(t *testing.T) {
+	type doc struct {
+		Id   string `bson:"_id,omitempty"`
+		Name string `bson:"name"`
+		Age  int    `bson:"age,omitempty"`
+	}
+	got, err := toSetDoc(doc{Id: "1", Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := bson.D{{Key: "$set", Value: bson.D{{Key: "name", Value: "a"}}}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+
+	c := NewCollection[doc](nil, "users")
+	if u, _ := c.updateDoc(&doc{Name: "b"}); !reflect.DeepEqual(u, bson.D{{Key: "$set", Value: bson.D{{Key: "name", Value: "b"}}}}) {
+		t.Errorf("pointer update %v", u)
+	}
+	inc := bson.M{"$inc": bson.M{"age": 1}}
+	if u, _ := c.updateDoc(inc); !reflect.DeepEqual(u, inc) {
+		t.Errorf("operator update %v", u)
+	}
+}
+
+func TestCountValue(t *testing.T) {
+	for _, v := range []any{int32(3), int64(3), 3, float64(3)} {
+		if n, err := countValue(v); err != nil || n != 3 {
+			t.Errorf("%T: got %d, %v", v, n, err)
+		}
+	}
+	if _, err := countValue("3"); err == nil {
+		t.Error("string count should fail")
+	}
+}
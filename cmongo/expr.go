@@ -0,0 +1,435 @@
+package cmongo
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ErrSyntax Where/Having 字串條件無法解析
+var ErrSyntax = errors.New("cmongo: invalid query")
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokPlaceholder
+	tokOperator
+	tokLParen
+	tokRParen
+	tokComma
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// tokenize 將條件字串切成 token，字串支援單引號及雙引號
+func tokenize(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokRParen, text: ")", pos: i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{kind: tokComma, text: ",", pos: i})
+			i++
+		case c == '?':
+			tokens = append(tokens, token{kind: tokPlaceholder, text: "?", pos: i})
+			i++
+		case strings.ContainsRune("=!<>", rune(c)):
+			j := i + 1
+			if j < len(s) && strings.ContainsRune("=>", rune(s[j])) {
+				j++
+			}
+			op := s[i:j]
+			switch op {
+			case "=", "==", "!=", "<>", ">", "<", ">=", "<=":
+			default:
+				return nil, fmt.Errorf("%w: unknown operator %q at %d", ErrSyntax, op, i)
+			}
+			tokens = append(tokens, token{kind: tokOperator, text: op, pos: i})
+			i = j
+		case c == '\'' || c == '"':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(s); j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+					sb.WriteByte(s[j])
+					continue
+				}
+				if s[j] == c {
+					break
+				}
+				sb.WriteByte(s[j])
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("%w: unterminated string at %d", ErrSyntax, i)
+			}
+			tokens = append(tokens, token{kind: tokString, text: sb.String(), pos: i})
+			i = j + 1
+		case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+			j := i + 1
+			for j < len(s) && (s[j] == '.' || s[j] == 'e' || s[j] == 'E' || (s[j] >= '0' && s[j] <= '9')) {
+				// 指數可帶正負號 如1e-5
+				if (s[j] == 'e' || s[j] == 'E') && j+1 < len(s) && (s[j+1] == '-' || s[j+1] == '+') {
+					j++
+				}
+				j++
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: s[i:j], pos: i})
+			i = j
+		case isIdentByte(c):
+			j := i + 1
+			for j < len(s) && isIdentByte(s[j]) {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: s[i:j], pos: i})
+			i = j
+		default:
+			return nil, fmt.Errorf("%w: unexpected %q at %d", ErrSyntax, c, i)
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(s)}), nil
+}
+
+// isIdentByte 欄位名稱可包含英數字、_、.、$ 及非 ASCII 字元
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '.' || c == '$' || c >= 0x80 ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// exprParser 遞迴下降解析，優先順序 NOT > AND > OR，括號可改變順序
+//
+//	expr    := and { OR and }
+//	and     := not { AND not }
+//	not     := NOT not | primary
+//	primary := "(" expr ")" | field op value
+type exprParser struct {
+	tokens []token
+	pos    int
+	args   []any
+	argIdx int
+	prefix string // having 的欄位前綴
+}
+
+// parseCondition 解析字串條件為 mongo filter，`?` 依序取用 args，參數數量須與佔位符相同
+func parseCondition(condition, prefix string, args ...any) (bson.D, error) {
+	tokens, err := tokenize(condition)
+	if err != nil {
+		return nil, fmt.Errorf("%w in %q", err, condition)
+	}
+	p := &exprParser{tokens: tokens, args: args, prefix: prefix}
+	d, err := p.parseOr()
+	if err == nil && p.peek().kind != tokEOF {
+		err = p.errorf("unexpected %q", p.peek().text)
+	}
+	if err == nil && p.argIdx != len(args) {
+		err = fmt.Errorf("%w: %d placeholders but %d args", ErrSyntax, p.argIdx, len(args))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w in %q", err, condition)
+	}
+	return d, nil
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// keyword 接下來的 token 依序為指定關鍵字(不分大小寫)時取用
+func (p *exprParser) keyword(words ...string) bool {
+	for i, w := range words {
+		if p.pos+i >= len(p.tokens) {
+			return false
+		}
+		t := p.tokens[p.pos+i]
+		if t.kind != tokIdent || !strings.EqualFold(t.text, w) {
+			return false
+		}
+	}
+	p.pos += len(words)
+	return true
+}
+
+func (p *exprParser) errorf(format string, a ...any) error {
+	return fmt.Errorf("%w: %s at %d", ErrSyntax, fmt.Sprintf(format, a...), p.peek().pos)
+}
+
+func (p *exprParser) parseOr() (bson.D, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	terms := []bson.D{first}
+	for p.keyword("or") {
+		d, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, d)
+	}
+	if len(terms) == 1 {
+		return first, nil
+	}
+	return bson.D{{Key: "$or", Value: terms}}, nil
+}
+
+func (p *exprParser) parseAnd() (bson.D, error) {
+	first, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	terms := []bson.D{first}
+	for p.keyword("and") {
+		d, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, d)
+	}
+	return mergeAnd(terms), nil
+}
+
+// mergeAnd 欄位不重複時合併為同一個 document，否則使用 $and
+func mergeAnd(terms []bson.D) bson.D {
+	if len(terms) == 1 {
+		return terms[0]
+	}
+	keys := map[string]bool{}
+	var merged bson.D
+	for _, d := range terms {
+		for _, e := range d {
+			if keys[e.Key] {
+				return bson.D{{Key: "$and", Value: terms}}
+			}
+			keys[e.Key] = true
+			merged = append(merged, e)
+		}
+	}
+	return merged
+}
+
+func (p *exprParser) parseNot() (bson.D, error) {
+	// mongo 的 $not 只能用在單一欄位的運算子，整組條件取反使用 $nor
+	if p.keyword("not") {
+		d, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return bson.D{{Key: "$nor", Value: []bson.D{d}}}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (bson.D, error) {
+	if p.peek().kind == tokLParen {
+		p.next()
+		d, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next().kind != tokRParen {
+			return nil, p.errorf("missing )")
+		}
+		return d, nil
+	}
+	cond, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+	e, err := processConditionPart(cond)
+	if err != nil {
+		return nil, p.errorf("%v", err)
+	}
+	return bson.D{e}, nil
+}
+
+// parseComparison 解析 field op value
+func (p *exprParser) parseComparison() (QueryCondition, error) {
+	t := p.next()
+	if t.kind != tokIdent {
+		return QueryCondition{}, p.errorf("expected field, got %q", t.text)
+	}
+	cond := QueryCondition{Field: p.prefix + t.text}
+
+	if p.peek().kind == tokOperator {
+		cond.Operator = p.next().text
+		v, err := p.parseValue()
+		if err != nil {
+			return cond, err
+		}
+		cond.Value = []any{v}
+		return cond, nil
+	}
+
+	switch {
+	case p.keyword("is", "not", "null"):
+		cond.Operator = "is not null"
+	case p.keyword("is", "null"):
+		cond.Operator = "is null"
+	case p.keyword("not", "exists"):
+		cond.Operator = "not exists"
+	case p.keyword("exists"):
+		cond.Operator = "exists"
+	case p.keyword("not", "in"):
+		cond.Operator = "not in"
+	case p.keyword("in"):
+		cond.Operator = "in"
+	case p.keyword("not", "like"):
+		cond.Operator = "not like"
+	case p.keyword("like"):
+		cond.Operator = "like"
+	case p.keyword("not", "between"):
+		cond.Operator = "not between"
+	case p.keyword("between"):
+		cond.Operator = "between"
+	default:
+		return cond, p.errorf("expected operator after %q", t.text)
+	}
+
+	switch cond.Operator {
+	case "in", "not in":
+		values, err := p.parseList()
+		if err != nil {
+			return cond, err
+		}
+		cond.Value = values
+	case "like", "not like":
+		v, err := p.parseValue()
+		if err != nil {
+			return cond, err
+		}
+		cond.Value = []any{v}
+	case "between", "not between":
+		low, err := p.parseValue()
+		if err != nil {
+			return cond, err
+		}
+		if !p.keyword("and") {
+			return cond, p.errorf("expected AND in between")
+		}
+		high, err := p.parseValue()
+		if err != nil {
+			return cond, err
+		}
+		cond.Value = []any{low, high}
+	}
+	return cond, nil
+}
+
+// parseList 解析 "(a, ?, c)"，或單一 `?` 且參數為 slice
+func (p *exprParser) parseList() ([]any, error) {
+	if p.peek().kind == tokPlaceholder {
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return toSlice(v), nil
+	}
+	if p.next().kind != tokLParen {
+		return nil, p.errorf("expected ( or ? after in")
+	}
+	var values []any
+	for {
+		if p.peek().kind == tokPlaceholder {
+			v, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, toSlice(v)...)
+		} else {
+			v, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		t := p.next()
+		if t.kind == tokRParen {
+			return values, nil
+		}
+		if t.kind != tokComma {
+			return nil, p.errorf("expected , or ) in list")
+		}
+	}
+}
+
+// parseValue 取用佔位符或常值
+func (p *exprParser) parseValue() (any, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokPlaceholder:
+		if p.argIdx >= len(p.args) {
+			return nil, p.errorf("missing arg for placeholder %d", p.argIdx+1)
+		}
+		p.next()
+		v := p.args[p.argIdx]
+		p.argIdx++
+		return v, nil
+	case tokString:
+		p.next()
+		return t.text, nil
+	case tokNumber:
+		p.next()
+		if i, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return i, nil
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", t.text)
+		}
+		return f, nil
+	case tokIdent:
+		switch strings.ToLower(t.text) {
+		case "true":
+			p.next()
+			return true, nil
+		case "false":
+			p.next()
+			return false, nil
+		case "null":
+			p.next()
+			return nil, nil
+		}
+	}
+	return nil, p.errorf("expected value, got %q", t.text)
+}
+
+// toSlice in 的參數為 slice 或 array 時展開
+func toSlice(v any) []any {
+	rv := reflect.ValueOf(v)
+	if (rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array) || rv.Type().Elem().Kind() == reflect.Uint8 {
+		return []any{v}
+	}
+	out := make([]any, rv.Len())
+	for i := range out {
+		out[i] = rv.Index(i).Interface()
+	}
+	return out
+}
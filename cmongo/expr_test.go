@@ -0,0 +1,94 @@
+package cmongo
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestQueryBuilder_Where(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		query string
+		args  []any
+		want  bson.D
+	}{
+		{"ABC = ? and BCD > ?", []any{"字串", 123}, bson.D{
+			{Key: "ABC", Value: bson.M{"$eq": "字串"}},
+			{Key: "BCD", Value: bson.M{"$gt": 123}},
+		}},
+		{"ABC = ? and BCD > ? or QQQ > ?", []any{"字串", 123, now}, bson.D{{Key: "$or", Value: []bson.D{
+			{{Key: "ABC", Value: bson.M{"$eq": "字串"}}, {Key: "BCD", Value: bson.M{"$gt": 123}}},
+			{{Key: "QQQ", Value: bson.M{"$gt": now}}},
+		}}}},
+		{"a = 1 and (b != 'x' or not c in (?, 3))", []any{2}, bson.D{
+			{Key: "a", Value: bson.M{"$eq": int64(1)}},
+			{Key: "$or", Value: []bson.D{
+				{{Key: "b", Value: bson.M{"$ne": "x"}}},
+				{{Key: "$nor", Value: []bson.D{{{Key: "c", Value: bson.M{"$in": []any{2, int64(3)}}}}}}},
+			}},
+		}},
+		{"age > ? and age < ?", []any{1, 5}, bson.D{{Key: "$and", Value: []bson.D{
+			{{Key: "age", Value: bson.M{"$gt": 1}}},
+			{{Key: "age", Value: bson.M{"$lt": 5}}},
+		}}}},
+		{"tag not in ? AND age between ? and ? AND deleted is null AND name exists", []any{[]string{"a", "b"}, 18, 30}, bson.D{
+			{Key: "tag", Value: bson.M{"$nin": []any{"a", "b"}}},
+			{Key: "age", Value: bson.D{{Key: "$gte", Value: 18}, {Key: "$lte", Value: 30}}},
+			{Key: "deleted", Value: nil},
+			{Key: "name", Value: bson.M{"$exists": true}},
+		}},
+		{"score > 1e-5 and rate < 2.5E+3", nil, bson.D{
+			{Key: "score", Value: bson.M{"$gt": 1e-5}},
+			{Key: "rate", Value: bson.M{"$lt": 2.5e3}},
+		}},
+		{"name like ?", []any{"%a.b%c"}, bson.D{
+			{Key: "name", Value: bson.M{"$regex": `a\.b.*c$`, "$options": "i"}},
+		}},
+	}
+	for _, tt := range tests {
+		filter, _, _, err := NewQueryBuilder().Where(tt.query, tt.args...).Build()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+		if !reflect.DeepEqual(filter, tt.want) {
+			t.Errorf("%s:\nwant %v\ngot  %v", tt.query, tt.want, filter)
+		}
+	}
+}
+
+func TestQueryBuilder_WhereError(t *testing.T) {
+	for _, query := range []string{
+		"a = ? and b = ?",
+		"a = ?) ",
+		"(a = ?",
+		"a ~ ?",
+		"a between ? ?",
+	} {
+		_, _, _, err := NewQueryBuilder().Where(query, 1).Build()
+		if !errors.Is(err, ErrSyntax) {
+			t.Errorf("%s: want ErrSyntax, got %v", query, err)
+		}
+	}
+	if _, _, _, err := NewQueryBuilder().Where("a = ?", 1, 2).Build(); !errors.Is(err, ErrSyntax) {
+		t.Errorf("extra args: want ErrSyntax, got %v", err)
+	}
+}
+
+func TestQueryBuilder_Having(t *testing.T) {
+	_, _, _, err := NewQueryBuilder().GroupBy("name").Sum("age").Having("age > ? or age < ?", 30, 10).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	qb := NewQueryBuilder().Having("age > ? or age < ?", 30, 10)
+	want := bson.D{{Key: "$or", Value: []bson.D{
+		{{Key: "total_age", Value: bson.M{"$gt": 30}}},
+		{{Key: "total_age", Value: bson.M{"$lt": 10}}},
+	}}}
+	if !reflect.DeepEqual(qb.having, want) {
+		t.Errorf("want %v, got %v", want, qb.having)
+	}
+}
@@ -77,9 +77,12 @@ func (m *MongoDB) InsertBatch(ctx context.Context, collection string, documents
 }
 
 func (m *MongoDB) Update(ctx context.Context, collection string, qb *QueryBuilder, update interface{}) error {
-	filter, _, _ := qb.Build()
+	filter, _, _, err := qb.Build()
+	if err != nil {
+		return err
+	}
 	coll := m.database.Collection(collection)
-	_, err := coll.UpdateOne(ctx, filter, update)
+	_, err = coll.UpdateOne(ctx, filter, update)
 	return err
 }
 
@@ -92,7 +95,10 @@ func (m *MongoDB) UpdateBatch(ctx context.Context, collection string, updates []
 	coll := m.database.Collection(collection)
 	models := make([]mongo.WriteModel, len(updates))
 	for i, update := range updates {
-		filter, _, _ := update.Filter.Build()
+		filter, _, _, err := update.Filter.Build()
+		if err != nil {
+			return err
+		}
 		models[i] = mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update.Update)
 	}
 	_, err := coll.BulkWrite(ctx, models)
@@ -100,9 +106,12 @@ func (m *MongoDB) UpdateBatch(ctx context.Context, collection string, updates []
 }
 
 func (m *MongoDB) Delete(ctx context.Context, collection string, qb *QueryBuilder) error {
-	filter, _, _ := qb.Build()
+	filter, _, _, err := qb.Build()
+	if err != nil {
+		return err
+	}
 	coll := m.database.Collection(collection)
-	_, err := coll.DeleteOne(ctx, filter)
+	_, err = coll.DeleteOne(ctx, filter)
 	return err
 }
 
@@ -110,7 +119,10 @@ func (m *MongoDB) DeleteBatch(ctx context.Context, collection string, deletes []
 	coll := m.database.Collection(collection)
 	models := make([]mongo.WriteModel, len(deletes))
 	for i, del := range deletes {
-		filter, _, _ := del.Build()
+		filter, _, _, err := del.Build()
+		if err != nil {
+			return err
+		}
 		models[i] = mongo.NewDeleteOneModel().SetFilter(filter)
 	}
 	_, err := coll.BulkWrite(ctx, models)
@@ -118,7 +130,10 @@ func (m *MongoDB) DeleteBatch(ctx context.Context, collection string, deletes []
 }
 
 func (m *MongoDB) Find(ctx context.Context, table string, qb *QueryBuilder, results any) error {
-	filter, group, opts := qb.Build()
+	filter, group, opts, err := qb.Build()
+	if err != nil {
+		return err
+	}
 	collection := m.database.Collection(table)
 	if len(group) > 0 {
 		pipeline := mongo.Pipeline{
@@ -128,6 +143,16 @@ func (m *MongoDB) Find(ctx context.Context, table string, qb *QueryBuilder, resu
 		if len(qb.having) > 0 {
 			pipeline = append(pipeline, bson.D{{Key: "$match", Value: qb.having}})
 		}
+		// 分組後的排序及分頁
+		if len(qb.sort) > 0 {
+			pipeline = append(pipeline, bson.D{{Key: "$sort", Value: qb.sort}})
+		}
+		if qb.offset > 0 {
+			pipeline = append(pipeline, bson.D{{Key: "$skip", Value: qb.offset}})
+		}
+		if qb.limit > 0 {
+			pipeline = append(pipeline, bson.D{{Key: "$limit", Value: qb.limit}})
+		}
 		cursor, err := collection.Aggregate(ctx, pipeline)
 		if err != nil {
 			return err
@@ -144,8 +169,25 @@ func (m *MongoDB) Find(ctx context.Context, table string, qb *QueryBuilder, resu
 	}
 }
 
+// Aggregate 執行 Pipeline，結果依 results 的 bson tag 解析，不在 Client 介面中以免影響既有的實作
+func (m *MongoDB) Aggregate(ctx context.Context, table string, p *Pipeline, results any) error {
+	pipeline, err := p.Build()
+	if err != nil {
+		return err
+	}
+	cursor, err := m.database.Collection(table).Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	return cursor.All(ctx, results)
+}
+
 func (m *MongoDB) Count(ctx context.Context, table string, qb *QueryBuilder) (int64, error) {
-	filter, group, _ := qb.Build()
+	filter, group, _, err := qb.Build()
+	if err != nil {
+		return 0, err
+	}
 	collection := m.database.Collection(table)
 	if len(group) > 0 {
 		pipeline := mongo.Pipeline{
@@ -167,7 +209,7 @@ func (m *MongoDB) Count(ctx context.Context, table string, qb *QueryBuilder) (in
 			return 0, err
 		}
 		if len(results) > 0 {
-			return results[0]["count"].(int64), nil
+			return countValue(results[0]["count"])
 		}
 		return 0, nil
 	} else {
@@ -179,6 +221,21 @@ func (m *MongoDB) Count(ctx context.Context, table string, qb *QueryBuilder) (in
 	}
 }
 
+// countValue $count 依數量回傳 int32 或 int64
+func countValue(v any) (int64, error) {
+	switch n := v.(type) {
+	case int32:
+		return int64(n), nil
+	case int64:
+		return n, nil
+	case int:
+		return int64(n), nil
+	case float64:
+		return int64(n), nil
+	}
+	return 0, fmt.Errorf("cmongo: unexpected count type %T", v)
+}
+
 type QueryBuilder struct {
 	filter    bson.D
 	sort      bson.D
@@ -194,7 +251,11 @@ func NewQueryBuilder() *QueryBuilder {
 	return &QueryBuilder{sumFields: map[string]bool{}}
 }
 
-func (qb *QueryBuilder) Build() (bson.D, bson.D, *options.FindOptions) {
+// Build 回傳 filter、group 及查詢選項，Where/Having 條件有誤時回傳第一個錯誤
+func (qb *QueryBuilder) Build() (bson.D, bson.D, *options.FindOptions, error) {
+	if qb.err != nil {
+		return nil, nil, nil, qb.err
+	}
 	findOptions := options.Find()
 	if qb.limit > 0 {
 		findOptions.SetLimit(qb.limit)
@@ -205,7 +266,7 @@ func (qb *QueryBuilder) Build() (bson.D, bson.D, *options.FindOptions) {
 	if len(qb.sort) > 0 {
 		findOptions.SetSort(qb.sort)
 	}
-	return qb.filter, qb.group, findOptions
+	return qb.filter, qb.group, findOptions, nil
 }
 
 // Sort default ASC, use `-` prefix as desc, example: "-age" is "age desc"
@@ -256,9 +317,13 @@ func (qb *QueryBuilder) Sum(fields ...string) *QueryBuilder {
 func (qb *QueryBuilder) Having(query interface{}, args ...interface{}) *QueryBuilder {
 	// 檢查 query 是否為字符串
 	if condition, ok := query.(string); ok {
-		if strings.Contains(condition, " ") {
-			// 處理簡單的字符串查詢
-			v := qb.processSimpleCondition(condition, true, args...)
+		if !isFieldName(condition) {
+			// 解析字串條件
+			v, err := parseCondition(condition, "total_", args...)
+			if err != nil {
+				qb.setErr(err)
+				return qb
+			}
 			qb.having = append(qb.having, v...)
 		} else if len(args) > 0 {
 			qb.having = append(qb.having, bson.E{Key: "total_" + condition, Value: args[0]})
@@ -280,13 +345,13 @@ func (qb *QueryBuilder) Having(query interface{}, args ...interface{}) *QueryBui
 			// 处理结构体类型的查询
 			bsonBytes, err := bson.Marshal(v)
 			if err != nil {
-				qb.err = err
+				qb.setErr(err)
 				return qb
 			}
 			var bsonDoc bson.D
 			err = bson.Unmarshal(bsonBytes, &bsonDoc)
 			if err != nil {
-				qb.err = err
+				qb.setErr(err)
 				return qb
 			}
 			qb.having = append(qb.having, bsonDoc...)
@@ -298,9 +363,13 @@ func (qb *QueryBuilder) Having(query interface{}, args ...interface{}) *QueryBui
 func (qb *QueryBuilder) Where(query interface{}, args ...interface{}) *QueryBuilder {
 	// 檢查 query 是否為字符串
 	if condition, ok := query.(string); ok {
-		if strings.Contains(condition, " ") {
-			// 處理簡單的字符串查詢
-			v := qb.processSimpleCondition(condition, false, args...)
+		if !isFieldName(condition) {
+			// 解析字串條件
+			v, err := parseCondition(condition, "", args...)
+			if err != nil {
+				qb.setErr(err)
+				return qb
+			}
 			qb.filter = append(qb.filter, v...)
 		} else if len(args) > 0 {
 			qb.filter = append(qb.filter, bson.E{Key: condition, Value: args[0]})
@@ -323,13 +392,13 @@ func (qb *QueryBuilder) Where(query interface{}, args ...interface{}) *QueryBuil
 			// 处理结构体类型的查询
 			bsonBytes, err := bson.Marshal(v)
 			if err != nil {
-				qb.err = err
+				qb.setErr(err)
 				return qb
 			}
 			var bsonDoc bson.D
 			err = bson.Unmarshal(bsonBytes, &bsonDoc)
 			if err != nil {
-				qb.err = err
+				qb.setErr(err)
 				return qb
 			}
 			qb.filter = append(qb.filter, bsonDoc...)
@@ -338,82 +407,68 @@ func (qb *QueryBuilder) Where(query interface{}, args ...interface{}) *QueryBuil
 	return qb
 }
 
-func (qb *QueryBuilder) processSimpleCondition(condition string, isHaving bool, args ...interface{}) bson.D {
-	// 使用正则表达式分割条件，以支持复杂条件，如 "AND"、"OR"
-	conditionParts := regexp.MustCompile(`\s+(AND|OR|and|or)\s+`).Split(condition, -1)
-	logicalOperators := regexp.MustCompile(`\s+(AND|OR|and|or)\s+`).FindAllString(condition, -1)
-
-	argIndex := 0
-	filters := make([]bson.E, 0)
-	for _, part := range conditionParts {
-		parts := strings.Fields(part)
-		if len(parts) >= 3 {
-			field := parts[0]
-			operator := parts[1]
-			var arrValue []any
-
-			if isHaving == true {
-				field = "total_" + field
-			}
-
-			// 检查是否有 '?' 占位符，若有则替换为 args 中的相应值
-			for strings.Contains(parts[2], "?") && argIndex < len(args) {
-				strings.Replace(parts[2], "?", "", 1)
-				arrValue = append(arrValue, args[argIndex])
-				argIndex++
-			}
-			if len(arrValue) == 0 {
-				arrValue = append(arrValue, parts[2])
-			}
-
-			// 创建查询条件
-			cond := QueryCondition{Field: field, Operator: operator, Value: arrValue}
-			// 处理每个子条件
-			filter := processConditionPart(cond)
-			filters = append(filters, filter)
-		}
+// setErr 只保留第一個錯誤，由 Build 回傳
+func (qb *QueryBuilder) setErr(err error) {
+	if qb.err == nil {
+		qb.err = err
 	}
+}
 
-	// 在所有条件都被处理完之后，根据逻辑运算符来组合它们
-	var result bson.D
-	for i, filter := range filters {
-		if i != 0 && i-1 < len(logicalOperators) {
-			result = append(result, filter)
-			op := parseLogic(logicalOperators[i-1])
-			result = bson.D{bson.E{Key: op, Value: result}}
-		} else {
-			result = append(result, filter)
+// isFieldName 只有欄位名稱時視為等於條件
+func isFieldName(condition string) bool {
+	if condition == "" {
+		return false
+	}
+	for i := 0; i < len(condition); i++ {
+		if !isIdentByte(condition[i]) {
+			return false
 		}
 	}
-	return result
+	return true
 }
 
 // processConditionPart 處理單個條件部分
-func processConditionPart(condition QueryCondition) bson.E {
-	// 生成过滤器
-	var filter bson.E
+func processConditionPart(condition QueryCondition) (bson.E, error) {
+	field, values := condition.Field, condition.Value
 	switch condition.Operator {
-	case "=", ">", "<", ">=", "<=":
-		if len(condition.Value) > 0 {
-			filter = bson.E{Key: condition.Field, Value: bson.M{parseOperator(condition.Operator): condition.Value[0]}}
+	case "=", "==", "!=", "<>", ">", "<", ">=", "<=":
+		return bson.E{Key: field, Value: bson.M{parseOperator(condition.Operator): values[0]}}, nil
+	case "in", "not in":
+		return bson.E{Key: field, Value: bson.M{parseOperator(condition.Operator): values}}, nil
+	case "between":
+		return bson.E{Key: field, Value: bson.D{{Key: "$gte", Value: values[0]}, {Key: "$lte", Value: values[1]}}}, nil
+	case "not between":
+		// 不在區間內，或欄位不存在
+		return bson.E{Key: field, Value: bson.M{"$not": bson.D{{Key: "$gte", Value: values[0]}, {Key: "$lte", Value: values[1]}}}}, nil
+	case "is null":
+		return bson.E{Key: field, Value: nil}, nil
+	case "is not null":
+		return bson.E{Key: field, Value: bson.M{"$ne": nil}}, nil
+	case "exists":
+		return bson.E{Key: field, Value: bson.M{"$exists": true}}, nil
+	case "not exists":
+		return bson.E{Key: field, Value: bson.M{"$exists": false}}, nil
+	case "like", "not like":
+		str, ok := values[0].(string)
+		if !ok {
+			return bson.E{}, fmt.Errorf("like pattern of %s must be string, got %T", field, values[0])
 		}
-	case "in":
-		filter = bson.E{Key: condition.Field, Value: bson.M{parseOperator(condition.Operator): condition.Value}}
-	case "like":
-		// 假设 Value 是一个字符串
-		if str, ok := condition.Value[0].(string); ok {
-			filter = buildLikeFilter(condition.Field, str)
+		filter := buildLikeFilter(field, str)
+		if condition.Operator == "not like" {
+			filter.Value = bson.M{"$not": filter.Value}
 		}
+		return filter, nil
 	}
-
-	return filter
+	return bson.E{}, fmt.Errorf("unsupported operator %q", condition.Operator)
 }
 
 // parseOperator 将常规比较操作符转换为 MongoDB 的操作符
 func parseOperator(operator string) string {
 	switch operator {
-	case "=":
+	case "=", "==":
 		return "$eq" // 等于
+	case "!=", "<>":
+		return "$ne" // 不等于
 	case ">":
 		return "$gt" // 大于
 	case "<":
@@ -424,25 +479,25 @@ func parseOperator(operator string) string {
 		return "$lte" // 小于或等于
 	case "in":
 		return "$in"
+	case "not in":
+		return "$nin"
 	default:
 		return "" // 如果操作符不匹配，返回空字符串
 	}
 }
 
-func parseLogic(logic string) string {
-	logic = strings.ToLower(strings.TrimSpace(logic))
-	return "$" + logic
-}
-
-// buildLikeFilter 創建用於模糊匹配的過濾器
+// buildLikeFilter 創建用於模糊匹配的過濾器，% 為任意字元，其餘字元依字面比對
 func buildLikeFilter(field, pattern string) bson.E {
-	regexPattern := ""
-	if strings.HasPrefix(pattern, "%") && strings.HasSuffix(pattern, "%") {
-		regexPattern = strings.Trim(pattern, "%")
-	} else if strings.HasPrefix(pattern, "%") {
-		regexPattern = strings.TrimLeft(pattern, "%") + "$"
-	} else if strings.HasSuffix(pattern, "%") {
-		regexPattern = "^" + strings.TrimRight(pattern, "%")
+	parts := strings.Split(strings.Trim(pattern, "%"), "%")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	regexPattern := strings.Join(parts, ".*")
+	if !strings.HasPrefix(pattern, "%") {
+		regexPattern = "^" + regexPattern
+	}
+	if !strings.HasSuffix(pattern, "%") {
+		regexPattern = regexPattern + "$"
 	}
 	regex := bson.M{"$regex": regexPattern, "$options": "i"} // 不區分大小寫
 	return bson.E{Key: field, Value: regex}
@@ -0,0 +1,284 @@
+package cmongo
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Pipeline aggregation 的 fluent builder，以 MongoDB.Aggregate 執行
+//
+//	p := cmongo.NewPipeline().
+//		Match(cmongo.NewQueryBuilder().Where("status = ?", "paid")).
+//		Lookup("users", "user_id", "_id", "user").
+//		Unwind("$user", false).
+//		GroupByDate("created_at", "day").Sum("amount", "total").Avg("amount", "avg").
+//		Sort("-total").
+//		Limit(10)
+type Pipeline struct {
+	stages mongo.Pipeline
+	err    error
+}
+
+func NewPipeline() *Pipeline {
+	return &Pipeline{}
+}
+
+// Build 回傳各 stage，任一步驟有誤時回傳第一個錯誤
+func (p *Pipeline) Build() (mongo.Pipeline, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return p.stages, nil
+}
+
+func (p *Pipeline) setErr(err error) *Pipeline {
+	if p.err == nil {
+		p.err = err
+	}
+	return p
+}
+
+func (p *Pipeline) add(op string, value any) *Pipeline {
+	p.stages = append(p.stages, bson.D{{Key: op, Value: value}})
+	return p
+}
+
+// last 最後一個 stage 為 op 時回傳其內容
+func (p *Pipeline) last(op string) (bson.D, bool) {
+	if len(p.stages) == 0 {
+		return nil, false
+	}
+	stage := p.stages[len(p.stages)-1]
+	if len(stage) == 0 || stage[0].Key != op {
+		return nil, false
+	}
+	doc, ok := stage[0].Value.(bson.D)
+	return doc, ok
+}
+
+func (p *Pipeline) setLast(doc bson.D) {
+	p.stages[len(p.stages)-1][0].Value = doc
+}
+
+// Stage 直接加入自訂的 stage
+func (p *Pipeline) Stage(stage bson.D) *Pipeline {
+	p.stages = append(p.stages, stage)
+	return p
+}
+
+// Match 使用 QueryBuilder 的 Where 條件，可用在分組前或分組後
+func (p *Pipeline) Match(qb *QueryBuilder) *Pipeline {
+	filter, _, _, err := cloneQuery(qb).Build()
+	if err != nil {
+		return p.setErr(err)
+	}
+	if filter == nil {
+		filter = bson.D{}
+	}
+	return p.add("$match", filter)
+}
+
+// Pipeline 將 QueryBuilder 轉為 Pipeline(條件、分組、having、排序及分頁)，可再接續其他 stage
+func (qb *QueryBuilder) Pipeline() *Pipeline {
+	p := NewPipeline().Match(qb)
+	if len(qb.group) > 0 {
+		p.add("$group", append(bson.D{}, qb.group...))
+		if len(qb.having) > 0 {
+			p.add("$match", qb.having)
+		}
+	}
+	if len(qb.sort) > 0 {
+		p.add("$sort", qb.sort)
+	}
+	if qb.offset > 0 {
+		p.Skip(qb.offset)
+	}
+	if qb.limit > 0 {
+		p.Limit(qb.limit)
+	}
+	return p
+}
+
+// Where 以字串條件加入 $match，語法與 QueryBuilder.Where 相同，欄位不加前綴
+func (p *Pipeline) Where(query string, args ...any) *Pipeline {
+	filter, err := parseCondition(query, "", args...)
+	if err != nil {
+		return p.setErr(err)
+	}
+	return p.add("$match", filter)
+}
+
+// Project 選取欄位，`-` 開頭為排除，連續呼叫合併為同一個 $project
+func (p *Pipeline) Project(fields ...string) *Pipeline {
+	doc, ok := p.last("$project")
+	for _, field := range fields {
+		if strings.HasPrefix(field, "-") {
+			doc = append(doc, bson.E{Key: strings.TrimPrefix(field, "-"), Value: 0})
+		} else {
+			doc = append(doc, bson.E{Key: field, Value: 1})
+		}
+	}
+	if ok {
+		p.setLast(doc)
+		return p
+	}
+	return p.add("$project", doc)
+}
+
+// ProjectAs 以運算式產生欄位，如 ProjectAs("year", bson.M{"$year": "$created_at"})
+func (p *Pipeline) ProjectAs(as string, expr any) *Pipeline {
+	if doc, ok := p.last("$project"); ok {
+		p.setLast(append(doc, bson.E{Key: as, Value: expr}))
+		return p
+	}
+	return p.add("$project", bson.D{{Key: as, Value: expr}})
+}
+
+// Lookup 關聯其他 collection，結果為陣列欄位 as
+func (p *Pipeline) Lookup(from, localField, foreignField, as string) *Pipeline {
+	return p.add("$lookup", bson.D{
+		{Key: "from", Value: from},
+		{Key: "localField", Value: localField},
+		{Key: "foreignField", Value: foreignField},
+		{Key: "as", Value: as},
+	})
+}
+
+// Unwind 展開陣列欄位，preserveEmpty 為 true 時保留空陣列或不存在的資料
+func (p *Pipeline) Unwind(path string, preserveEmpty bool) *Pipeline {
+	return p.add("$unwind", bson.D{
+		{Key: "path", Value: fieldRef(path)},
+		{Key: "preserveNullAndEmptyArrays", Value: preserveEmpty},
+	})
+}
+
+// GroupBy 開始新的 $group，_id 為各欄位，沒有欄位時整體彙總
+// 分組結果的欄位為 _id.<field>，之後以 Sum/Avg/Min/Max/Push/AddToSet/Count 加入彙總欄位
+func (p *Pipeline) GroupBy(fields ...string) *Pipeline {
+	var id any
+	if len(fields) > 0 {
+		keys := bson.D{}
+		for _, field := range fields {
+			keys = append(keys, bson.E{Key: field, Value: fieldRef(field)})
+		}
+		id = keys
+	}
+	return p.add("$group", bson.D{{Key: "_id", Value: id}})
+}
+
+var dateUnits = map[string]bool{
+	"year": true, "quarter": true, "month": true, "week": true,
+	"day": true, "hour": true, "minute": true, "second": true,
+}
+
+// GroupByDate 依時間欄位截斷到 unit(year/quarter/month/week/day/hour/minute/second) 分組
+// 緊接在 GroupBy 之後時加入同一個 _id，timezone 如 "Asia/Taipei" 預設 UTC，需 MongoDB 5.0 以上
+func (p *Pipeline) GroupByDate(field, unit string, timezone ...string) *Pipeline {
+	if !dateUnits[unit] {
+		return p.setErr(fmt.Errorf("cmongo: unknown date unit %q", unit))
+	}
+	trunc := bson.D{{Key: "date", Value: fieldRef(field)}, {Key: "unit", Value: unit}}
+	if len(timezone) > 0 && timezone[0] != "" {
+		trunc = append(trunc, bson.E{Key: "timezone", Value: timezone[0]})
+	}
+	key := bson.E{Key: field, Value: bson.D{{Key: "$dateTrunc", Value: trunc}}}
+
+	group, ok := p.last("$group")
+	if !ok || len(group) != 1 {
+		return p.add("$group", bson.D{{Key: "_id", Value: bson.D{key}}})
+	}
+	id, _ := group[0].Value.(bson.D)
+	group[0].Value = append(id, key)
+	p.setLast(group)
+	return p
+}
+
+// accumulate 在最後一個 $group 加入彙總欄位
+func (p *Pipeline) accumulate(op, as string, expr any) *Pipeline {
+	group, ok := p.last("$group")
+	if !ok {
+		return p.setErr(fmt.Errorf("cmongo: %s %s must follow GroupBy", op, as))
+	}
+	p.setLast(append(group, bson.E{Key: as, Value: bson.D{{Key: op, Value: expr}}}))
+	return p
+}
+
+// Sum 加總欄位 field 為 as，field 以 $ 開頭時視為運算式，如 "$$ROOT"
+func (p *Pipeline) Sum(field, as string) *Pipeline {
+	return p.accumulate("$sum", as, fieldRef(field))
+}
+
+func (p *Pipeline) Avg(field, as string) *Pipeline {
+	return p.accumulate("$avg", as, fieldRef(field))
+}
+
+func (p *Pipeline) Min(field, as string) *Pipeline {
+	return p.accumulate("$min", as, fieldRef(field))
+}
+
+func (p *Pipeline) Max(field, as string) *Pipeline {
+	return p.accumulate("$max", as, fieldRef(field))
+}
+
+// Push 收集每筆的 field 為陣列，field 為 "$$ROOT" 時收集整筆資料
+func (p *Pipeline) Push(field, as string) *Pipeline {
+	return p.accumulate("$push", as, fieldRef(field))
+}
+
+// AddToSet 收集不重複的 field 為陣列
+func (p *Pipeline) AddToSet(field, as string) *Pipeline {
+	return p.accumulate("$addToSet", as, fieldRef(field))
+}
+
+// Count 計算每組的筆數
+func (p *Pipeline) Count(as string) *Pipeline {
+	return p.accumulate("$sum", as, 1)
+}
+
+// Sort 預設 ASC，`-` 開頭為 DESC，分組後可使用彙總欄位或 _id.<field>
+func (p *Pipeline) Sort(fields ...string) *Pipeline {
+	sort := NewQueryBuilder().Sort(fields...).sort
+	if len(sort) == 0 {
+		return p
+	}
+	return p.add("$sort", sort)
+}
+
+func (p *Pipeline) Skip(n int64) *Pipeline {
+	return p.add("$skip", n)
+}
+
+func (p *Pipeline) Limit(n int64) *Pipeline {
+	return p.add("$limit", n)
+}
+
+// Facet 以子 pipeline 產生欄位 name，連續呼叫合併為同一個 $facet
+func (p *Pipeline) Facet(name string, sub *Pipeline) *Pipeline {
+	if sub == nil {
+		return p.setErr(errors.New("cmongo: nil facet pipeline " + name))
+	}
+	stages, err := sub.Build()
+	if err != nil {
+		return p.setErr(err)
+	}
+	if stages == nil {
+		stages = mongo.Pipeline{}
+	}
+	if doc, ok := p.last("$facet"); ok {
+		p.setLast(append(doc, bson.E{Key: name, Value: stages}))
+		return p
+	}
+	return p.add("$facet", bson.D{{Key: name, Value: stages}})
+}
+
+// fieldRef 欄位名稱加上 $，已是運算式時原樣回傳
+func fieldRef(field string) string {
+	if strings.HasPrefix(field, "$") {
+		return field
+	}
+	return "$" + field
+}
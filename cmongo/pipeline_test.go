@@ -0,0 +1,73 @@
+package cmongo
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestPipeline_Build(t *testing.T) {
+	p := NewPipeline().
+		Match(NewQueryBuilder().Where("status = ?", "paid")).
+		Lookup("users", "user_id", "_id", "user").
+		Unwind("user", true).
+		Project("amount", "created_at", "user.name", "-_id").
+		GroupBy("user.name").GroupByDate("created_at", "month", "Asia/Taipei").
+		Sum("amount", "total").Avg("amount", "avg").Max("amount", "max").AddToSet("$user.name", "names").Count("count").
+		Where("total >= ?", 100).
+		Sort("-total").
+		Facet("top", NewPipeline().Limit(3)).
+		Facet("all", NewPipeline())
+	stages, err := p.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := make([]string, len(stages))
+	for i, stage := range stages {
+		ops[i] = stage[0].Key
+	}
+	if want := "$match $lookup $unwind $project $group $match $sort $facet"; strings.Join(ops, " ") != want {
+		t.Fatalf("want %s, got %v", want, ops)
+	}
+	wantGroup := bson.D{
+		{Key: "_id", Value: bson.D{
+			{Key: "user.name", Value: "$user.name"},
+			{Key: "created_at", Value: bson.D{{Key: "$dateTrunc", Value: bson.D{
+				{Key: "date", Value: "$created_at"}, {Key: "unit", Value: "month"}, {Key: "timezone", Value: "Asia/Taipei"},
+			}}}},
+		}},
+		{Key: "total", Value: bson.D{{Key: "$sum", Value: "$amount"}}},
+		{Key: "avg", Value: bson.D{{Key: "$avg", Value: "$amount"}}},
+		{Key: "max", Value: bson.D{{Key: "$max", Value: "$amount"}}},
+		{Key: "names", Value: bson.D{{Key: "$addToSet", Value: "$user.name"}}},
+		{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+	}
+	if !reflect.DeepEqual(stages[4][0].Value, wantGroup) {
+		t.Errorf("group:\nwant %v\ngot  %v", wantGroup, stages[4][0].Value)
+	}
+	if facet := stages[7][0].Value.(bson.D); len(facet) != 2 {
+		t.Errorf("facets should be merged, got %v", facet)
+	}
+
+	stages, err = NewQueryBuilder().Where("age > ?", 10).GroupBy("name").Sum("age").Having("age > ?", 32).Sort("-total_age").Limit(5).
+		Pipeline().Project("total_age").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stages) != 6 || stages[1][0].Key != "$group" || stages[5][0].Key != "$project" {
+		t.Errorf("query builder pipeline %v", stages)
+	}
+	if _, err := NewQueryBuilder().Where("age >").Pipeline().Build(); !errors.Is(err, ErrSyntax) {
+		t.Errorf("query builder error should be kept, got %v", err)
+	}
+
+	if _, err := NewPipeline().Avg("amount", "avg").Build(); err == nil {
+		t.Error("accumulator without GroupBy should fail")
+	}
+	if _, err := NewPipeline().GroupByDate("created_at", "fortnight").Build(); err == nil {
+		t.Error("unknown date unit should fail")
+	}
+}
@@ -18,6 +18,14 @@ var HttpMockErr map[string]error = make(map[string]error)
 
 var tracingClient = apmhttp.WrapClient(http.DefaultClient)
 
+/*
+	替換HttpGetJSON使用的RoundTripper 仍保留apm追蹤
+	例: 使用cetcd.NewTransport 以服務名稱呼叫etcd上註冊的服務
+*/
+func SetHttpTransport(rt http.RoundTripper) {
+	tracingClient = apmhttp.WrapClient(&http.Client{Transport: rt})
+}
+
 func HttpGetJSON(ctx context.Context, url string,
 	param map[string]interface{}) (resMap map[string]interface{}, err error) {
 
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -16,6 +17,31 @@ type GoServer struct {
 	srv *http.Server
 }
 
+var (
+	shutdownLock  sync.Mutex
+	shutdownFuncs []func(ctx context.Context) error
+)
+
+/* 註冊關機時執行的動作 例: kafka寫入器flush 在http server關閉後依註冊的相反順序執行 */
+func OnShutdown(fn func(ctx context.Context) error) {
+	shutdownLock.Lock()
+	defer shutdownLock.Unlock()
+	shutdownFuncs = append(shutdownFuncs, fn)
+}
+
+/* 執行所有註冊的關機動作 未使用GoServer時可自行在關機前呼叫 */
+func Shutdown(ctx context.Context) {
+	shutdownLock.Lock()
+	funcs := shutdownFuncs
+	shutdownFuncs = nil
+	shutdownLock.Unlock()
+	for i := len(funcs) - 1; i >= 0; i-- {
+		if err := funcs[i](ctx); err != nil {
+			zlog.Error("shutdown func err:", err)
+		}
+	}
+}
+
 func ServerSet(addr string, handler http.Handler) GoServer {
 	return GoServer{srv: &http.Server{
 		Addr:    addr,
@@ -52,6 +78,8 @@ func (gs GoServer) Run() {
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Fatalf("Server Shutdown err: %s , Spend time : %d ms", err, time.Since(t).Milliseconds())
 	}
+	// 請求處理完後 執行其他元件的關閉動作
+	Shutdown(ctx)
 
 	zlog.Info("Server Exiting")
 }